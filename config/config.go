@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 
@@ -45,6 +46,9 @@ var (
 	udpIP        = flag.String("server-host", "127.0.0.1", "udp server host ")
 	udpPort      = flag.Int("server-port", 6666, "udp server port ")
 	statsdServer = flag.String("statsd-server", "127.0.0.1:9125", "statsd server address")
+	reqTimeout   = flag.Duration("request-timeout", 10*time.Second, "requests without response before the deadline are reported as timeout")
+	uaRules      = flag.String("ua-rules", "", "user agent classification rule file, replaces the built-in rules and is reloaded when modified")
+	trustedProxy = flag.String("trusted-proxies", "", "trusted proxy CIDR list separated by comma, client ip is read from forwarded headers behind them")
 )
 
 //PCAPOption 抓包相关配置
@@ -65,6 +69,12 @@ type Option struct {
 	SendCount      int
 	Close          chan struct{}
 	DiscoverConfig *DiscoverConfig
+	//端口没有单独配置时使用的可信代理
+	TrustedProxies []string
+	//User-Agent分类规则文件
+	UARulesFile string
+	//请求超过该时间没有响应时统计为超时
+	RequestTimeout time.Duration
 }
 
 //Flagparse 解析参数
@@ -86,6 +96,11 @@ func Flagparse() *Option {
 		UDPPort:        *udpPort,
 		StatsdServer:   *statsdServer,
 		DiscoverConfig: GetDiscoverConfig(),
+		UARulesFile:    *uaRules,
+		RequestTimeout: *reqTimeout,
+	}
+	if *trustedProxy != "" {
+		option.TrustedProxies = strings.Split(*trustedProxy, ",")
 	}
 	if option.Device == "" {
 		devs, err := pcap.FindAllDevs()
@@ -135,7 +150,19 @@ func getBaseConfig(disc *DiscoverConfig) {
 	if protocol == "" {
 		protocol = "http"
 	}
-	disc.Ports = append(disc.Ports, Port{Port: port, Protocol: protocol})
+	p := Port{Port: port, Protocol: protocol}
+	if routes := os.Getenv("HTTP_ROUTES"); routes != "" {
+		if err := json.Unmarshal([]byte(routes), &p.Routes); err != nil {
+			logrus.Errorf("parse env HTTP_ROUTES error,%s", err.Error())
+		}
+	}
+	if dims := os.Getenv("HTTP_DIMENSIONS"); dims != "" {
+		if err := json.Unmarshal([]byte(dims), &p.Dimensions); err != nil {
+			logrus.Errorf("parse env HTTP_DIMENSIONS error,%s", err.Error())
+		}
+	}
+	p.Mode = os.Getenv("HTTP_MODE")
+	disc.Ports = append(disc.Ports, p)
 }
 
 //DiscoverConfig 配置发现
@@ -147,4 +174,46 @@ type DiscoverConfig struct {
 type Port struct {
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"`
+	//http地址模版，优先于自动识别的模版
+	Routes []Route `json:"routes,omitempty"`
+	//可信代理的地址段，来自这些地址的请求从转发头中获取客户端地址
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	//按Host统计时的最大Host数量，超出后归入other，默认50
+	MaxHosts int `json:"max_hosts,omitempty"`
+	//已知的Host，FoldUnknownHosts为true时其余Host都归入other
+	Hosts            []string `json:"hosts,omitempty"`
+	FoldUnknownHosts bool     `json:"fold_unknown_hosts,omitempty"`
+	//请求超时时间(秒)，为0时使用 -request-timeout 参数
+	RequestTimeout int `json:"request_timeout,omitempty"`
+	//从请求头、响应头中获取的自定义统计维度
+	Dimensions []Dimension `json:"dimensions,omitempty"`
+	//长轮询地址，按规范化之后的地址匹配，以*结尾时按前缀匹配，这些请求作为会话统计
+	LongPollRoutes []string `json:"long_poll_routes,omitempty"`
+	//http端口的解析模式，graphql或elasticsearch，按报文体与API代替地址统计
+	Mode string `json:"mode,omitempty"`
+}
+
+//Dimension 基于http头的统计维度
+type Dimension struct {
+	//维度名称，为空时使用头名称
+	Name   string `json:"name"`
+	Header string `json:"header"`
+	//request或response，默认request
+	From string `json:"from"`
+	//取值规范化：lower、upper，默认只去除首尾空白
+	Normalize string `json:"normalize"`
+	//正则表达式，有分组时取第一个分组，否则取匹配的内容
+	Pattern string `json:"pattern"`
+	//允许的取值，为空时不限制，不在列表中的取值归入other
+	Allow []string `json:"allow"`
+	//最多统计的取值数量，超出后归入other，默认100
+	MaxValues int `json:"max_values"`
+}
+
+//Route 用户定义的http地址模版
+//Pattern 形如 /users/{id}/orders/*，以~开头时作为正则表达式
+//Name 不为空时作为业务名称代替地址进行统计
+type Route struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
 }
@@ -0,0 +1,79 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package metric
+
+import (
+	"strconv"
+	"strings"
+)
+
+//HTTPCache 请求与响应中与缓存相关的信息
+type HTTPCache struct {
+	//请求带有If-None-Match或If-Modified-Since
+	Conditional bool `json:"conditional"`
+	//响应为304
+	NotModified bool `json:"notModified"`
+	//响应头中是否有Cache-Control、Expires、ETag
+	CacheControl bool `json:"cacheControl"`
+	Expires      bool `json:"expires"`
+	ETag         bool `json:"etag"`
+	//响应可以被缓存：GET/HEAD请求，没有no-store，并且有有效期或校验标识
+	Cacheable bool `json:"cacheable"`
+	//上游缓存命中：X-Cache包含HIT或者Age大于0
+	UpstreamHit bool `json:"upstreamHit"`
+}
+
+//Header 可以按名称获取头部取值的请求头或响应头
+type Header interface {
+	Get(name string) string
+}
+
+//CreateHTTPCache 从已经解析的请求头与响应头中获取缓存信息
+func CreateHTTPCache(method string, status int, req, res Header) HTTPCache {
+	c := HTTPCache{
+		Conditional:  req.Get("If-None-Match") != "" || req.Get("If-Modified-Since") != "",
+		NotModified:  status == 304,
+		CacheControl: res.Get("Cache-Control") != "",
+		Expires:      res.Get("Expires") != "",
+		ETag:         res.Get("ETag") != "",
+	}
+	if xc := res.Get("X-Cache"); xc != "" {
+		c.UpstreamHit = strings.Contains(strings.ToUpper(xc), "HIT")
+	} else if age, err := strconv.Atoi(res.Get("Age")); err == nil && age > 0 {
+		c.UpstreamHit = true
+	}
+	if method != "GET" && method != "HEAD" {
+		return c
+	}
+	var fresh bool
+	for _, d := range strings.Split(res.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store":
+			return c
+		case strings.HasPrefix(d, "max-age="), strings.HasPrefix(d, "s-maxage="):
+			v, err := strconv.Atoi(d[strings.Index(d, "=")+1:])
+			if err == nil && v > 0 {
+				fresh = true
+			}
+		}
+	}
+	c.Cacheable = fresh || c.Expires || c.ETag || res.Get("Last-Modified") != "" || c.NotModified
+	return c
+}
@@ -23,9 +23,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"net/http"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
@@ -38,14 +36,30 @@ const TIMEBUCKETS = 10000
 //Maximume max 10
 const Maximume = 10
 
-//MapKey MapKey
-type MapKey string
 type httpMetricStore struct {
 	methodRequestSize  map[string]uint64
 	unusualRequestSize map[string]uint64
-	requestTimes       [TIMEBUCKETS]uint64
+	//缓存相关请求数量
+	cacheRequestSize map[string]uint64
+	requestTimes     [TIMEBUCKETS]uint64
+	lastByteTimes    [TIMEBUCKETS]uint64
+	requestBytes     uint64
+	responseBytes    uint64
+	responseSize     sizeHistogram
+	engineTimes      [TIMEBUCKETS]uint64
+	shardFailures    uint64
+	itemErrors       uint64
 	//每次发出消息后清理
 	PathCache map[string]*cache
+	//按Host统计
+	HostCache map[string]*cache
+	//按User-Agent分类统计，key为 维度.分类 如browser.Chrome
+	AgentCache map[string]*cache
+	//按请求头、响应头定义的维度统计，key为 维度.取值
+	DimensionCache map[string]*cache
+	//WebSocket与流式响应会话，按类型与按地址统计
+	SessionCache     map[string]*sessionCache
+	SessionPathCache map[string]*sessionCache
 	//每次发出消息后清理
 	IndependentIP        map[string]*cache
 	ServiceID            string
@@ -91,23 +105,70 @@ func (h *httpMetricStore) sendmessage() {
 	for _, v := range h.PathCache {
 		_, avg, max := calculate(&v.ResTime)
 		mm := MonitorMessage{
-			ServiceID:      h.ServiceID,
-			Port:           h.Port,
-			HostName:       h.HostName,
-			MessageType:    "http",
-			Key:            v.Key,
-			Count:          v.Count,
-			AbnormalCount:  v.UnusualCount,
-			AverageTime:    Round(avg, 2),
-			MaxTime:        Round(max, 2),
-			CumulativeTime: Round(avg*float64(v.Count), 2),
+			ServiceID:       h.ServiceID,
+			Port:            h.Port,
+			HostName:        h.HostName,
+			MessageType:     "http",
+			Key:             v.Key,
+			Host:            v.Host,
+			Count:           v.Count,
+			AbnormalCount:   v.UnusualCount,
+			AverageTime:     Round(avg, 2),
+			MaxTime:         Round(max, 2),
+			CumulativeTime:  Round(avg*float64(v.Count), 2),
+			RequestLength:   v.ReqLength,
+			ResponseLength:  v.ResLength,
+			MaxLastByteTime: Round(float64(v.MaxLastByteTime)/1000000, 2),
+			ResponseSizeP50: v.ResSize.percentile(0.5),
+			ResponseSizeP90: v.ResSize.percentile(0.9),
+			ResponseSizeP99: v.ResSize.percentile(0.99),
+			TimeoutCount:    v.TimeoutCount,
+			AbortedCount:    v.AbortedCount,
+		}
+		if v.EngineCount > 0 {
+			mm.AverageEngineTime = Round(float64(v.EngineTime)/float64(v.EngineCount)/1000000, 2)
+		}
+		if v.Count > 0 {
+			mm.AverageLastByteTime = Round(float64(v.LastByteTime)/float64(v.Count)/1000000, 2)
+			mm.CacheableRatio = Round(float64(v.Cacheable)/float64(v.Count), 4)
+			mm.CacheHitRatio = Round(float64(v.CacheHit)/float64(v.Count), 4)
 		}
 		caches.Add(&mm)
 	}
 	sort.Sort(caches)
 	if caches.Len() > 20 {
 		h.monitorMessageManage.Send(caches.Pop(20))
-		return
+	} else {
+		h.monitorMessageManage.Send(caches)
+	}
+	h.sendUncacheable()
+	h.sendSessions()
+}
+
+//sendUncacheable 发送不可缓存响应字节数最多的地址
+func (h *httpMetricStore) sendUncacheable() {
+	var caches = new(MonitorMessageList)
+	for _, v := range h.PathCache {
+		if v.UncacheableLength == 0 {
+			continue
+		}
+		caches.Add(&MonitorMessage{
+			ServiceID:      h.ServiceID,
+			Port:           h.Port,
+			HostName:       h.HostName,
+			MessageType:    "http.uncacheable",
+			Key:            v.Key,
+			Host:           v.Host,
+			Count:          v.Count - v.Cacheable,
+			ResponseLength: v.UncacheableLength,
+			CacheableRatio: Round(float64(v.Cacheable)/float64(v.Count), 4),
+		})
+	}
+	sort.Slice(*caches, func(i, j int) bool {
+		return (*caches)[i].ResponseLength > (*caches)[j].ResponseLength
+	})
+	if caches.Len() > 20 {
+		caches = caches.Pop(20)
 	}
 	h.monitorMessageManage.Send(caches)
 }
@@ -130,10 +191,36 @@ func (h *httpMetricStore) sendstatsd() {
 		h.unusualRequestSize[k] = 0
 	}
 	h.statsdclient.Incr("request.unusual.total", int64(errtotal))
+	for k, v := range h.cacheRequestSize {
+		h.statsdclient.Incr("cache."+k, int64(v))
+		h.cacheRequestSize[k] = 0
+	}
 	min, avg, max := calculate(&h.requestTimes)
 	h.statsdclient.FGauge("requesttime.min", min)
 	h.statsdclient.FGauge("requesttime.avg", avg)
 	h.statsdclient.FGauge("requesttime.max", max)
+	min, avg, max = calculate(&h.lastByteTimes)
+	h.statsdclient.FGauge("lastbytetime.min", min)
+	h.statsdclient.FGauge("lastbytetime.avg", avg)
+	h.statsdclient.FGauge("lastbytetime.max", max)
+	h.statsdclient.Incr("request.bytes", int64(h.requestBytes))
+	h.statsdclient.Incr("response.bytes", int64(h.responseBytes))
+	h.statsdclient.Gauge("responsesize.p50", int64(h.responseSize.percentile(0.5)))
+	h.statsdclient.Gauge("responsesize.p90", int64(h.responseSize.percentile(0.9)))
+	h.statsdclient.Gauge("responsesize.p99", int64(h.responseSize.percentile(0.99)))
+	min, avg, max = calculate(&h.engineTimes)
+	h.statsdclient.FGauge("enginetime.min", min)
+	h.statsdclient.FGauge("enginetime.avg", avg)
+	h.statsdclient.FGauge("enginetime.max", max)
+	h.statsdclient.Incr("shards.failed", int64(h.shardFailures))
+	h.statsdclient.Incr("items.failed", int64(h.itemErrors))
+	h.shardFailures, h.itemErrors = 0, 0
+	h.requestBytes, h.responseBytes = 0, 0
+	h.responseSize = sizeHistogram{}
+	h.sendLabels("host.", h.HostCache)
+	h.sendLabels("useragent.", h.AgentCache)
+	h.sendLabels("dimension.", h.DimensionCache)
+	h.sendSessionStatsd()
 	h.statsdclient.Gauge("requestclient", int64(len(h.IndependentIP)))
 }
 
@@ -148,6 +235,10 @@ func (h *httpMetricStore) clear() {
 		delete(h.PathCache, key)
 	}
 	clearKey = clearKey[:0]
+	clearCache(h.HostCache)
+	clearCache(h.AgentCache)
+	clearCache(h.DimensionCache)
+	h.clearSessions()
 	for k, v := range h.IndependentIP {
 		if v.updateTime.Add(5 * time.Minute).Before(time.Now()) {
 			clearKey = append(clearKey, k)
@@ -162,7 +253,18 @@ func (h *httpMetricStore) clear() {
 func (h *httpMetricStore) Input(message interface{}) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
+	if session, ok := message.(*HTTPSession); ok {
+		h.inputSession(session)
+		return
+	}
 	if httpms, ok := message.(*HTTPMessage); ok {
+		if httpms.Batched {
+			if httpms.Failed {
+				h.unusualRequestSize["failed"]++
+			}
+			h.inputPath(httpms, rand.Intn(TIMEBUCKETS))
+			return
+		}
 		//request method
 		h.methodRequestSize[httpms.Method]++
 		//request unusual
@@ -172,28 +274,39 @@ func (h *httpMetricStore) Input(message interface{}) {
 		if httpms.StatusCode >= 500 {
 			h.unusualRequestSize["5xx"]++
 		}
-		//requestTimes
-		randn := rand.Intn(TIMEBUCKETS)
-		h.requestTimes[randn] = uint64(httpms.TimeConsum)
+		if httpms.Result != "" {
+			h.unusualRequestSize[httpms.Result]++
+		}
+		if httpms.Failed {
+			h.unusualRequestSize["failed"]++
+		}
 		//cache
-		if c, ok := h.PathCache[httpms.URI]; ok {
-			c.Count++
-			if httpms.StatusCode >= 400 {
-				c.UnusualCount++
-			}
-			c.ResTime[randn] = uint64(httpms.TimeConsum)
-			c.updateTime = time.Now()
-		} else {
-			c := &cache{
-				Key: httpms.URI,
-			}
-			c.Count++
-			if httpms.StatusCode >= 400 {
-				c.UnusualCount++
-			}
-			c.ResTime[randn] = uint64(httpms.TimeConsum)
-			c.updateTime = time.Now()
-			h.PathCache[httpms.URI] = c
+		h.countCache(httpms.Cache)
+		//requestTimes，没有响应的请求不参与响应时间与大小的统计
+		randn := rand.Intn(TIMEBUCKETS)
+		h.requestBytes += uint64(httpms.RequestLength)
+		if httpms.Result == "" {
+			h.requestTimes[randn] = uint64(httpms.TimeConsum)
+			h.lastByteTimes[randn] = uint64(httpms.TimeToLastByte)
+			h.responseBytes += uint64(httpms.ContentLength)
+			h.responseSize.add(uint64(httpms.ContentLength))
+			h.engineTimes[randn] = uint64(httpms.EngineTime)
+		}
+		h.shardFailures += uint64(httpms.ShardFailures)
+		h.itemErrors += uint64(httpms.ItemErrors)
+		h.inputPath(httpms, randn)
+		//host
+		if httpms.Host != "" {
+			h.inputLabel(h.HostCache, StatsdName(httpms.Host), httpms, randn)
+		}
+		//user agent
+		h.inputLabel(h.AgentCache, "category."+StatsdName(httpms.UACategory), httpms, randn)
+		h.inputLabel(h.AgentCache, "browser."+StatsdName(httpms.UABrowser), httpms, randn)
+		h.inputLabel(h.AgentCache, "os."+StatsdName(httpms.UAOS), httpms, randn)
+		h.inputLabel(h.AgentCache, "device."+StatsdName(httpms.UADevice), httpms, randn)
+		//header dimensions
+		for k, v := range httpms.Dimensions {
+			h.inputLabel(h.DimensionCache, StatsdName(k)+"."+StatsdName(v), httpms, randn)
 		}
 		//remote addr
 		if c, ok := h.IndependentIP[httpms.RemoteAddr]; ok {
@@ -210,6 +323,121 @@ func (h *httpMetricStore) Input(message interface{}) {
 	}
 }
 
+//inputPath 按地址统计，按模式解析时地址为操作
+func (h *httpMetricStore) inputPath(httpms *HTTPMessage, randn int) {
+	key := httpms.URI
+	if httpms.Host != "" {
+		key = httpms.Host + " " + httpms.URI
+	}
+	c, ok := h.PathCache[key]
+	if !ok {
+		c = &cache{
+			Key:  httpms.URI,
+			Host: httpms.Host,
+		}
+		h.PathCache[key] = c
+	}
+	c.Count++
+	if httpms.unusual() {
+		c.UnusualCount++
+	}
+	c.ReqLength += uint64(httpms.RequestLength)
+	switch httpms.Result {
+	case ResultTimeout:
+		c.TimeoutCount++
+	case ResultAborted:
+		c.AbortedCount++
+	default:
+		c.ResTime[randn] = uint64(httpms.TimeConsum)
+		c.ResLength += uint64(httpms.ContentLength)
+		if !httpms.Batched {
+			c.ResSize.add(uint64(httpms.ContentLength))
+		}
+		c.LastByteTime += uint64(httpms.TimeToLastByte)
+		if uint64(httpms.TimeToLastByte) > c.MaxLastByteTime {
+			c.MaxLastByteTime = uint64(httpms.TimeToLastByte)
+		}
+		if httpms.EngineTime > 0 {
+			c.EngineTime += uint64(httpms.EngineTime)
+			c.EngineCount++
+		}
+	}
+	if httpms.Cache.Cacheable {
+		c.Cacheable++
+	} else {
+		c.UncacheableLength += uint64(httpms.ContentLength)
+	}
+	if httpms.Cache.Conditional {
+		c.Conditional++
+	}
+	if httpms.Cache.NotModified {
+		c.NotModified++
+	}
+	if httpms.Cache.UpstreamHit {
+		c.UpstreamHit++
+	}
+	if httpms.Cache.NotModified || httpms.Cache.UpstreamHit {
+		c.CacheHit++
+	}
+	c.updateTime = time.Now()
+}
+
+//inputLabel 按标签统计请求数量、异常数量与响应时间
+func (h *httpMetricStore) inputLabel(caches map[string]*cache, key string, httpms *HTTPMessage, randn int) {
+	c, ok := caches[key]
+	if !ok {
+		c = &cache{
+			Key: key,
+		}
+		caches[key] = c
+	}
+	c.Count++
+	if httpms.unusual() {
+		c.UnusualCount++
+	}
+	if httpms.Result == "" {
+		c.ResTime[randn] = uint64(httpms.TimeConsum)
+	}
+	c.updateTime = time.Now()
+}
+
+//sendLabels 发送按标签统计的数据，statsd名称为 前缀+标签+指标
+func (h *httpMetricStore) sendLabels(prefix string, caches map[string]*cache) {
+	for k, v := range caches {
+		h.statsdclient.Incr(prefix+k+".request.total", int64(v.Count))
+		h.statsdclient.Incr(prefix+k+".request.unusual.total", int64(v.UnusualCount))
+		min, avg, max := calculate(&v.ResTime)
+		h.statsdclient.FGauge(prefix+k+".requesttime.min", min)
+		h.statsdclient.FGauge(prefix+k+".requesttime.avg", avg)
+		h.statsdclient.FGauge(prefix+k+".requesttime.max", max)
+		v.Count, v.UnusualCount = 0, 0
+	}
+}
+
+//clearCache 清理5分钟没有更新的数据
+func clearCache(caches map[string]*cache) {
+	for k, v := range caches {
+		if v.updateTime.Add(5 * time.Minute).Before(time.Now()) {
+			delete(caches, k)
+		}
+	}
+}
+
+func (h *httpMetricStore) countCache(c HTTPCache) {
+	count := func(key string, ok bool) {
+		if ok {
+			h.cacheRequestSize[key]++
+		}
+	}
+	count("conditional", c.Conditional)
+	count("notmodified", c.NotModified)
+	count("cacheable", c.Cacheable)
+	count("upstreamhit", c.UpstreamHit)
+	count("cachecontrol", c.CacheControl)
+	count("expires", c.Expires)
+	count("etag", c.ETag)
+}
+
 //Start 启动
 func (h *httpMetricStore) Start() {
 	tickMessage := time.NewTicker(time.Second * 5)
@@ -234,37 +462,47 @@ func (h *httpMetricStore) Stop() {
 //HTTPMessage http protocol zeromq message
 type HTTPMessage struct {
 	Method        string `json:"method"`
+	Host          string `json:"host"`
 	URI           string `json:"uri"`
 	StatusCode    int    `json:"statusCode"`
+	RequestLength int    `json:"requestLength"`
 	ContentLength int    `json:"contentLength"`
-	TimeConsum    int64  `json:"timeConsum"`
-	RemoteAddr    string
+	//首字节时间，请求第一个报文到响应第一个报文
+	TimeConsum int64 `json:"timeConsum"`
+	//请求第一个报文到响应最后一个报文
+	TimeToLastByte int64 `json:"timeToLastByte"`
+	RemoteAddr     string
+	UserAgent      string `json:"userAgent"`
+	//User-Agent分类
+	UACategory string    `json:"uaCategory"`
+	UABrowser  string    `json:"uaBrowser"`
+	UAOS       string    `json:"uaOS"`
+	UADevice   string    `json:"uaDevice"`
+	Cache      HTTPCache `json:"cache"`
+	//按端口配置从请求头、响应头中获取的维度
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+	//没有得到响应的请求为timeout或aborted
+	Result string `json:"result,omitempty"`
+	//响应状态正常但报文体中有错误，如GraphQL响应的errors
+	Failed bool `json:"failed,omitempty"`
+	//批量请求中第一个以外的操作，只按操作统计，不计入请求数量、字节数与客户端
+	Batched bool `json:"batched,omitempty"`
+	//后端引擎自身报告的处理时间，如Elasticsearch响应的took
+	EngineTime int64 `json:"engineTime,omitempty"`
+	//Elasticsearch分片失败数量与批量操作失败数量
+	ShardFailures int `json:"shardFailures,omitempty"`
+	ItemErrors    int `json:"itemErrors,omitempty"`
 }
 
-//CreateHTTPMessage 通过response构造message
-func CreateHTTPMessage(rs *http.Response) *HTTPMessage {
-	m := &HTTPMessage{
-		Method:     rs.Request.Method,
-		StatusCode: rs.StatusCode,
-		RemoteAddr: rs.Request.RemoteAddr,
-	}
-	in := strings.Index(rs.Request.RequestURI, "?")
-	if in > -1 {
-		m.URI = rs.Request.RequestURI[:in]
-	} else {
-		m.URI = rs.Request.RequestURI
-	}
-	var ReqTime, ResTime time.Time
-	if t, ok := rs.Request.Context().Value(MapKey("ReqTime")).(time.Time); ok {
-		ReqTime = t
-	}
-	if t, ok := rs.Request.Context().Value(MapKey("ResTime")).(time.Time); ok {
-		ResTime = t
-	}
-	if !ReqTime.IsZero() && !ResTime.IsZero() {
-		m.TimeConsum = ResTime.Sub(ReqTime).Nanoseconds()
-	}
-	return m
+const (
+	//ResultTimeout 超过期限没有响应
+	ResultTimeout = "timeout"
+	//ResultAborted 连接在响应之前关闭
+	ResultAborted = "aborted"
+)
+
+func (m *HTTPMessage) unusual() bool {
+	return m.StatusCode >= 400 || m.Result != "" || m.Failed
 }
 
 //Round Round
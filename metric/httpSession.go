@@ -0,0 +1,181 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package metric
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	//SessionWebSocket 升级为WebSocket的连接
+	SessionWebSocket = "websocket"
+	//SessionUpgrade 升级为其他协议的连接
+	SessionUpgrade = "upgrade"
+	//SessionSSE text/event-stream响应
+	SessionSSE = "sse"
+	//SessionStream 流式响应或者传输时间过长的响应
+	SessionStream = "stream"
+	//SessionLongPoll 配置为长轮询的地址
+	SessionLongPoll = "longpoll"
+)
+
+//HTTPSession WebSocket连接与流式响应，不参与普通请求的响应时间统计
+//In为客户端发往服务端的方向，Out为服务端发往客户端的方向
+type HTTPSession struct {
+	Kind       string `json:"kind"`
+	Method     string `json:"method"`
+	Host       string `json:"host"`
+	URI        string `json:"uri"`
+	StatusCode int    `json:"statusCode"`
+	//请求第一个报文到会话结束
+	Duration    int64  `json:"duration"`
+	FramesIn    uint64 `json:"framesIn"`
+	FramesOut   uint64 `json:"framesOut"`
+	MessagesIn  uint64 `json:"messagesIn"`
+	MessagesOut uint64 `json:"messagesOut"`
+	BytesIn     uint64 `json:"bytesIn"`
+	BytesOut    uint64 `json:"bytesOut"`
+	//WebSocket关闭帧中的状态码，没有关闭帧时为0
+	CloseCode int `json:"closeCode"`
+}
+
+//sessionCache 会话的累计数据
+type sessionCache struct {
+	Kind        string
+	Key         string
+	Host        string
+	Count       uint64
+	Duration    uint64
+	MaxDuration uint64
+	FramesIn    uint64
+	FramesOut   uint64
+	MessagesIn  uint64
+	MessagesOut uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	CloseCodes  map[int]uint64
+	updateTime  time.Time
+}
+
+func (c *sessionCache) add(s *HTTPSession) {
+	c.Count++
+	c.Duration += uint64(s.Duration)
+	if uint64(s.Duration) > c.MaxDuration {
+		c.MaxDuration = uint64(s.Duration)
+	}
+	c.FramesIn += s.FramesIn
+	c.FramesOut += s.FramesOut
+	c.MessagesIn += s.MessagesIn
+	c.MessagesOut += s.MessagesOut
+	c.BytesIn += s.BytesIn
+	c.BytesOut += s.BytesOut
+	if s.Kind == SessionWebSocket {
+		if c.CloseCodes == nil {
+			c.CloseCodes = make(map[int]uint64)
+		}
+		c.CloseCodes[s.CloseCode]++
+	}
+	c.updateTime = time.Now()
+}
+
+//inputSession 按会话类型与地址统计
+func (h *httpMetricStore) inputSession(s *HTTPSession) {
+	c, ok := h.SessionCache[s.Kind]
+	if !ok {
+		c = &sessionCache{Kind: s.Kind, Key: s.Kind}
+		h.SessionCache[s.Kind] = c
+	}
+	c.add(s)
+	key := s.Kind + " " + s.Host + " " + s.URI
+	pc, ok := h.SessionPathCache[key]
+	if !ok {
+		pc = &sessionCache{Kind: s.Kind, Key: s.URI, Host: s.Host}
+		h.SessionPathCache[key] = pc
+	}
+	pc.add(s)
+}
+
+//sendSessionStatsd 发送各类会话的累计数据，发送后清零
+func (h *httpMetricStore) sendSessionStatsd() {
+	for k, v := range h.SessionCache {
+		prefix := "session." + k + "."
+		h.statsdclient.Incr(prefix+"total", int64(v.Count))
+		if v.Count > 0 {
+			h.statsdclient.FGauge(prefix+"duration.avg", float64(v.Duration)/float64(v.Count)/1000000)
+		}
+		h.statsdclient.FGauge(prefix+"duration.max", float64(v.MaxDuration)/1000000)
+		h.statsdclient.Incr(prefix+"frames.in", int64(v.FramesIn))
+		h.statsdclient.Incr(prefix+"frames.out", int64(v.FramesOut))
+		h.statsdclient.Incr(prefix+"messages.in", int64(v.MessagesIn))
+		h.statsdclient.Incr(prefix+"messages.out", int64(v.MessagesOut))
+		h.statsdclient.Incr(prefix+"bytes.in", int64(v.BytesIn))
+		h.statsdclient.Incr(prefix+"bytes.out", int64(v.BytesOut))
+		for code, n := range v.CloseCodes {
+			name := strconv.Itoa(code)
+			if code == 0 {
+				name = "none"
+			}
+			h.statsdclient.Incr(prefix+"close."+name, int64(n))
+		}
+		*v = sessionCache{Kind: v.Kind, Key: v.Key}
+	}
+}
+
+//sendSessions 发送累计时间最长的会话地址
+func (h *httpMetricStore) sendSessions() {
+	var caches = new(MonitorMessageList)
+	for _, v := range h.SessionPathCache {
+		avg := float64(v.Duration) / float64(v.Count) / 1000000
+		caches.Add(&MonitorMessage{
+			ServiceID:      h.ServiceID,
+			Port:           h.Port,
+			HostName:       h.HostName,
+			MessageType:    "http.session",
+			SessionType:    v.Kind,
+			Key:            v.Key,
+			Host:           v.Host,
+			Count:          v.Count,
+			AverageTime:    Round(avg, 2),
+			MaxTime:        Round(float64(v.MaxDuration)/1000000, 2),
+			CumulativeTime: Round(float64(v.Duration)/1000000, 2),
+			RequestLength:  v.BytesIn,
+			ResponseLength: v.BytesOut,
+			FramesIn:       v.FramesIn,
+			FramesOut:      v.FramesOut,
+			MessagesIn:     v.MessagesIn,
+			MessagesOut:    v.MessagesOut,
+		})
+	}
+	sort.Sort(sort.Reverse(caches))
+	if caches.Len() > 20 {
+		caches = caches.Pop(20)
+	}
+	h.monitorMessageManage.Send(caches)
+}
+
+//clearSessions 清理5分钟没有更新的会话地址
+func (h *httpMetricStore) clearSessions() {
+	for k, v := range h.SessionPathCache {
+		if v.updateTime.Add(5 * time.Minute).Before(time.Now()) {
+			delete(h.SessionPathCache, k)
+		}
+	}
+}
@@ -51,12 +51,18 @@ func NewMetric(protocol, messageServer, statsdserver string, messagePort, port i
 	}
 	hostname, _ := os.Hostname()
 	switch protocol {
-	case "http":
+	case "http", "fastcgi":
 		ctx, cancel := context.WithCancel(context.Background())
 		return &httpMetricStore{
 			methodRequestSize:    make(map[string]uint64),
 			unusualRequestSize:   make(map[string]uint64),
+			cacheRequestSize:     make(map[string]uint64),
 			PathCache:            make(map[string]*cache),
+			HostCache:            make(map[string]*cache),
+			AgentCache:           make(map[string]*cache),
+			DimensionCache:       make(map[string]*cache),
+			SessionCache:         make(map[string]*sessionCache),
+			SessionPathCache:     make(map[string]*sessionCache),
 			IndependentIP:        make(map[string]*cache),
 			ServiceID:            os.Getenv("SERVICE_ID"),
 			Port:                 strconv.Itoa(port),
@@ -80,6 +86,8 @@ func NewMetric(protocol, messageServer, statsdserver string, messagePort, port i
 			monitorMessageManage: mmm,
 			statsdclient:         statsdclient,
 		}
+	case "mongodb", "memcached", "kafka", "amqp", "mqtt", "nats", "zookeeper", "dubbo", "thrift", "cassandra", "mssql":
+		return newProtocolMetricStore(protocol, strconv.Itoa(port), hostname, mmm, statsdclient)
 	default:
 		return nil
 	}
@@ -92,6 +100,8 @@ type MonitorMessage struct {
 	HostName    string
 	MessageType string //mysql，http ...
 	Key         string
+	//http请求的Host
+	Host string
 	//总时间
 	CumulativeTime float64
 	AverageTime    float64
@@ -99,6 +109,30 @@ type MonitorMessage struct {
 	Count          uint64
 	//异常请求次数
 	AbnormalCount uint64
+	//请求到响应最后一个报文的时间
+	AverageLastByteTime float64
+	MaxLastByteTime     float64
+	//请求与响应报文体累计字节数
+	RequestLength  uint64
+	ResponseLength uint64
+	//响应报文体大小分布
+	ResponseSizeP50 uint64
+	ResponseSizeP90 uint64
+	ResponseSizeP99 uint64
+	//可缓存响应占比与缓存命中(304或上游缓存命中)占比
+	CacheableRatio float64
+	CacheHitRatio  float64
+	//没有得到响应的请求：超时与连接提前关闭
+	TimeoutCount uint64
+	AbortedCount uint64
+	//WebSocket与流式响应会话的类型，两个方向的帧数与消息数
+	SessionType string
+	FramesIn    uint64
+	FramesOut   uint64
+	MessagesIn  uint64
+	MessagesOut uint64
+	//后端引擎报告的平均处理时间，如Elasticsearch的took
+	AverageEngineTime float64
 }
 
 //MonitorMessageList 消息列表
@@ -183,9 +217,29 @@ func CreateStatsdClient(server, prefix string) *statsd.StatsdClient {
 
 type cache struct {
 	Key          string
+	Host         string
 	Count        uint64
 	UnusualCount uint64
 	ResTime      [TIMEBUCKETS]uint64
 	updateTime   time.Time
 	ResLength    uint64
+	ReqLength    uint64
+	ResSize      sizeHistogram
+	//请求到响应最后一个报文的累计时间与最大时间
+	LastByteTime    uint64
+	MaxLastByteTime uint64
+	//缓存相关的请求数量
+	Cacheable   uint64
+	Conditional uint64
+	NotModified uint64
+	UpstreamHit uint64
+	//命中缓存(304或上游缓存命中)的请求数量，每个请求最多计一次
+	CacheHit uint64
+	//不可缓存响应的累计字节数
+	UncacheableLength uint64
+	TimeoutCount      uint64
+	AbortedCount      uint64
+	//后端引擎报告的累计处理时间与次数
+	EngineTime  uint64
+	EngineCount uint64
 }
@@ -120,7 +120,10 @@ func (h *mysqlMetricStore) Input(message interface{}) {
 	defer h.lock.Unlock()
 	if mm, ok := message.(*MysqlMessage); ok {
 		randn := rand.Intn(TIMEBUCKETS)
-		h.requestTimes[randn] = mm.Reqtime
+		//超时与连接关闭的查询没有响应时间
+		if mm.Reqtime > 0 {
+			h.requestTimes[randn] = mm.Reqtime
+		}
 		h.sqlRequestSize[mm.Code]++
 		//cache
 		if c, ok := h.PathCache[mm.SQL]; ok {
@@ -128,7 +131,9 @@ func (h *mysqlMetricStore) Input(message interface{}) {
 			if mm.Code != "Success" {
 				c.UnusualCount++
 			}
-			c.ResTime[randn] = mm.Reqtime
+			if mm.Reqtime > 0 {
+				c.ResTime[randn] = mm.Reqtime
+			}
 			c.ResLength += mm.ContentLength
 			c.updateTime = time.Now()
 		} else {
@@ -139,7 +144,9 @@ func (h *mysqlMetricStore) Input(message interface{}) {
 			if mm.Code != "Success" {
 				c.UnusualCount++
 			}
-			c.ResTime[randn] = mm.Reqtime
+			if mm.Reqtime > 0 {
+				c.ResTime[randn] = mm.Reqtime
+			}
 			c.updateTime = time.Now()
 			h.PathCache[mm.SQL] = c
 		}
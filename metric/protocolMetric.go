@@ -0,0 +1,424 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package metric
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quipo/statsd"
+)
+
+//ProtocolMessage 请求响应类协议(如mongodb、kafka)的一次请求
+type ProtocolMessage struct {
+	//命令，如 find、produce，按命令统计数量与响应时间
+	Command string `json:"command"`
+	//资源，如集合、topic，按资源统计数量与响应时间，可以为空
+	Resource string `json:"resource"`
+	//排行使用的key，为空时使用 命令 资源
+	Key string `json:"key"`
+	//错误码，成功时为空
+	Code string `json:"code"`
+	//没有得到响应的请求为timeout或aborted
+	Result     string `json:"result,omitempty"`
+	RemoteAddr string
+	//响应时间，没有响应的请求或不需要响应的消息为0
+	ReqTime        uint64 `json:"reqtime"`
+	RequestLength  uint64 `json:"requestLength"`
+	ResponseLength uint64 `json:"responseLength"`
+	//协议相关的累计值，key为statsd指标名称
+	Counters map[string]uint64 `json:"counters,omitempty"`
+	//协议相关的瞬时值，如连接的客户端数量，保留最后一次的取值
+	Gauges map[string]int64 `json:"gauges,omitempty"`
+	//额外的排行，如热点key、大value
+	Tops []TopEntry `json:"tops,omitempty"`
+	//同一请求中第一个以外的资源(如Produce中的其他topic)，只按资源与排行统计，不计入请求数量
+	Batched bool `json:"batched,omitempty"`
+}
+
+//TopEntry 额外排行中的一项，ByBytes为true时按最大字节数排序(如大value)，否则按次数排序(如热点key)
+type TopEntry struct {
+	List    string
+	Key     string
+	Bytes   uint64
+	ByBytes bool
+}
+
+func (m *ProtocolMessage) unusual() bool {
+	return m.Code != "" || m.Result != ""
+}
+
+func (m *ProtocolMessage) key() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	if m.Resource != "" {
+		return m.Command + " " + m.Resource
+	}
+	return m.Command
+}
+
+//maxTopEntries 每个额外排行在一个统计周期内记录的最大key数量
+const maxTopEntries = 300
+
+//topCount 额外排行中一个key的次数与最大字节数
+type topCount struct {
+	Count uint64
+	Bytes uint64
+}
+
+//protocolRatios 各协议由计数器计算的比例
+var protocolRatios = map[string]map[string][2]string{
+	"memcached": {"get.hitratio": {"get.hits", "get.misses"}},
+}
+
+type protocolMetricStore struct {
+	protocol    string
+	commandSize map[string]uint64
+	unusualSize map[string]uint64
+	//请求报文与响应报文的累计字节数
+	requestBytes  uint64
+	responseBytes uint64
+	requestTimes  [TIMEBUCKETS]uint64
+	counters      map[string]uint64
+	gauges        map[string]int64
+	//按key统计，发送排行
+	PathCache map[string]*cache
+	//按命令、资源统计，发送statsd
+	CommandCache  map[string]*cache
+	ResourceCache map[string]*cache
+	//额外的排行，按排行名称与key统计，每次发送之后重新统计
+	TopCache map[string]map[string]*topCount
+	topBytes map[string]bool
+	//由两个计数器计算的比例，如命中率，取值为[分子, 另一部分]
+	ratios               map[string][2]string
+	IndependentIP        map[string]*cache
+	ServiceID            string
+	Port                 string
+	HostName             string
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	lock                 sync.Mutex
+	monitorMessageManage *MonitorMessageManage
+	statsdclient         *statsd.StatsdClient
+}
+
+func newProtocolMetricStore(protocol, port, hostname string, mmm *MonitorMessageManage, statsdclient *statsd.StatsdClient) *protocolMetricStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &protocolMetricStore{
+		protocol:             protocol,
+		commandSize:          make(map[string]uint64),
+		unusualSize:          make(map[string]uint64),
+		counters:             make(map[string]uint64),
+		gauges:               make(map[string]int64),
+		PathCache:            make(map[string]*cache),
+		CommandCache:         make(map[string]*cache),
+		ResourceCache:        make(map[string]*cache),
+		TopCache:             make(map[string]map[string]*topCount),
+		topBytes:             make(map[string]bool),
+		ratios:               protocolRatios[protocol],
+		IndependentIP:        make(map[string]*cache),
+		ServiceID:            os.Getenv("SERVICE_ID"),
+		Port:                 port,
+		HostName:             hostname,
+		cancel:               cancel,
+		ctx:                  ctx,
+		monitorMessageManage: mmm,
+		statsdclient:         statsdclient,
+	}
+}
+
+//sendmessage 发送累计时间最长的20个key与额外的排行
+func (h *protocolMetricStore) sendmessage() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var caches = new(MonitorMessageList)
+	for _, v := range h.PathCache {
+		_, avg, max := calculate(&v.ResTime)
+		caches.Add(&MonitorMessage{
+			ServiceID:      h.ServiceID,
+			Port:           h.Port,
+			HostName:       h.HostName,
+			MessageType:    h.protocol,
+			Key:            v.Key,
+			Count:          v.Count,
+			AbnormalCount:  v.UnusualCount,
+			AverageTime:    Round(avg, 2),
+			MaxTime:        Round(max, 2),
+			CumulativeTime: Round(avg*float64(v.Count), 2),
+			RequestLength:  v.ReqLength,
+			ResponseLength: v.ResLength,
+			TimeoutCount:   v.TimeoutCount,
+			AbortedCount:   v.AbortedCount,
+		})
+	}
+	sort.Sort(sort.Reverse(caches))
+	if caches.Len() > 20 {
+		caches = caches.Pop(20)
+	}
+	h.monitorMessageManage.Send(caches)
+	for list, entries := range h.TopCache {
+		var tops = new(MonitorMessageList)
+		for k, v := range entries {
+			tops.Add(&MonitorMessage{
+				ServiceID:      h.ServiceID,
+				Port:           h.Port,
+				HostName:       h.HostName,
+				MessageType:    h.protocol + "." + list,
+				Key:            k,
+				Count:          v.Count,
+				ResponseLength: v.Bytes,
+			})
+		}
+		byBytes := h.topBytes[list]
+		sort.Slice(*tops, func(i, j int) bool {
+			if byBytes {
+				return (*tops)[i].ResponseLength > (*tops)[j].ResponseLength
+			}
+			return (*tops)[i].Count > (*tops)[j].Count
+		})
+		if tops.Len() > 20 {
+			tops = tops.Pop(20)
+		}
+		h.monitorMessageManage.Send(tops)
+	}
+	h.TopCache = make(map[string]map[string]*topCount)
+}
+
+//inputTop 统计额外排行，key数量达到上限时替换最小的一项，
+//按次数排序时新的key继承被替换项的次数，热点key不会因为出现较晚而被忽略
+func (h *protocolMetricStore) inputTop(t TopEntry) {
+	entries, ok := h.TopCache[t.List]
+	if !ok {
+		entries = make(map[string]*topCount)
+		h.TopCache[t.List] = entries
+		h.topBytes[t.List] = t.ByBytes
+	}
+	c, ok := entries[t.Key]
+	if !ok {
+		if len(entries) >= maxTopEntries {
+			var minKey string
+			var min *topCount
+			for k, v := range entries {
+				if min == nil || (t.ByBytes && v.Bytes < min.Bytes) || (!t.ByBytes && v.Count < min.Count) {
+					minKey, min = k, v
+				}
+			}
+			if t.ByBytes && t.Bytes <= min.Bytes {
+				return
+			}
+			delete(entries, minKey)
+			c = &topCount{}
+			if !t.ByBytes {
+				c.Count = min.Count
+			}
+		} else {
+			c = &topCount{}
+		}
+		entries[t.Key] = c
+	}
+	c.Count++
+	if t.Bytes > c.Bytes {
+		c.Bytes = t.Bytes
+	}
+}
+
+//sendstatsd send metric to statsd
+func (h *protocolMetricStore) sendstatsd() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var total int64
+	for k, v := range h.commandSize {
+		h.statsdclient.Incr("request."+k, int64(v))
+		total += int64(v)
+		h.commandSize[k] = 0
+	}
+	h.statsdclient.Incr("request.total", total)
+	var errtotal int64
+	for k, v := range h.unusualSize {
+		h.statsdclient.Incr("request.unusual."+k, int64(v))
+		errtotal += int64(v)
+		h.unusualSize[k] = 0
+	}
+	h.statsdclient.Incr("request.unusual.total", errtotal)
+	min, avg, max := calculate(&h.requestTimes)
+	h.statsdclient.FGauge("requesttime.min", min)
+	h.statsdclient.FGauge("requesttime.avg", avg)
+	h.statsdclient.FGauge("requesttime.max", max)
+	h.statsdclient.Incr("request.bytes", int64(h.requestBytes))
+	h.statsdclient.Incr("response.bytes", int64(h.responseBytes))
+	h.requestBytes, h.responseBytes = 0, 0
+	for name, parts := range h.ratios {
+		if a, b := h.counters[parts[0]], h.counters[parts[1]]; a+b > 0 {
+			h.statsdclient.FGauge(name, Round(float64(a)/float64(a+b), 4))
+		}
+	}
+	for k, v := range h.counters {
+		h.statsdclient.Incr(k, int64(v))
+		h.counters[k] = 0
+	}
+	for k, v := range h.gauges {
+		h.statsdclient.Gauge(k, v)
+	}
+	h.sendLabels("command.", h.CommandCache)
+	h.sendLabels("resource.", h.ResourceCache)
+	h.statsdclient.Gauge("request.client", int64(len(h.IndependentIP)))
+}
+
+//sendLabels 发送按标签统计的数据，statsd名称为 前缀+标签+指标
+func (h *protocolMetricStore) sendLabels(prefix string, caches map[string]*cache) {
+	for k, v := range caches {
+		h.statsdclient.Incr(prefix+k+".request.total", int64(v.Count))
+		h.statsdclient.Incr(prefix+k+".request.unusual.total", int64(v.UnusualCount))
+		min, avg, max := calculate(&v.ResTime)
+		h.statsdclient.FGauge(prefix+k+".requesttime.min", min)
+		h.statsdclient.FGauge(prefix+k+".requesttime.avg", avg)
+		h.statsdclient.FGauge(prefix+k+".requesttime.max", max)
+		if v.ReqLength > 0 {
+			h.statsdclient.Incr(prefix+k+".request.bytes", int64(v.ReqLength))
+		}
+		v.Count, v.UnusualCount, v.ReqLength = 0, 0, 0
+	}
+}
+
+func (h *protocolMetricStore) clear() {
+	clearCache(h.PathCache)
+	clearCache(h.CommandCache)
+	clearCache(h.ResourceCache)
+	clearCache(h.IndependentIP)
+}
+
+//Input 数据输入
+func (h *protocolMetricStore) Input(message interface{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	pm, ok := message.(*ProtocolMessage)
+	if !ok {
+		return
+	}
+	for k, v := range pm.Counters {
+		h.counters[k] += v
+	}
+	for k, v := range pm.Gauges {
+		h.gauges[k] = v
+	}
+	for _, t := range pm.Tops {
+		h.inputTop(t)
+	}
+	//只有计数器、瞬时值或排行的消息
+	if pm.Command == "" {
+		return
+	}
+	randn := rand.Intn(TIMEBUCKETS)
+	if !pm.Batched {
+		h.commandSize[StatsdName(pm.Command)]++
+	}
+	switch {
+	case pm.Result != "":
+		h.unusualSize[pm.Result]++
+	case pm.Code != "":
+		h.unusualSize[StatsdName(pm.Code)]++
+	}
+	if pm.ReqTime > 0 && !pm.Batched {
+		h.requestTimes[randn] = pm.ReqTime
+	}
+	h.requestBytes += pm.RequestLength
+	h.responseBytes += pm.ResponseLength
+	key := pm.key()
+	c, ok := h.PathCache[key]
+	if !ok {
+		c = &cache{Key: key}
+		h.PathCache[key] = c
+	}
+	c.Count++
+	if pm.unusual() {
+		c.UnusualCount++
+	}
+	switch pm.Result {
+	case ResultTimeout:
+		c.TimeoutCount++
+	case ResultAborted:
+		c.AbortedCount++
+	}
+	if pm.ReqTime > 0 {
+		c.ResTime[randn] = pm.ReqTime
+	}
+	c.ReqLength += pm.RequestLength
+	c.ResLength += pm.ResponseLength
+	c.updateTime = time.Now()
+	if pm.Resource != "" {
+		h.inputLabel(h.ResourceCache, StatsdName(pm.Resource), pm, randn)
+	}
+	if pm.Batched {
+		return
+	}
+	h.inputLabel(h.CommandCache, StatsdName(pm.Command), pm, randn)
+	if pm.RemoteAddr != "" {
+		ip, ok := h.IndependentIP[pm.RemoteAddr]
+		if !ok {
+			ip = &cache{Key: pm.RemoteAddr}
+			h.IndependentIP[pm.RemoteAddr] = ip
+		}
+		ip.Count++
+		ip.updateTime = time.Now()
+	}
+}
+
+//inputLabel 按标签统计请求数量、异常数量与响应时间
+func (h *protocolMetricStore) inputLabel(caches map[string]*cache, key string, pm *ProtocolMessage, randn int) {
+	c, ok := caches[key]
+	if !ok {
+		c = &cache{Key: key}
+		caches[key] = c
+	}
+	c.Count++
+	if pm.unusual() {
+		c.UnusualCount++
+	}
+	if pm.ReqTime > 0 {
+		c.ResTime[randn] = pm.ReqTime
+	}
+	c.ReqLength += pm.RequestLength
+	c.updateTime = time.Now()
+}
+
+//Start 启动
+func (h *protocolMetricStore) Start() {
+	tickMessage := time.NewTicker(time.Second * 5)
+	for {
+		select {
+		case <-h.ctx.Done():
+			tickMessage.Stop()
+			return
+		case <-tickMessage.C:
+			h.sendmessage()
+			h.sendstatsd()
+			h.clear()
+		}
+	}
+}
+
+//Stop 停止
+func (h *protocolMetricStore) Stop() {
+	h.cancel()
+}
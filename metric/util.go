@@ -18,6 +18,12 @@
 
 package metric
 
+import (
+	"math"
+	"math/bits"
+	"strings"
+)
+
 func calculate(timings *[TIMEBUCKETS]uint64) (fmin, favg, fmax float64) {
 	var counts, total, min, max, avg uint64 = 0, 0, 0, 0, 0
 	hasmin := false
@@ -43,3 +49,44 @@ func calculate(timings *[TIMEBUCKETS]uint64) (fmin, favg, fmax float64) {
 	return float64(min) / 1000000, float64(avg) / 1000000,
 		float64(max) / 1000000
 }
+
+//SIZEBUCKETS 报文大小分布的桶数量，第i个桶存放二进制位数为i的大小
+const SIZEBUCKETS = 48
+
+//sizeHistogram 报文大小分布
+type sizeHistogram [SIZEBUCKETS]uint64
+
+func (s *sizeHistogram) add(size uint64) {
+	i := bits.Len64(size)
+	if i >= SIZEBUCKETS {
+		i = SIZEBUCKETS - 1
+	}
+	s[i]++
+}
+
+//percentile 返回分位数p所在桶的上界
+func (s *sizeHistogram) percentile(p float64) uint64 {
+	var total uint64
+	for _, c := range s {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(float64(total) * p))
+	var seen uint64
+	for i, c := range s {
+		seen += c
+		if seen >= rank {
+			return 1<<uint(i) - 1
+		}
+	}
+	return 1<<uint(SIZEBUCKETS-1) - 1
+}
+
+var statsdReplacer = strings.NewReplacer(".", "_", " ", "_", ":", "_", "/", "_", "|", "_", "@", "_")
+
+//StatsdName 替换会破坏statsd层级与协议格式的字符
+func StatsdName(s string) string {
+	return statsdReplacer.Replace(s)
+}
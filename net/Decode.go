@@ -35,6 +35,8 @@ type SourceData struct {
 	SourceHost  *gopacket.Endpoint
 	TargetHost  *gopacket.Endpoint
 	TCP         *layers.TCP
+	//ProxyClient 连接开始的PROXY协议头中的真实客户端地址，没有时为nil
+	ProxyClient *ProxyAddr
 }
 
 //Decode 不同协议解码器接口
@@ -49,6 +51,30 @@ func FindDecode(option *config.Option, port config.Port) Decode {
 		return CreateHTTPDecode(option, port)
 	case "mysql":
 		return CreateMysqlDecode(option, port)
+	case "fastcgi":
+		return CreateFastCGIDecode(option, port)
+	case "mongodb":
+		return CreateMongoDecode(option, port)
+	case "memcached":
+		return CreateMemcachedDecode(option, port)
+	case "kafka":
+		return CreateKafkaDecode(option, port)
+	case "amqp":
+		return CreateAMQPDecode(option, port)
+	case "mqtt":
+		return CreateMQTTDecode(option, port)
+	case "nats":
+		return CreateNATSDecode(option, port)
+	case "zookeeper":
+		return CreateZooKeeperDecode(option, port)
+	case "dubbo":
+		return CreateDubboDecode(option, port)
+	case "thrift":
+		return CreateThriftDecode(option, port)
+	case "cassandra":
+		return CreateCassandraDecode(option, port)
+	case "mssql":
+		return CreateMSSQLDecode(option, port)
 	default:
 		return nil
 	}
@@ -0,0 +1,652 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+	"time"
+)
+
+//AMQP帧类型
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+)
+
+//AMQP方法，取值为 class<<16 | method
+const (
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpConnectionBlocked = 10<<16 | 60
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicReturn       = 60<<16 | 50
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicGet          = 60<<16 | 70
+	amqpBasicGetOk        = 60<<16 | 71
+	amqpBasicGetEmpty     = 60<<16 | 72
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicReject       = 60<<16 | 90
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+)
+
+const (
+	//maxAMQPFrame 认为是AMQP帧的最大长度，超出时重新同步
+	maxAMQPFrame = 128 << 20
+	//maxAMQPLabels 统计的最大exchange与队列数量，超出后归入other
+	maxAMQPLabels = 500
+	//maxAMQPRoutingKeys 排行中的最大routing key数量，超出后归入other
+	maxAMQPRoutingKeys = 1000
+	//amqpConfirmKey 等待确认的消息在请求表中的key，与同步方法的通道号区分
+	amqpConfirmKey = 1 << 63
+	//amqpConfirmSeq key中发布消息序号的部分，高位为通道号
+	amqpConfirmSeq = 1<<40 - 1
+)
+
+//amqpMethods 统计的方法名称
+var amqpMethods = map[uint32]string{
+	10<<16 | 40: "connection.open", 10<<16 | 50: "connection.close",
+	20<<16 | 10: "channel.open", 20<<16 | 20: "channel.flow", 20<<16 | 40: "channel.close",
+	40<<16 | 10: "exchange.declare", 40<<16 | 20: "exchange.delete", 40<<16 | 30: "exchange.bind",
+	40<<16 | 40: "exchange.unbind", 50<<16 | 10: "queue.declare", 50<<16 | 20: "queue.bind",
+	50<<16 | 30: "queue.purge", 50<<16 | 40: "queue.delete", 50<<16 | 50: "queue.unbind",
+	60<<16 | 10: "basic.qos", 60<<16 | 20: "basic.consume", 60<<16 | 30: "basic.cancel",
+	60<<16 | 40: "basic.publish", 60<<16 | 50: "basic.return", 60<<16 | 60: "basic.deliver",
+	60<<16 | 70: "basic.get", 60<<16 | 110: "basic.recover", 85<<16 | 10: "confirm.select",
+	90<<16 | 10: "tx.select", 90<<16 | 20: "tx.commit", 90<<16 | 30: "tx.rollback",
+}
+
+//amqpReplyCodes 关闭连接与通道时的应答码
+var amqpReplyCodes = map[uint16]string{
+	311: "CONTENT_TOO_LARGE", 312: "NO_ROUTE", 313: "NO_CONSUMERS", 320: "CONNECTION_FORCED",
+	402: "INVALID_PATH", 403: "ACCESS_REFUSED", 404: "NOT_FOUND", 405: "RESOURCE_LOCKED",
+	406: "PRECONDITION_FAILED", 501: "FRAME_ERROR", 502: "SYNTAX_ERROR", 503: "COMMAND_INVALID",
+	504: "CHANNEL_ERROR", 505: "UNEXPECTED_FRAME", 506: "RESOURCE_ERROR", 530: "NOT_ALLOWED",
+	540: "NOT_IMPLEMENTED", 541: "INTERNAL_ERROR",
+}
+
+//amqpChannel 通道状态
+type amqpChannel struct {
+	open bool
+	//confirm模式下发布消息的序号，只在观察到confirm.select后统计，序号才与服务端一致
+	confirm   bool
+	published uint64
+	//消费者标签对应的队列
+	consumers map[string]*amqpConsumer
+	//未确认的投递，按delivery tag记录队列
+	unacked map[uint64]string
+	//等待内容头部的消息，两个方向分别记录，deferred为true时客户端方向的消息在确认时统计
+	content  [2]*metric.ProtocolMessage
+	deferred bool
+}
+
+type amqpConsumer struct {
+	queue string
+	noAck bool
+}
+
+//amqpConn 连接状态
+type amqpConn struct {
+	start    time.Time
+	open     bool
+	channels map[uint16]*amqpChannel
+}
+
+//amqpCall 等待响应的同步方法或等待确认的消息
+type amqpCall struct {
+	msg *metric.ProtocolMessage
+	//basic.consume与basic.get的队列
+	queue string
+	noAck bool
+}
+
+//AMQPDecode AMQP 0-9-1协议(RabbitMQ)解码
+type AMQPDecode struct {
+	*tcpStream
+	labels      *labelFolder
+	routingKeys *labelFolder
+	//打开的连接与通道数量，按队列统计的未确认投递数量
+	connections int64
+	channels    int64
+	unacked     map[string]int64
+}
+
+//CreateAMQPDecode CreateAMQPDecode
+func CreateAMQPDecode(option *config.Option, port config.Port) *AMQPDecode {
+	d := &AMQPDecode{
+		labels:      newLabelFolder(maxAMQPLabels),
+		routingKeys: newLabelFolder(maxAMQPRoutingKeys),
+		unacked:     make(map[string]int64),
+	}
+	d.tcpStream = newTCPStream("amqp", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *AMQPDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if request && bytes.HasPrefix(buf, []byte("AMQP")) {
+		return 8, 8
+	}
+	if len(buf) < 7 {
+		return 0, 0
+	}
+	size := int(binary.BigEndian.Uint32(buf[3:]))
+	if size > maxAMQPFrame {
+		return -1, 0
+	}
+	total = 7 + size + 1
+	switch buf[0] {
+	case amqpFrameBody:
+		return total, 7
+	case amqpFrameMethod, amqpFrameHeader, amqpFrameHeartbeat:
+		return total, total
+	}
+	return -1, 0
+}
+
+func (d *AMQPDecode) conn(c *streamConn) *amqpConn {
+	if c.state == nil {
+		c.state = &amqpConn{start: c.now, channels: make(map[uint16]*amqpChannel)}
+	}
+	return c.state.(*amqpConn)
+}
+
+func (a *amqpConn) channel(id uint16) *amqpChannel {
+	ch, ok := a.channels[id]
+	if !ok {
+		ch = &amqpChannel{consumers: make(map[string]*amqpConsumer), unacked: make(map[uint64]string)}
+		a.channels[id] = ch
+	}
+	return ch
+}
+
+func (d *AMQPDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	ac := d.conn(c)
+	if frame[0] == 'A' {
+		ac.start = c.now
+		return
+	}
+	id := binary.BigEndian.Uint16(frame[1:])
+	payload := frame[7:]
+	if len(payload) > total-8 {
+		payload = payload[:total-8]
+	}
+	dir := 0
+	if !request {
+		dir = 1
+	}
+	switch frame[0] {
+	case amqpFrameHeader:
+		//内容头部中的body size
+		if len(payload) < 12 {
+			return
+		}
+		ch := ac.channel(id)
+		if msg := ch.content[dir]; msg != nil {
+			size := binary.BigEndian.Uint64(payload[4:])
+			name := "deliver.bytes"
+			if request {
+				msg.RequestLength = size
+				name = "publish.bytes"
+			} else {
+				msg.ResponseLength = size
+			}
+			msg.Counters = map[string]uint64{name: size}
+			ch.flush(s, dir)
+		}
+	case amqpFrameMethod:
+		if len(payload) < 4 {
+			return
+		}
+		ch := ac.channel(id)
+		ch.flush(s, dir)
+		method := binary.BigEndian.Uint32(payload)
+		args := &amqpReader{p: payload[4:]}
+		if request {
+			d.clientMethod(s, c, ac, id, ch, method, args, total)
+		} else {
+			d.serverMethod(s, c, ac, id, ch, method, args, total)
+		}
+	}
+}
+
+//flush 统计等待内容头部的消息
+func (ch *amqpChannel) flush(s *tcpStream, dir int) {
+	if msg := ch.content[dir]; msg != nil && (dir == 1 || !ch.deferred) {
+		s.store.Input(msg)
+	}
+	ch.content[dir] = nil
+}
+
+//clientMethod 客户端发送的方法
+func (d *AMQPDecode) clientMethod(s *tcpStream, c *streamConn, ac *amqpConn, id uint16, ch *amqpChannel, method uint32, args *amqpReader, total int) {
+	switch method {
+	case amqpBasicPublish:
+		args.skip(2)
+		exchange := args.shortstr()
+		key := args.shortstr()
+		msg := d.message(c, "basic.publish", d.labels.fold(amqpExchange(exchange)))
+		msg.Key = "basic.publish " + msg.Resource + " " + d.routingKeys.fold(key)
+		ch.content[0], ch.deferred = msg, ch.confirm
+		if ch.confirm {
+			//消息在确认时统计，得到发布到确认的时间
+			ch.published++
+			c.call(amqpConfirmKey|uint64(id)<<40|ch.published, &amqpCall{msg: msg})
+		}
+		return
+	case amqpBasicAck, amqpBasicNack, amqpBasicReject:
+		tag := args.longlong()
+		multiple := method != amqpBasicReject && args.octet()&1 != 0
+		d.acknowledge(s, ch, method, tag, multiple)
+		return
+	case amqpConfirmSelect:
+		ch.confirm = true
+	case amqpConnectionCloseOk:
+		d.closeConn(s, ac)
+		return
+	case amqpChannelCloseOk:
+		d.closeChannel(s, ac, id)
+		return
+	}
+	name, ok := amqpMethods[method]
+	if !ok {
+		return
+	}
+	sync := amqpSync(method, &amqpReader{p: args.p})
+	call := &amqpCall{msg: d.message(c, name, "")}
+	call.msg.RequestLength = uint64(total)
+	switch method / 65536 {
+	case 40:
+		args.skip(2)
+		call.msg.Resource = d.labels.fold(amqpExchange(args.shortstr()))
+	case 50:
+		args.skip(2)
+		call.msg.Resource = d.labels.fold(args.shortstr())
+	}
+	switch method {
+	case amqpBasicConsume, amqpBasicGet:
+		args.skip(2)
+		call.queue = args.shortstr()
+		call.msg.Resource = d.labels.fold(call.queue)
+		if method == amqpBasicConsume {
+			tag := args.shortstr()
+			bits := args.octet()
+			call.noAck = bits&2 != 0
+			//no-wait时没有consume-ok，使用客户端指定的标签
+			if bits&8 != 0 {
+				ch.consumers[tag] = &amqpConsumer{queue: call.queue, noAck: call.noAck}
+				s.store.Input(call.msg)
+				return
+			}
+		} else {
+			call.noAck = args.octet()&1 != 0
+		}
+	case amqpConnectionClose, amqpChannelClose:
+		code := args.short()
+		call.msg.Code = amqpReplyCode(code)
+		kind := "channel"
+		if method == amqpConnectionClose {
+			kind = "connection"
+		}
+		call.msg.Counters = map[string]uint64{"close." + kind + "." + strconv.Itoa(int(code)): 1}
+	}
+	if sync {
+		c.call(uint64(id), call)
+		return
+	}
+	s.store.Input(call.msg)
+}
+
+//amqpSync 需要等待-ok响应的方法，带有no-wait时不等待
+func amqpSync(method uint32, args *amqpReader) bool {
+	switch method {
+	case 40<<16 | 10, 40<<16 | 20, 40<<16 | 30, 40<<16 | 40, 50<<16 | 10, 50<<16 | 20,
+		50<<16 | 30, 50<<16 | 40, 60<<16 | 30, amqpConfirmSelect:
+		//no-wait为最后一个bit字段，参数解析失败时认为需要响应
+		return !args.noWait(method)
+	case 10<<16 | 40, amqpConnectionClose, 20<<16 | 10, amqpChannelClose, 50<<16 | 50, 60<<16 | 10,
+		60<<16 | 110, amqpBasicConsume, amqpBasicGet, 90<<16 | 10, 90<<16 | 20, 90<<16 | 30:
+		return true
+	}
+	return false
+}
+
+//serverMethod 服务端发送的方法
+func (d *AMQPDecode) serverMethod(s *tcpStream, c *streamConn, ac *amqpConn, id uint16, ch *amqpChannel, method uint32, args *amqpReader, total int) {
+	switch method {
+	case amqpBasicDeliver:
+		tag := args.shortstr()
+		delivery := args.longlong()
+		consumer := ch.consumers[tag]
+		queue := ""
+		if consumer != nil {
+			queue = consumer.queue
+		}
+		msg := d.message(c, "basic.deliver", d.labels.fold(queue))
+		if consumer != nil && !consumer.noAck {
+			msg.Gauges = d.deliver(ch, delivery, msg.Resource)
+		}
+		ch.content[1] = msg
+	case amqpBasicAck, amqpBasicNack:
+		//confirm模式下服务端对发布消息的确认
+		if !ch.confirm {
+			return
+		}
+		tag := args.longlong()
+		if args.octet()&1 == 0 {
+			d.confirmed(s, c, method, c.reply(amqpConfirmKey|uint64(id)<<40|tag))
+			return
+		}
+		//multiple时确认该通道中序号不超过tag的所有消息，只遍历等待确认的消息
+		prefix := amqpConfirmKey | uint64(id)<<40
+		for key := range c.pending {
+			if key&^amqpConfirmSeq == prefix && key&amqpConfirmSeq <= tag {
+				d.confirmed(s, c, method, c.reply(key))
+			}
+		}
+	case amqpBasicReturn:
+		code := args.short()
+		args.shortstr()
+		msg := d.message(c, "basic.return", d.labels.fold(amqpExchange(args.shortstr())))
+		msg.Code = amqpReplyCode(code)
+		ch.content[1] = msg
+	case amqpConnectionBlocked:
+		s.store.Input(&metric.ProtocolMessage{Counters: map[string]uint64{"connection.blocked": 1}})
+	case amqpConnectionClose, amqpChannelClose:
+		//服务端关闭通道或连接，通常由错误引起，等待响应的方法统计为该错误
+		code := args.short()
+		kind, key := "channel", uint64(id)
+		if method == amqpConnectionClose {
+			kind = "connection"
+		}
+		msg := d.message(c, kind+".close", "")
+		msg.Code = amqpReplyCode(code)
+		msg.Counters = map[string]uint64{"close." + kind + "." + strconv.Itoa(int(code)): 1}
+		s.store.Input(msg)
+		if call := c.reply(key); call != nil {
+			d.finish(s, c, call, msg.Code, total)
+		}
+	case amqpConnectionCloseOk:
+		if call := c.reply(uint64(id)); call != nil {
+			d.finish(s, c, call, "", total)
+		}
+		d.closeConn(s, ac)
+	case amqpChannelCloseOk:
+		if call := c.reply(uint64(id)); call != nil {
+			d.finish(s, c, call, "", total)
+		}
+		d.closeChannel(s, ac, id)
+	default:
+		//同步方法的响应
+		call := c.reply(uint64(id))
+		if call == nil {
+			return
+		}
+		pc := call.value.(*amqpCall)
+		switch method {
+		case amqpConnectionOpenOk:
+			//连接建立的时间从协议头开始，包括认证
+			pc.msg.ReqTime = uint64(c.now.Sub(ac.start).Nanoseconds())
+			pc.msg.ResponseLength = uint64(total)
+			d.connections++
+			ac.open = true
+			pc.msg.Gauges = map[string]int64{"connections": d.connections}
+			s.store.Input(pc.msg)
+			return
+		case amqpChannelOpenOk:
+			ch.open = true
+			d.channels++
+			pc.msg.Gauges = map[string]int64{"channels": d.channels}
+		case amqpBasicConsumeOk:
+			ch.consumers[args.shortstr()] = &amqpConsumer{queue: pc.queue, noAck: pc.noAck}
+		case amqpBasicGetOk:
+			delivery := args.longlong()
+			if !pc.noAck {
+				pc.msg.Gauges = d.deliver(ch, delivery, pc.msg.Resource)
+			}
+		case amqpBasicGetEmpty:
+			pc.msg.Counters = map[string]uint64{"get.empty": 1}
+		}
+		d.finish(s, c, call, "", total)
+	}
+}
+
+func (d *AMQPDecode) finish(s *tcpStream, c *streamConn, call *streamCall, code string, total int) {
+	msg := call.value.(*amqpCall).msg
+	if code != "" {
+		msg.Code = code
+	}
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	s.store.Input(msg)
+}
+
+//confirmed 统计服务端确认的消息
+func (d *AMQPDecode) confirmed(s *tcpStream, c *streamConn, method uint32, call *streamCall) {
+	if call == nil {
+		return
+	}
+	msg := call.value.(*amqpCall).msg
+	msg.ReqTime = c.elapsed(call)
+	if method == amqpBasicNack {
+		msg.Code = "NACK"
+	}
+	s.store.Input(msg)
+}
+
+func (d *AMQPDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*amqpCall).msg
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//closed 连接关闭时清除其中的通道与未确认的投递
+func (d *AMQPDecode) closed(s *tcpStream, c *streamConn) {
+	if c.state != nil {
+		d.closeConn(s, c.state.(*amqpConn))
+	}
+}
+
+func (d *AMQPDecode) message(c *streamConn, command, resource string) *metric.ProtocolMessage {
+	return &metric.ProtocolMessage{Command: command, Resource: resource, RemoteAddr: c.client}
+}
+
+//deliver 记录需要确认的投递，返回队列的未确认数量
+func (d *AMQPDecode) deliver(ch *amqpChannel, tag uint64, queue string) map[string]int64 {
+	ch.unacked[tag] = queue
+	d.unacked[queue]++
+	return d.unackedGauges(queue)
+}
+
+//acknowledge 客户端确认、拒绝投递
+func (d *AMQPDecode) acknowledge(s *tcpStream, ch *amqpChannel, method uint32, tag uint64, multiple bool) {
+	counter := map[uint32]string{amqpBasicAck: "acked", amqpBasicNack: "nacked", amqpBasicReject: "rejected"}[method]
+	msg := &metric.ProtocolMessage{Counters: make(map[string]uint64), Gauges: make(map[string]int64)}
+	ack := func(t uint64, queue string) {
+		delete(ch.unacked, t)
+		d.unacked[queue]--
+		msg.Counters[counter]++
+		msg.Counters["queue."+metric.StatsdName(queue)+"."+counter]++
+		for k, v := range d.unackedGauges(queue) {
+			msg.Gauges[k] = v
+		}
+	}
+	if multiple {
+		//tag为0时确认所有投递
+		for t, queue := range ch.unacked {
+			if t <= tag || tag == 0 {
+				ack(t, queue)
+			}
+		}
+	} else if queue, ok := ch.unacked[tag]; ok {
+		ack(tag, queue)
+	}
+	if len(msg.Counters) > 0 {
+		s.store.Input(msg)
+	}
+}
+
+func (d *AMQPDecode) unackedGauges(queue string) map[string]int64 {
+	var total int64
+	for _, n := range d.unacked {
+		total += n
+	}
+	gauges := map[string]int64{"unacked": total}
+	if queue != "" {
+		gauges["queue."+metric.StatsdName(queue)+".unacked"] = d.unacked[queue]
+	}
+	return gauges
+}
+
+//closeChannel 通道关闭，未确认的投递重新入队
+func (d *AMQPDecode) closeChannel(s *tcpStream, ac *amqpConn, id uint16) {
+	ch, ok := ac.channels[id]
+	if !ok {
+		return
+	}
+	delete(ac.channels, id)
+	msg := &metric.ProtocolMessage{Gauges: make(map[string]int64)}
+	for _, queue := range ch.unacked {
+		d.unacked[queue]--
+		for k, v := range d.unackedGauges(queue) {
+			msg.Gauges[k] = v
+		}
+	}
+	if ch.open {
+		d.channels--
+		msg.Gauges["channels"] = d.channels
+	}
+	if len(msg.Gauges) > 0 {
+		s.store.Input(msg)
+	}
+}
+
+func (d *AMQPDecode) closeConn(s *tcpStream, ac *amqpConn) {
+	for id := range ac.channels {
+		d.closeChannel(s, ac, id)
+	}
+	if ac.open {
+		ac.open = false
+		d.connections--
+		s.store.Input(&metric.ProtocolMessage{Gauges: map[string]int64{"connections": d.connections}})
+	}
+}
+
+//amqpExchange 默认exchange的名称为空
+func amqpExchange(name string) string {
+	if name == "" {
+		return "amq.default"
+	}
+	return name
+}
+
+//amqpReplyCode 应答码名称，200为正常
+func amqpReplyCode(code uint16) string {
+	if code == 200 {
+		return ""
+	}
+	if name, ok := amqpReplyCodes[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+//amqpReader 读取方法参数，数据不足时返回零值
+type amqpReader struct {
+	p []byte
+}
+
+func (a *amqpReader) take(n int) []byte {
+	if n > len(a.p) {
+		a.p = nil
+		return nil
+	}
+	b := a.p[:n]
+	a.p = a.p[n:]
+	return b
+}
+
+func (a *amqpReader) skip(n int) {
+	a.take(n)
+}
+
+func (a *amqpReader) octet() byte {
+	if b := a.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (a *amqpReader) short() uint16 {
+	if b := a.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (a *amqpReader) longlong() uint64 {
+	if b := a.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (a *amqpReader) shortstr() string {
+	return string(a.take(int(a.octet())))
+}
+
+//noWait 读取声明、绑定、删除等方法的no-wait标志
+func (a *amqpReader) noWait(method uint32) bool {
+	switch method {
+	case amqpConfirmSelect:
+		return a.octet()&1 != 0
+	case 60<<16 | 30:
+		a.shortstr()
+		return a.octet()&1 != 0
+	}
+	a.skip(2)
+	//包括exchange或队列名称在内的字符串参数数量
+	strs := map[uint32]int{
+		40<<16 | 10: 2, 40<<16 | 20: 1, 40<<16 | 30: 3, 40<<16 | 40: 3,
+		50<<16 | 10: 1, 50<<16 | 20: 3, 50<<16 | 30: 1, 50<<16 | 40: 1,
+	}[method]
+	for i := 0; i < strs; i++ {
+		a.shortstr()
+	}
+	//no-wait之前的bit字段数量
+	bits := map[uint32]uint{
+		40<<16 | 10: 4, 40<<16 | 20: 1, 40<<16 | 30: 0, 40<<16 | 40: 0,
+		50<<16 | 10: 4, 50<<16 | 20: 0, 50<<16 | 30: 0, 50<<16 | 40: 2,
+	}[method]
+	return a.octet()&(1<<bits) != 0
+}
@@ -0,0 +1,157 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//amqpArgs 按AMQP类型生成方法参数，string为shortstr，uint16为short，uint64为longlong，byte为octet
+func amqpArgs(args ...interface{}) []byte {
+	var p []byte
+	for _, a := range args {
+		switch v := a.(type) {
+		case string:
+			p = append(append(p, byte(len(v))), v...)
+		case uint16:
+			p = append(p, byte(v>>8), byte(v))
+		case uint32:
+			p = append(p, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(p[len(p)-4:], v)
+		case uint64:
+			p = append(p, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(p[len(p)-8:], v)
+		case byte:
+			p = append(p, v)
+		}
+	}
+	return p
+}
+
+//amqpFrame 生成帧
+func amqpFrame(kind byte, channel uint16, payload []byte) []byte {
+	f := []byte{kind, byte(channel >> 8), byte(channel), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(f[3:], uint32(len(payload)))
+	return append(append(f, payload...), 0xce)
+}
+
+//amqpMethod 方法帧
+func amqpMethod(channel uint16, method uint32, args ...interface{}) []byte {
+	return amqpFrame(amqpFrameMethod, channel, append(amqpArgs(method), amqpArgs(args...)...))
+}
+
+//amqpContent 内容头部与内容帧
+func amqpContent(channel uint16, body string) []byte {
+	header := amqpFrame(amqpFrameHeader, channel, amqpArgs(uint16(60), uint16(0), uint64(len(body)), uint16(0)))
+	return append(header, amqpFrame(amqpFrameBody, channel, []byte(body))...)
+}
+
+func TestAMQPDecode(t *testing.T) {
+	client := func(frames ...[]byte) streamSegment { return streamSegment{true, joinFrames(frames)} }
+	server := func(frames ...[]byte) streamSegment { return streamSegment{false, joinFrames(frames)} }
+	publish := func(exchange, key, body string) []byte {
+		return append(amqpMethod(1, amqpBasicPublish, uint16(0), exchange, key, byte(0)), amqpContent(1, body)...)
+	}
+	const (
+		confirmSelectOk = 85<<16 | 11
+		queueDeclare    = 50<<16 | 10
+		queueDeclareOk  = 50<<16 | 11
+	)
+	runStreamTests(t, func() streamParser {
+		return &AMQPDecode{labels: newLabelFolder(maxAMQPLabels), routingKeys: newLabelFolder(maxAMQPRoutingKeys), unacked: make(map[string]int64)}
+	}, []streamTest{
+		{
+			name: "publish without confirms",
+			segments: []streamSegment{
+				client([]byte("AMQP\x00\x00\x09\x01"), publish("", "tasks", "hello")),
+				client(publish("orders", "order.created", "{}")),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "basic.publish", Resource: "amq.default", Key: "basic.publish amq.default tasks", RequestLength: 5, Counters: map[string]uint64{"publish.bytes": 5}},
+				{Command: "basic.publish", Resource: "orders", Key: "basic.publish orders order.created", RequestLength: 2},
+			},
+		},
+		{
+			name: "publisher confirms",
+			segments: []streamSegment{
+				client(amqpMethod(1, amqpConfirmSelect, byte(0))),
+				server(amqpMethod(1, confirmSelectOk)),
+				client(publish("orders", "a", "1"), publish("orders", "a", "2"), publish("orders", "b", "3")),
+				server(amqpMethod(1, amqpBasicAck, uint64(2), byte(1))),
+				server(amqpMethod(1, amqpBasicNack, uint64(3), byte(0))),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "confirm.select"},
+				{Command: "basic.publish", Resource: "orders", Key: "basic.publish orders a"},
+				{Command: "basic.publish", Resource: "orders", Key: "basic.publish orders a"},
+				{Command: "basic.publish", Resource: "orders", Key: "basic.publish orders b", Code: "NACK"},
+			},
+		},
+		{
+			//没有观察到confirm.select时不统计服务端的确认，发布的消息立即统计
+			name: "confirms without confirm.select",
+			segments: []streamSegment{
+				client(publish("orders", "a", "1")),
+				server(amqpMethod(1, amqpBasicAck, uint64(1<<40), byte(1))),
+			},
+			want: []metric.ProtocolMessage{{Command: "basic.publish", Resource: "orders", Key: "basic.publish orders a"}},
+		},
+		{
+			name: "consume and ack",
+			segments: []streamSegment{
+				client(amqpMethod(1, amqpBasicConsume, uint16(0), "jobs", "ctag", byte(0), uint32(0))),
+				server(amqpMethod(1, amqpBasicConsumeOk, "ctag")),
+				server(amqpMethod(1, amqpBasicDeliver, "ctag", uint64(1), byte(0), "", "jobs"), amqpContent(1, "work")),
+				client(amqpMethod(1, amqpBasicAck, uint64(1), byte(0))),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "basic.consume", Resource: "jobs"},
+				{Command: "basic.deliver", Resource: "jobs", ResponseLength: 4, Counters: map[string]uint64{"deliver.bytes": 4}, Gauges: map[string]int64{"unacked": 1, "queue.jobs.unacked": 1}},
+				{Counters: map[string]uint64{"acked": 1, "queue.jobs.acked": 1}, Gauges: map[string]int64{"unacked": 0}},
+			},
+		},
+		{
+			name: "channel closed by server",
+			segments: []streamSegment{
+				client(amqpMethod(2, queueDeclare, uint16(0), "missing", byte(1), uint32(0))),
+				server(amqpMethod(2, amqpChannelClose, uint16(404), "NOT_FOUND - no queue 'missing'", uint16(50), uint16(10))),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "channel.close", Code: "NOT_FOUND", Counters: map[string]uint64{"close.channel.404": 1}},
+				{Command: "queue.declare", Resource: "missing", Code: "NOT_FOUND"},
+			},
+		},
+		{
+			name:     "declare timeout",
+			segments: []streamSegment{client(amqpMethod(1, queueDeclare, uint16(0), "jobs", byte(0), uint32(0)))},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "queue.declare", Resource: "jobs", Result: metric.ResultTimeout}},
+		},
+	})
+}
+
+func joinFrames(frames [][]byte) []byte {
+	var p []byte
+	for _, f := range frames {
+		p = append(p, f...)
+	}
+	return p
+}
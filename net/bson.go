@@ -0,0 +1,288 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+//BSON类型
+const (
+	bsonDouble    = 0x01
+	bsonString    = 0x02
+	bsonDocument  = 0x03
+	bsonArray     = 0x04
+	bsonBinary    = 0x05
+	bsonObjectID  = 0x07
+	bsonBool      = 0x08
+	bsonDateTime  = 0x09
+	bsonNull      = 0x0a
+	bsonRegex     = 0x0b
+	bsonDBPointer = 0x0c
+	bsonCode      = 0x0d
+	bsonSymbol    = 0x0e
+	bsonCodeScope = 0x0f
+	bsonInt32     = 0x10
+	bsonTimestamp = 0x11
+	bsonInt64     = 0x12
+	bsonDecimal   = 0x13
+)
+
+const (
+	//maxShapeDepth 查询条件规范化时保留的最大嵌套层数
+	maxShapeDepth = 3
+	//maxShapeLength 规范化之后查询条件的最大长度
+	maxShapeLength = 200
+)
+
+//bsonDoc 一个BSON文档，报文被截断时只解析完整的元素
+type bsonDoc []byte
+
+//bsonElement 文档中的一个元素
+type bsonElement struct {
+	kind  byte
+	name  []byte
+	value []byte
+}
+
+//readBSON 读取p开头的文档，返回文档与文档声明的长度
+func readBSON(p []byte) (bsonDoc, int) {
+	if len(p) < 5 {
+		return nil, 0
+	}
+	n := int(int32(binary.LittleEndian.Uint32(p)))
+	if n < 5 {
+		return nil, 0
+	}
+	if n > len(p) {
+		return bsonDoc(p), n
+	}
+	return bsonDoc(p[:n]), n
+}
+
+//each 按顺序遍历元素，fn返回false时停止
+func (d bsonDoc) each(fn func(e bsonElement) bool) {
+	if len(d) < 5 {
+		return
+	}
+	p := d[4:]
+	for len(p) > 0 && p[0] != 0 {
+		kind := p[0]
+		end := bytes.IndexByte(p[1:], 0)
+		if end < 0 {
+			return
+		}
+		name := p[1 : 1+end]
+		p = p[2+end:]
+		size := bsonValueSize(kind, p)
+		if size < 0 || size > len(p) {
+			return
+		}
+		if !fn(bsonElement{kind: kind, name: name, value: p[:size]}) {
+			return
+		}
+		p = p[size:]
+	}
+}
+
+//lookup 查找名称为name的元素
+func (d bsonDoc) lookup(name string) (found bsonElement, ok bool) {
+	d.each(func(e bsonElement) bool {
+		if string(e.name) == name {
+			found, ok = e, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+//first 文档的第一个元素，命令文档中为命令名称
+func (d bsonDoc) first() (found bsonElement, ok bool) {
+	d.each(func(e bsonElement) bool {
+		found, ok = e, true
+		return false
+	})
+	return
+}
+
+//count 元素的数量，用于数组
+func (d bsonDoc) count() int {
+	n := 0
+	d.each(func(e bsonElement) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+//bsonValueSize 返回值的长度，无法确定时返回-1
+func bsonValueSize(kind byte, p []byte) int {
+	int32At := func(i int) int {
+		if len(p) < i+4 {
+			return -1
+		}
+		return int(int32(binary.LittleEndian.Uint32(p[i:])))
+	}
+	switch kind {
+	case bsonNull, 0x06, 0x7f, 0xff:
+		return 0
+	case bsonBool:
+		return 1
+	case bsonInt32:
+		return 4
+	case bsonDouble, bsonDateTime, bsonTimestamp, bsonInt64:
+		return 8
+	case bsonObjectID:
+		return 12
+	case bsonDecimal:
+		return 16
+	case bsonString, bsonCode, bsonSymbol:
+		if n := int32At(0); n > 0 {
+			return 4 + n
+		}
+	case bsonDBPointer:
+		if n := int32At(0); n > 0 {
+			return 4 + n + 12
+		}
+	case bsonBinary:
+		if n := int32At(0); n >= 0 {
+			return 5 + n
+		}
+	case bsonDocument, bsonArray, bsonCodeScope:
+		if n := int32At(0); n >= 5 {
+			return n
+		}
+	case bsonRegex:
+		i := bytes.IndexByte(p, 0)
+		if i < 0 {
+			return -1
+		}
+		if j := bytes.IndexByte(p[i+1:], 0); j > -1 {
+			return i + j + 2
+		}
+	}
+	return -1
+}
+
+//str 字符串类型的值
+func (e bsonElement) str() string {
+	if e.kind != bsonString && e.kind != bsonSymbol || len(e.value) < 5 {
+		return ""
+	}
+	return string(e.value[4 : len(e.value)-1])
+}
+
+//number 数值类型的值
+func (e bsonElement) number() (float64, bool) {
+	switch e.kind {
+	case bsonDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(e.value)), true
+	case bsonInt32:
+		return float64(int32(binary.LittleEndian.Uint32(e.value))), true
+	case bsonInt64:
+		return float64(int64(binary.LittleEndian.Uint64(e.value))), true
+	case bsonBool:
+		if e.value[0] != 0 {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+//doc 文档或数组类型的值
+func (e bsonElement) doc() bsonDoc {
+	if e.kind != bsonDocument && e.kind != bsonArray {
+		return nil
+	}
+	return bsonDoc(e.value)
+}
+
+//bsonShape 规范化查询条件，保留字段名与操作符，值替换为?，如 {status: ?, age: {$gt: ?}}
+func bsonShape(d bsonDoc) string {
+	var buf bytes.Buffer
+	writeShape(&buf, d, false, 1)
+	if buf.Len() > maxShapeLength {
+		return string(buf.Bytes()[:maxShapeLength]) + "..."
+	}
+	return buf.String()
+}
+
+func writeShape(buf *bytes.Buffer, d bsonDoc, array bool, depth int) {
+	open, end := byte('{'), byte('}')
+	if array {
+		open, end = '[', ']'
+	}
+	buf.WriteByte(open)
+	if depth > maxShapeDepth {
+		buf.WriteString("...")
+		buf.WriteByte(end)
+		return
+	}
+	seen := make(map[string]bool)
+	i := 0
+	d.each(func(e bsonElement) bool {
+		if buf.Len() > maxShapeLength {
+			return false
+		}
+		var value string
+		if sub := e.doc(); sub != nil {
+			var b bytes.Buffer
+			writeShape(&b, sub, e.kind == bsonArray, depth+1)
+			value = b.String()
+		} else {
+			value = "?"
+		}
+		//数组中形状相同的元素只保留一个，如 $in 的取值
+		if array {
+			if seen[value] {
+				return true
+			}
+			seen[value] = true
+		}
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		i++
+		if !array {
+			buf.Write(e.name)
+			buf.WriteString(": ")
+		}
+		buf.WriteString(value)
+		return true
+	})
+	buf.WriteByte(end)
+}
+
+//bsonErrorCode 错误码，codeName优先
+func bsonErrorCode(d bsonDoc) string {
+	if e, ok := d.lookup("codeName"); ok && e.str() != "" {
+		return e.str()
+	}
+	if e, ok := d.lookup("code"); ok {
+		if n, ok := e.number(); ok {
+			return strconv.Itoa(int(n))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,465 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	cqlHeadLength = 9
+	//maxCQLBody 报文体的最大长度，超出时认为不是CQL协议
+	maxCQLBody = 256 * 1024 * 1024
+	//cqlHeadLimit 读取的报文体最大长度，绑定的参数与结果只统计长度
+	cqlHeadLimit = 16 * 1024
+	//maxCQLTables 统计的最大表数量，超出后归入other
+	maxCQLTables = 500
+	//maxCQLPrepared 每个连接记录的最大预处理语句数量
+	maxCQLPrepared = 10000
+)
+
+//请求与响应的操作码
+const (
+	cqlError          = 0x00
+	cqlStartup        = 0x01
+	cqlReady          = 0x02
+	cqlQuery          = 0x07
+	cqlResult         = 0x08
+	cqlPrepare        = 0x09
+	cqlExecute        = 0x0a
+	cqlBatch          = 0x0d
+	cqlAuthSuccess    = 0x10
+	cqlResultKeyspace = 3
+	cqlResultPrepared = 4
+)
+
+//cqlOpcodes 请求的操作码
+var cqlOpcodes = map[byte]string{
+	0x01: "STARTUP", 0x05: "OPTIONS", 0x07: "QUERY", 0x09: "PREPARE", 0x0a: "EXECUTE",
+	0x0b: "REGISTER", 0x0d: "BATCH", 0x0f: "AUTH_RESPONSE",
+}
+
+//cqlErrors 错误码
+var cqlErrors = map[int32]string{
+	0x0000: "SERVER_ERROR", 0x000a: "PROTOCOL_ERROR", 0x0100: "BAD_CREDENTIALS",
+	0x1000: "UNAVAILABLE", 0x1001: "OVERLOADED", 0x1002: "IS_BOOTSTRAPPING", 0x1003: "TRUNCATE_ERROR",
+	0x1100: "WRITE_TIMEOUT", 0x1200: "READ_TIMEOUT", 0x1300: "READ_FAILURE", 0x1400: "FUNCTION_FAILURE",
+	0x1500: "WRITE_FAILURE", 0x1600: "CDC_WRITE_FAILURE", 0x1700: "CAS_WRITE_UNKNOWN",
+	0x2000: "SYNTAX_ERROR", 0x2100: "UNAUTHORIZED", 0x2200: "INVALID", 0x2300: "CONFIG_ERROR",
+	0x2400: "ALREADY_EXISTS", 0x2500: "UNPREPARED",
+}
+
+//cqlConsistency 一致性级别
+var cqlConsistency = map[uint16]string{
+	0: "ANY", 1: "ONE", 2: "TWO", 3: "THREE", 4: "QUORUM", 5: "ALL", 6: "LOCAL_QUORUM",
+	7: "EACH_QUORUM", 8: "SERIAL", 9: "LOCAL_SERIAL", 10: "LOCAL_ONE",
+}
+
+//cqlStatement 规范化后的语句与语句操作的表
+type cqlStatement struct {
+	query    string
+	resource string
+}
+
+//cqlCall 等待响应的请求，PREPARE在响应中得到语句的ID
+type cqlCall struct {
+	msg     *metric.ProtocolMessage
+	prepare *cqlStatement
+}
+
+//cqlConn 连接的当前keyspace、预处理语句与v5的分段传输状态
+type cqlConn struct {
+	keyspace string
+	prepared map[string]*cqlStatement
+	//v5建立连接后使用分段传输，压缩的分段无法解析
+	segments   bool
+	compressed bool
+	//跨多个分段的报文，按方向记录已收到的部分与报文总长度
+	partial [2][]byte
+	missing [2]int
+	length  [2]int
+}
+
+//CassandraDecode Cassandra CQL协议(v3-v5)解码
+type CassandraDecode struct {
+	*tcpStream
+	tables *labelFolder
+}
+
+//CreateCassandraDecode CreateCassandraDecode
+func CreateCassandraDecode(option *config.Option, port config.Port) *CassandraDecode {
+	d := &CassandraDecode{tables: newLabelFolder(maxCQLTables)}
+	d.tcpStream = newTCPStream("cassandra", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *CassandraDecode) conn(c *streamConn) *cqlConn {
+	if c.state == nil {
+		c.state = &cqlConn{prepared: map[string]*cqlStatement{}}
+	}
+	return c.state.(*cqlConn)
+}
+
+func (d *CassandraDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	cc := d.conn(c)
+	if cc.segments {
+		//分段头部为3字节(压缩时5字节)的长度与标志，加3字节CRC24，分段之后为4字节CRC32
+		head := 6
+		if cc.compressed {
+			head = 8
+		}
+		if len(buf) < head {
+			return 0, 0
+		}
+		length := int(buf[0]) | int(buf[1])<<8 | int(buf[2]&0x01)<<16
+		total = head + length + 4
+		return total, total
+	}
+	if len(buf) < cqlHeadLength {
+		return 0, 0
+	}
+	version := buf[0]
+	if request != (version&0x80 == 0) || version&0x7f < 3 || version&0x7f > 5 {
+		return -1, 0
+	}
+	length := int32(binary.BigEndian.Uint32(buf[5:]))
+	if length < 0 || length > maxCQLBody {
+		return -1, 0
+	}
+	total = cqlHeadLength + int(length)
+	if total > cqlHeadLength+cqlHeadLimit {
+		return total, cqlHeadLength + cqlHeadLimit
+	}
+	return total, total
+}
+
+func (d *CassandraDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	cc := d.conn(c)
+	if !cc.segments {
+		d.envelope(s, c, cc, request, frame, total)
+		return
+	}
+	if cc.compressed {
+		return
+	}
+	dir := 0
+	if !request {
+		dir = 1
+	}
+	payload := frame[6:]
+	if len(payload) > total-10 {
+		payload = payload[:total-10]
+	}
+	if frame[2]&0x02 != 0 {
+		//self-contained分段包含一个或多个完整的报文
+		for len(payload) >= cqlHeadLength {
+			length := cqlHeadLength + int(binary.BigEndian.Uint32(payload[5:]))
+			if length > len(payload) {
+				break
+			}
+			d.envelope(s, c, cc, request, payload[:length], length)
+			payload = payload[length:]
+		}
+		return
+	}
+	if cc.missing[dir] <= 0 {
+		if len(payload) < cqlHeadLength {
+			return
+		}
+		cc.length[dir] = cqlHeadLength + int(binary.BigEndian.Uint32(payload[5:]))
+		cc.missing[dir] = cc.length[dir]
+		cc.partial[dir] = nil
+	}
+	cc.missing[dir] -= len(payload)
+	if room := cqlHeadLength + cqlHeadLimit - len(cc.partial[dir]); room > 0 {
+		if len(payload) > room {
+			payload = payload[:room]
+		}
+		cc.partial[dir] = append(cc.partial[dir], payload...)
+	}
+	if cc.missing[dir] <= 0 {
+		d.envelope(s, c, cc, request, cc.partial[dir], cc.length[dir])
+		cc.partial[dir], cc.missing[dir] = nil, 0
+	}
+}
+
+//envelope 处理一个CQL报文
+func (d *CassandraDecode) envelope(s *tcpStream, c *streamConn, cc *cqlConn, request bool, env []byte, total int) {
+	version, flags, opcode := env[0]&0x7f, env[1], env[4]
+	stream := uint64(binary.BigEndian.Uint16(env[2:]))
+	r := &cqlReader{p: env[cqlHeadLength:]}
+	//v3与v4压缩的报文体无法解析
+	readable := flags&0x01 == 0 || version >= 5
+	if request {
+		command, ok := cqlOpcodes[opcode]
+		if !ok {
+			command = strconv.Itoa(int(opcode))
+		}
+		call := &cqlCall{msg: &metric.ProtocolMessage{Command: command, RemoteAddr: c.client, RequestLength: uint64(total)}}
+		if readable {
+			if flags&0x04 != 0 {
+				r.bytesMap()
+			}
+			d.request(cc, call, version, opcode, r)
+		}
+		c.call(stream, call)
+		return
+	}
+	if int16(stream) < 0 {
+		//服务端推送的事件
+		return
+	}
+	call := c.reply(stream)
+	if call == nil {
+		return
+	}
+	cl := call.value.(*cqlCall)
+	msg := cl.msg
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	if readable {
+		if flags&0x02 != 0 {
+			r.take(16)
+		}
+		if flags&0x08 != 0 {
+			for n := r.short(); n > 0 && !r.err; n-- {
+				r.string()
+			}
+		}
+		if flags&0x04 != 0 {
+			r.bytesMap()
+		}
+		switch opcode {
+		case cqlError:
+			code := r.int32()
+			if msg.Code = cqlErrors[code]; msg.Code == "" {
+				msg.Code = "0x" + strconv.FormatInt(int64(code), 16)
+			}
+		case cqlReady, cqlAuthSuccess:
+			//v5在STARTUP或认证完成之后改为分段传输
+			if version == 5 {
+				cc.segments = true
+			}
+		case cqlResult:
+			switch r.int32() {
+			case cqlResultKeyspace:
+				cc.keyspace = strings.ToLower(r.string())
+			case cqlResultPrepared:
+				if id := r.shortBytes(); cl.prepare != nil && !r.err && len(cc.prepared) < maxCQLPrepared {
+					cc.prepared[string(id)] = cl.prepare
+				}
+			}
+		}
+	}
+	s.store.Input(msg)
+}
+
+//request 读取请求中的语句与一致性级别
+func (d *CassandraDecode) request(cc *cqlConn, call *cqlCall, version, opcode byte, r *cqlReader) {
+	msg := call.msg
+	switch opcode {
+	case cqlStartup:
+		for n := r.short(); n > 0 && !r.err; n-- {
+			if key := r.string(); strings.EqualFold(key, "COMPRESSION") {
+				cc.compressed = r.string() != ""
+			} else {
+				r.string()
+			}
+		}
+	case cqlQuery:
+		d.statement(msg, d.parse(cc, r.longString()))
+		d.consistency(msg, r)
+	case cqlPrepare:
+		call.prepare = d.parse(cc, r.longString())
+		d.statement(msg, call.prepare)
+		if msg.Key != "" {
+			msg.Key = "PREPARE " + msg.Key
+		}
+	case cqlExecute:
+		id := r.shortBytes()
+		if version >= 5 {
+			r.shortBytes()
+		}
+		d.statement(msg, cc.prepared[string(id)])
+		d.consistency(msg, r)
+	case cqlBatch:
+		//按第一个语句统计
+		r.byte()
+		for i, n := 0, int(r.short()); i < n && !r.err; i++ {
+			var st *cqlStatement
+			if r.byte() == 0 {
+				st = d.parse(cc, r.longString())
+			} else {
+				st = cc.prepared[string(r.shortBytes())]
+			}
+			if i == 0 {
+				d.statement(msg, st)
+				if msg.Key != "" {
+					msg.Key = "BATCH " + msg.Key
+				}
+			}
+			for v := r.short(); v > 0 && !r.err; v-- {
+				r.bytes()
+			}
+		}
+		d.consistency(msg, r)
+	}
+}
+
+func (d *CassandraDecode) statement(msg *metric.ProtocolMessage, st *cqlStatement) {
+	if st != nil {
+		msg.Key = st.query
+		msg.Resource = st.resource
+	}
+}
+
+//consistency 一致性级别统计为 consistency.<级别>
+func (d *CassandraDecode) consistency(msg *metric.ProtocolMessage, r *cqlReader) {
+	level := r.short()
+	if r.err {
+		return
+	}
+	name, ok := cqlConsistency[level]
+	if !ok {
+		name = strconv.Itoa(int(level))
+	}
+	msg.Counters = map[string]uint64{"consistency." + name: 1}
+}
+
+//parse 规范化语句并读取语句操作的表
+func (d *CassandraDecode) parse(cc *cqlConn, query []byte) *cqlStatement {
+	if len(query) == 0 {
+		return nil
+	}
+	text := cleanupQuery(query)
+	st := &cqlStatement{query: text}
+	if table := cqlTable(text, cc.keyspace); table != "" {
+		st.resource = d.tables.fold(table)
+	}
+	return st
+}
+
+func (d *CassandraDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*cqlCall).msg
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//cqlTable 语句操作的表，没有指定keyspace时使用连接的当前keyspace
+func cqlTable(query, keyspace string) string {
+	fields := strings.Fields(query)
+	for i := 0; i < len(fields)-1; i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "FROM", "INTO", "UPDATE", "TABLE", "TRUNCATE":
+		default:
+			continue
+		}
+		j := i + 1
+		for j < len(fields)-1 {
+			if w := strings.ToUpper(fields[j]); w != "IF" && w != "NOT" && w != "EXISTS" && w != "TABLE" {
+				break
+			}
+			j++
+		}
+		name := fields[j]
+		if k := strings.IndexAny(name, "(;"); k >= 0 {
+			name = name[:k]
+		}
+		name = strings.ToLower(strings.Trim(name, "\""))
+		if name == "" || name == "?" {
+			return ""
+		}
+		if !strings.Contains(name, ".") && keyspace != "" {
+			name = keyspace + "." + name
+		}
+		return name
+	}
+	return ""
+}
+
+//cqlReader 读取CQL的基本类型，数据不足时err为true
+type cqlReader struct {
+	p   []byte
+	err bool
+}
+
+func (r *cqlReader) take(n int) []byte {
+	if r.err || n < 0 || n > len(r.p) {
+		r.err = true
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+func (r *cqlReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *cqlReader) short() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *cqlReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *cqlReader) string() string {
+	return string(r.take(int(r.short())))
+}
+
+func (r *cqlReader) longString() []byte {
+	return r.take(int(r.int32()))
+}
+
+func (r *cqlReader) shortBytes() []byte {
+	return r.take(int(r.short()))
+}
+
+//bytes 长度为负数时为null或未设置的值
+func (r *cqlReader) bytes() []byte {
+	if n := r.int32(); n > 0 {
+		return r.take(int(n))
+	}
+	return nil
+}
+
+func (r *cqlReader) bytesMap() {
+	for n := r.short(); n > 0 && !r.err; n-- {
+		r.string()
+		r.bytes()
+	}
+}
@@ -0,0 +1,165 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//cqlFrame 生成CQL报文，响应的版本号最高位为1
+func cqlFrame(request bool, version byte, stream uint16, opcode byte, body string) []byte {
+	p := make([]byte, cqlHeadLength)
+	p[0], p[4] = version, opcode
+	if !request {
+		p[0] |= 0x80
+	}
+	binary.BigEndian.PutUint16(p[2:], stream)
+	binary.BigEndian.PutUint32(p[5:], uint32(len(body)))
+	return append(p, body...)
+}
+
+//cqlSegment v5的未压缩分段，CRC不校验，填充为0
+func cqlSegment(selfContained bool, payload []byte) []byte {
+	length := len(payload)
+	if selfContained {
+		length |= 1 << 17
+	}
+	p := []byte{byte(length), byte(length >> 8), byte(length >> 16), 0, 0, 0}
+	return append(append(p, payload...), 0, 0, 0, 0)
+}
+
+//cqlShort [short]
+func cqlShort(v uint16) string {
+	return string([]byte{byte(v >> 8), byte(v)})
+}
+
+//cqlInt [int]
+func cqlInt(v int32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return string(b)
+}
+
+//cqlString [string]
+func cqlString(s string) string {
+	return cqlShort(uint16(len(s))) + s
+}
+
+//cqlLongString [long string]
+func cqlLongString(s string) string {
+	return cqlInt(int32(len(s))) + s
+}
+
+func TestCassandraDecode(t *testing.T) {
+	query := func(stream uint16, text string, consistency uint16) streamSegment {
+		return streamSegment{true, cqlFrame(true, 4, stream, cqlQuery, cqlLongString(text)+cqlShort(consistency)+"\x00")}
+	}
+	result := func(stream uint16, body string) streamSegment {
+		return streamSegment{false, cqlFrame(false, 4, stream, cqlResult, body)}
+	}
+	cqlErr := func(stream uint16, code int32) streamSegment {
+		return streamSegment{false, cqlFrame(false, 4, stream, cqlError, cqlInt(code)+cqlString("failed"))}
+	}
+	rows := cqlInt(2) + cqlInt(0) + cqlInt(0) + cqlInt(0)
+	v5Query := cqlFrame(true, 5, 3, cqlQuery, cqlLongString("SELECT * FROM shop.orders")+cqlShort(10)+"\x00\x00\x00\x00")
+	runStreamTests(t, func() streamParser { return &CassandraDecode{tables: newLabelFolder(maxCQLTables)} }, []streamTest{
+		{
+			name: "use keyspace",
+			segments: []streamSegment{
+				query(1, "USE Shop", 1), result(1, cqlInt(cqlResultKeyspace)+cqlString("Shop")),
+				query(2, "SELECT * FROM orders WHERE id = 42", 6), result(2, rows),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "QUERY", Key: "USE Shop", Counters: map[string]uint64{"consistency.ONE": 1}},
+				{Command: "QUERY", Resource: "shop.orders", Key: "SELECT * FROM orders WHERE id = ?", RequestLength: 50, ResponseLength: 25,
+					Counters: map[string]uint64{"consistency.LOCAL_QUORUM": 1}},
+			},
+		},
+		{
+			name: "prepare and execute",
+			segments: []streamSegment{
+				{true, cqlFrame(true, 4, 1, cqlPrepare, cqlLongString("INSERT INTO shop.orders (id, total) VALUES (1, 2)"))},
+				result(1, cqlInt(cqlResultPrepared)+cqlShort(2)+"\x01\x02"),
+				{true, cqlFrame(true, 4, 2, cqlExecute, cqlShort(2)+"\x01\x02"+cqlShort(4)+"\x00")},
+				result(2, cqlInt(1)),
+				{true, cqlFrame(true, 4, 3, cqlExecute, cqlShort(2)+"\x09\x09"+cqlShort(4)+"\x00")},
+				cqlErr(3, 0x2500),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "PREPARE", Resource: "shop.orders", Key: "PREPARE INSERT INTO shop.orders (id, total) VALUES (?)"},
+				{Command: "EXECUTE", Resource: "shop.orders", Key: "INSERT INTO shop.orders (id, total) VALUES (?)",
+					Counters: map[string]uint64{"consistency.QUORUM": 1}},
+				{Command: "EXECUTE", Code: "UNPREPARED", Counters: map[string]uint64{"consistency.QUORUM": 1}},
+			},
+		},
+		{
+			name: "batch",
+			segments: []streamSegment{
+				{true, cqlFrame(true, 4, 1, cqlBatch, "\x01"+cqlShort(2)+
+					"\x00"+cqlLongString("UPDATE shop.stock SET n = n - 1 WHERE id = 7")+cqlShort(0)+
+					"\x00"+cqlLongString("INSERT INTO shop.log (id) VALUES (?)")+cqlShort(1)+cqlInt(1)+"\x07"+
+					cqlShort(4)+"\x00")},
+				result(1, cqlInt(1)),
+			},
+			want: []metric.ProtocolMessage{{Command: "BATCH", Resource: "shop.stock", Key: "BATCH UPDATE shop.stock SET n = n - ? WHERE id = ?",
+				Counters: map[string]uint64{"consistency.QUORUM": 1}}},
+		},
+		{
+			name: "errors",
+			segments: []streamSegment{
+				query(1, "SELECT * FROM shop.orders", 1), query(2, "SELEC oops", 1), query(3, "SELECT * FROM shop.users", 1),
+				cqlErr(2, 0x2000), cqlErr(1, 0x1200), cqlErr(3, 0x7777),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "QUERY", Key: "SELEC oops", Code: "SYNTAX_ERROR"},
+				{Command: "QUERY", Resource: "shop.orders", Key: "SELECT * FROM shop.orders", Code: "READ_TIMEOUT"},
+				{Command: "QUERY", Resource: "shop.users", Key: "SELECT * FROM shop.users", Code: "0x7777"},
+			},
+		},
+		{
+			name: "v5 segments",
+			segments: []streamSegment{
+				{true, cqlFrame(true, 5, 1, cqlStartup, cqlShort(1)+cqlString("CQL_VERSION")+cqlString("3.0.0"))},
+				{false, cqlFrame(false, 5, 1, cqlReady, "")},
+				{true, cqlSegment(true, v5Query)},
+				{false, cqlSegment(true, cqlFrame(false, 5, 3, cqlResult, rows))},
+				{true, cqlSegment(false, v5Query[:20])},
+				{true, cqlSegment(false, v5Query[20:])},
+				{false, cqlSegment(true, cqlFrame(false, 5, 3, cqlError, cqlInt(0x1001)+cqlString("busy")))},
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "STARTUP"},
+				{Command: "QUERY", Resource: "shop.orders", Key: "SELECT * FROM shop.orders", Counters: map[string]uint64{"consistency.LOCAL_ONE": 1}},
+				{Command: "QUERY", Resource: "shop.orders", Key: "SELECT * FROM shop.orders", Code: "OVERLOADED"},
+			},
+		},
+		{
+			name:     "timeout",
+			segments: []streamSegment{query(1, "SELECT * FROM shop.orders", 1)},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "QUERY", Resource: "shop.orders", Key: "SELECT * FROM shop.orders", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "not cassandra",
+			segments: []streamSegment{{true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")}},
+		},
+	})
+}
@@ -0,0 +1,128 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"net"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+//clientIPResolver 在可信代理之后时，从请求头中获取真实的客户端地址
+type clientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+func newClientIPResolver(cidrs []string) *clientIPResolver {
+	r := &clientIPResolver{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Errorf("trusted proxy %s is invalid,%s", c, err.Error())
+			continue
+		}
+		r.trusted = append(r.trusted, ipnet)
+	}
+	return r
+}
+
+func (r *clientIPResolver) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//resolve 返回真实的客户端地址，remote为网络层的来源地址
+//依次使用Forwarded、X-Forwarded-For、X-Real-IP，从右向左跳过可信代理
+func (r *clientIPResolver) resolve(remote string, head *httpHead) string {
+	if len(r.trusted) == 0 || !r.isTrusted(remote) {
+		return remote
+	}
+	var chain []string
+	if forwarded := head.values("Forwarded"); len(forwarded) > 0 {
+		chain = parseForwarded(forwarded)
+	} else if xff := head.values("X-Forwarded-For"); len(xff) > 0 {
+		for _, line := range xff {
+			for _, addr := range strings.Split(line, ",") {
+				chain = append(chain, stripPort(strings.TrimSpace(addr)))
+			}
+		}
+	} else if xri := head.Get("X-Real-Ip"); xri != "" {
+		chain = []string{stripPort(strings.TrimSpace(xri))}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			//无法识别的地址(unknown或混淆标识)，不再向前追溯
+			break
+		}
+		if !r.isTrusted(chain[i]) || i == 0 {
+			return chain[i]
+		}
+	}
+	return remote
+}
+
+//parseForwarded 解析RFC 7239 Forwarded头中的for参数
+func parseForwarded(values []string) (chain []string) {
+	for _, line := range values {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				chain = append(chain, stripPort(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return chain
+}
+
+//stripPort 去掉地址中的端口与IPv6的方括号
+func stripPort(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if i := strings.Index(addr, "]"); i > 0 {
+			return addr[1:i]
+		}
+		return addr
+	}
+	if strings.Count(addr, ":") == 1 {
+		return addr[:strings.Index(addr, ":")]
+	}
+	return addr
+}
@@ -0,0 +1,264 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	dubboMagic      = 0xdabb
+	dubboHeadLength = 16
+	//maxDubboBody 报文体的最大长度，超出时认为不是Dubbo协议
+	maxDubboBody = 16 * 1024 * 1024
+	//dubboHeadLimit 读取的报文体最大长度，参数与返回值只统计长度
+	dubboHeadLimit = 4096
+	//maxDubboMethods 统计的最大服务方法数量，超出后归入other
+	maxDubboMethods = 1000
+	//maxDubboExceptions 统计的最大异常类型数量
+	maxDubboExceptions = 100
+	//dubboHessian2 hessian2序列化的编号
+	dubboHessian2 = 2
+)
+
+//头部标志位
+const (
+	dubboFlagRequest = 0x80
+	dubboFlagTwoWay  = 0x40
+	dubboFlagEvent   = 0x20
+)
+
+//dubboStatus 响应状态
+var dubboStatus = map[byte]string{
+	30: "CLIENT_TIMEOUT", 31: "SERVER_TIMEOUT", 35: "CHANNEL_INACTIVE", 40: "BAD_REQUEST",
+	50: "BAD_RESPONSE", 60: "SERVICE_NOT_FOUND", 70: "SERVICE_ERROR", 80: "SERVER_ERROR",
+	90: "CLIENT_ERROR", 100: "SERVER_THREADPOOL_EXHAUSTED_ERROR",
+}
+
+//DubboDecode Dubbo协议解码
+type DubboDecode struct {
+	*tcpStream
+	methods    *labelFolder
+	exceptions *labelFolder
+}
+
+//CreateDubboDecode CreateDubboDecode
+func CreateDubboDecode(option *config.Option, port config.Port) *DubboDecode {
+	d := &DubboDecode{
+		methods:    newLabelFolder(maxDubboMethods),
+		exceptions: newLabelFolder(maxDubboExceptions),
+	}
+	d.tcpStream = newTCPStream("dubbo", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *DubboDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < dubboHeadLength {
+		if len(buf) >= 2 && binary.BigEndian.Uint16(buf) != dubboMagic {
+			return -1, 0
+		}
+		return 0, 0
+	}
+	length := binary.BigEndian.Uint32(buf[12:])
+	if binary.BigEndian.Uint16(buf) != dubboMagic || length > maxDubboBody {
+		return -1, 0
+	}
+	total = dubboHeadLength + int(length)
+	if total > dubboHeadLength+dubboHeadLimit {
+		return total, dubboHeadLength + dubboHeadLimit
+	}
+	return total, total
+}
+
+func (d *DubboDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	flag, status := frame[2], frame[3]
+	id := binary.BigEndian.Uint64(frame[4:])
+	body := &hessianReader{p: frame[dubboHeadLength:]}
+	hessian := flag&0x1f == dubboHessian2
+	if flag&dubboFlagRequest != 0 {
+		msg := &metric.ProtocolMessage{Command: "heartbeat", RemoteAddr: c.client, RequestLength: uint64(total)}
+		if flag&dubboFlagEvent == 0 {
+			msg.Command = "invoke"
+			if hessian {
+				d.invocation(msg, body)
+			}
+		}
+		if flag&dubboFlagTwoWay == 0 {
+			//单向调用没有响应
+			s.store.Input(msg)
+			return
+		}
+		c.call(id, msg)
+		return
+	}
+	call := c.reply(id)
+	if call == nil {
+		return
+	}
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	if status != 20 {
+		if msg.Code = dubboStatus[status]; msg.Code == "" {
+			msg.Code = strconv.Itoa(int(status))
+		}
+	} else if hessian && flag&dubboFlagEvent == 0 {
+		//返回类型为0或3时结果为异常对象
+		if kind := body.int(); !body.err && (kind == 0 || kind == 3) {
+			msg.Code = "EXCEPTION"
+			if class := body.class(); class != "" {
+				msg.Code = d.exceptions.fold(class)
+			}
+		}
+	}
+	s.store.Input(msg)
+}
+
+//invocation 读取调用的服务接口、版本与方法，resource为 服务接口.方法，有版本时为 服务接口:版本.方法
+func (d *DubboDecode) invocation(msg *metric.ProtocolMessage, body *hessianReader) {
+	body.string()
+	service := body.string()
+	version := body.string()
+	method := body.string()
+	if body.err || service == "" || method == "" {
+		return
+	}
+	if version != "" && version != "0.0.0" {
+		service += ":" + version
+	}
+	msg.Resource = d.methods.fold(service + "." + method)
+	msg.Key = msg.Resource
+}
+
+func (d *DubboDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//hessianReader 读取hessian2编码的字符串与整数，数据不足或类型不符时err为true
+type hessianReader struct {
+	p   []byte
+	err bool
+}
+
+func (h *hessianReader) take(n int) []byte {
+	if h.err || n < 0 || n > len(h.p) {
+		h.err = true
+		return nil
+	}
+	b := h.p[:n]
+	h.p = h.p[n:]
+	return b
+}
+
+func (h *hessianReader) byte() byte {
+	if b := h.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+//int 读取整数，返回类型等较小的整数
+func (h *hessianReader) int() int {
+	code := h.byte()
+	switch {
+	case code >= 0x80 && code <= 0xbf:
+		return int(code) - 0x90
+	case code >= 0xc0 && code <= 0xcf:
+		return (int(code)-0xc8)<<8 + int(h.byte())
+	case code == 'I':
+		if b := h.take(4); b != nil {
+			return int(int32(binary.BigEndian.Uint32(b)))
+		}
+	default:
+		h.err = true
+	}
+	return 0
+}
+
+//string 读取字符串，长度为UTF-16字符数，null返回空字符串
+func (h *hessianReader) string() string {
+	var sb strings.Builder
+	for !h.err {
+		code := h.byte()
+		final, length := true, 0
+		switch {
+		case code == 'N':
+			return ""
+		case code <= 0x1f:
+			length = int(code)
+		case code >= 0x30 && code <= 0x33:
+			length = int(code-0x30)<<8 + int(h.byte())
+		case code == 'S' || code == 'R':
+			if b := h.take(2); b != nil {
+				length = int(binary.BigEndian.Uint16(b))
+			}
+			final = code == 'S'
+		default:
+			h.err = true
+			return ""
+		}
+		h.chars(&sb, length)
+		if final {
+			break
+		}
+	}
+	if h.err {
+		return ""
+	}
+	return sb.String()
+}
+
+//chars 读取n个字符，补充平面的字符在Java中编码为两个3字节的代理字符
+func (h *hessianReader) chars(sb *strings.Builder, n int) {
+	start, size := h.p, 0
+	for i := 0; i < n; i++ {
+		if size >= len(start) {
+			h.err = true
+			return
+		}
+		switch b := start[size]; {
+		case b >= 0xe0:
+			size += 3
+		case b >= 0xc0:
+			size += 2
+		default:
+			size++
+		}
+	}
+	if b := h.take(size); b != nil {
+		sb.Write(b)
+	}
+}
+
+//class 读取对象的类型定义，返回类名
+func (h *hessianReader) class() string {
+	if h.byte() != 'C' || h.err {
+		return ""
+	}
+	return h.string()
+}
@@ -0,0 +1,113 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//dubboPacket 生成Dubbo报文，flag的低位为序列化编号
+func dubboPacket(flag, status byte, id uint64, body string) []byte {
+	p := make([]byte, dubboHeadLength)
+	binary.BigEndian.PutUint16(p, dubboMagic)
+	p[2], p[3] = flag, status
+	binary.BigEndian.PutUint64(p[4:], id)
+	binary.BigEndian.PutUint32(p[12:], uint32(len(body)))
+	return append(p, body...)
+}
+
+//hessianString hessian2编码的短字符串
+func hessianString(s string) string {
+	return string([]byte{byte(len(s))}) + s
+}
+
+func TestDubboDecode(t *testing.T) {
+	invoke := func(id uint64, flag byte, service, version, method string) streamSegment {
+		body := hessianString("2.0.2") + service + hessianString(version) + hessianString(method) + hessianString("Ljava/lang/String;") + hessianString("arg")
+		return streamSegment{true, dubboPacket(flag|dubboHessian2, 0, id, body)}
+	}
+	call := func(id uint64, service, version, method string) streamSegment {
+		return invoke(id, dubboFlagRequest|dubboFlagTwoWay, hessianString(service), version, method)
+	}
+	res := func(id uint64, status byte, body string) streamSegment {
+		return streamSegment{false, dubboPacket(dubboHessian2, status, id, body)}
+	}
+	runStreamTests(t, func() streamParser {
+		return &DubboDecode{methods: newLabelFolder(maxDubboMethods), exceptions: newLabelFolder(maxDubboExceptions)}
+	}, []streamTest{
+		{
+			name:     "invoke",
+			segments: []streamSegment{call(1, "com.acme.OrderService", "1.0.0", "create"), res(1, 20, "\x91\x05order")},
+			want: []metric.ProtocolMessage{{Command: "invoke", Resource: "com.acme.OrderService:1.0.0.create",
+				Key: "com.acme.OrderService:1.0.0.create", RequestLength: 80, ResponseLength: 23}},
+		},
+		{
+			name: "exceptions",
+			segments: []streamSegment{
+				call(2, "com.acme.OrderService", "0.0.0", "cancel"), call(3, "com.acme.OrderService", "", "get"),
+				res(2, 20, "\x90C"+hessianString("java.lang.IllegalStateException")), res(3, 20, "\x93\x60"),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "invoke", Resource: "com.acme.OrderService.cancel", Key: "com.acme.OrderService.cancel", Code: "java.lang.IllegalStateException"},
+				{Command: "invoke", Resource: "com.acme.OrderService.get", Key: "com.acme.OrderService.get", Code: "EXCEPTION"},
+			},
+		},
+		{
+			name: "error status",
+			segments: []streamSegment{
+				call(4, "com.acme.UserService", "", "find"), call(5, "com.acme.UserService", "", "find"),
+				res(5, 31, "\x05timeout"), res(4, 44, ""),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "invoke", Resource: "com.acme.UserService.find", Key: "com.acme.UserService.find", Code: "SERVER_TIMEOUT"},
+				{Command: "invoke", Resource: "com.acme.UserService.find", Key: "com.acme.UserService.find", Code: "44"},
+			},
+		},
+		{
+			name:     "oneway",
+			segments: []streamSegment{invoke(6, dubboFlagRequest, hessianString("com.acme.AuditService"), "", "log")},
+			want:     []metric.ProtocolMessage{{Command: "invoke", Resource: "com.acme.AuditService.log", Key: "com.acme.AuditService.log"}},
+		},
+		{
+			name:     "chunked service name",
+			segments: []streamSegment{invoke(7, dubboFlagRequest|dubboFlagTwoWay, "R\x00\x04com.\x09acme.User", "", "get"), res(7, 20, "\x94")},
+			want:     []metric.ProtocolMessage{{Command: "invoke", Resource: "com.acme.User.get", Key: "com.acme.User.get"}},
+		},
+		{
+			name: "heartbeat",
+			segments: []streamSegment{
+				{true, dubboPacket(dubboFlagRequest|dubboFlagTwoWay|dubboFlagEvent|dubboHessian2, 0, 8, "N")},
+				{false, dubboPacket(dubboFlagEvent|dubboHessian2, 20, 8, "N")},
+			},
+			want: []metric.ProtocolMessage{{Command: "heartbeat"}},
+		},
+		{
+			name:     "timeout",
+			segments: []streamSegment{call(9, "com.acme.OrderService", "", "create")},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "invoke", Resource: "com.acme.OrderService.create", Key: "com.acme.OrderService.create", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "not dubbo",
+			segments: []streamSegment{{true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")}},
+		},
+	})
+}
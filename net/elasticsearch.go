@@ -0,0 +1,208 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"tcm/metric"
+)
+
+const (
+	//maxESIndexPatterns 统计的最大索引模式数量，超出后归入otherIndex
+	maxESIndexPatterns = 200
+	//otherIndex 超出数量限制的索引模式
+	otherIndex = "other"
+)
+
+var (
+	//索引名称中的日期与数字，如 logs-2026.10.18、.ds-logs-000001
+	esDate   = regexp.MustCompile(`\d{4}[.\-_/]?\d{2}([.\-_/]?\d{2})?`)
+	esNumber = regexp.MustCompile(`\d+`)
+	esStars  = regexp.MustCompile(`\*([.\-_]*\*)+`)
+	esAPI    = regexp.MustCompile(`^[a-z_]+$`)
+	esTook   = regexp.MustCompile(`"took"\s*:\s*(\d+)`)
+)
+
+type esResponse struct {
+	Took   *int64          `json:"took"`
+	Error  json.RawMessage `json:"error"`
+	Shards struct {
+		Failed int `json:"failed"`
+	} `json:"_shards"`
+	Items []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+	//_msearch的每个查询的结果
+	Responses []esResponse `json:"responses"`
+}
+
+//esInspector Elasticsearch模式，按API与索引模式统计
+type esInspector struct {
+	indices *labelFolder
+}
+
+func newESInspector() *esInspector {
+	indices := newLabelFolder(maxESIndexPatterns)
+	indices.overflow = otherIndex
+	return &esInspector{indices: indices}
+}
+
+func (e *esInspector) bodyLimits() (request, response int) {
+	return 0, maxInspectBody
+}
+
+//inspect 地址改为 操作 索引模式，并增加es_operation与es_index维度
+func (e *esInspector) inspect(info *metric.HTTPMessage, r *httpRequest, rs *httpResponse, body []byte) []*metric.HTTPMessage {
+	op, index := esOperation(r.method, r.uri)
+	index = e.indices.fold(index)
+	info.URI = op
+	if index != "" {
+		info.URI = op + " " + index
+	}
+	dims := make(map[string]string, len(info.Dimensions)+2)
+	for k, v := range info.Dimensions {
+		dims[k] = v
+	}
+	dims["es_operation"] = op
+	if index != "" {
+		dims["es_index"] = index
+	}
+	info.Dimensions = dims
+	if rs != nil && rs.status < 300 {
+		esResult(info, body)
+	}
+	return []*metric.HTTPMessage{info}
+}
+
+//esOperation 通过请求方法与地址识别API与索引模式
+func esOperation(method, uri string) (op, index string) {
+	var segs []string
+	for _, s := range strings.Split(uri, "/") {
+		if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	if len(segs) == 0 {
+		return "info", ""
+	}
+	if strings.HasPrefix(segs[0], "_") {
+		//集群与系统API，如 _cluster/health、_cat/indices
+		op = segs[0][1:]
+		if len(segs) > 1 && esAPI.MatchString(segs[1]) && !strings.HasPrefix(segs[1], "_") {
+			op += "." + segs[1]
+		} else if len(segs) > 1 && strings.HasPrefix(segs[1], "_") {
+			op += "." + segs[1][1:]
+		}
+		return op, ""
+	}
+	index = esIndexPattern(segs[0])
+	for _, s := range segs[1:] {
+		if strings.HasPrefix(s, "_") {
+			op = s[1:]
+			break
+		}
+	}
+	switch op {
+	case "":
+		//索引本身的操作
+		op = "index." + esMethod(method, "create", "get")
+	case "doc":
+		op = "doc." + esMethod(method, "index", "get")
+	case "create", "update":
+		op = "doc." + op
+	case "source":
+		op = "doc.get"
+	}
+	return op, index
+}
+
+//esMethod 按请求方法返回操作，write为PUT与POST的操作，read为GET的操作
+func esMethod(method, write, read string) string {
+	switch method {
+	case "PUT", "POST":
+		return write
+	case "DELETE":
+		return "delete"
+	case "HEAD":
+		return "exists"
+	}
+	return read
+}
+
+//esIndexPattern 把索引名称中的日期与数字替换为*，多个索引排序后以逗号连接
+func esIndexPattern(name string) string {
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, index := range strings.Split(name, ",") {
+		index = esDate.ReplaceAllString(index, "*")
+		index = esNumber.ReplaceAllString(index, "*")
+		index = esStars.ReplaceAllString(index, "*")
+		if index != "" && !seen[index] {
+			seen[index] = true
+			patterns = append(patterns, index)
+		}
+	}
+	sort.Strings(patterns)
+	return strings.Join(patterns, ",")
+}
+
+//esResult 从响应中获取took、分片失败与批量操作失败的数量
+func esResult(info *metric.HTTPMessage, body []byte) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return
+	}
+	var res esResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		//报文体超过保存长度时只从已有部分获取
+		if m := esTook.FindSubmatch(body); m != nil {
+			took, _ := strconv.ParseInt(string(m[1]), 10, 64)
+			info.EngineTime = took * 1000000
+		}
+		if bytes.Contains(body, []byte(`"errors":true`)) {
+			info.ItemErrors = bytes.Count(body, []byte(`"error":`))
+		}
+		info.Failed = info.ItemErrors > 0
+		return
+	}
+	if res.Took != nil {
+		info.EngineTime = *res.Took * 1000000
+	}
+	info.ShardFailures = res.Shards.Failed
+	for _, item := range res.Items {
+		for _, result := range item {
+			if result.Status >= 300 || len(result.Error) > 0 {
+				info.ItemErrors++
+			}
+		}
+	}
+	for _, sub := range res.Responses {
+		info.ShardFailures += sub.Shards.Failed
+		if len(sub.Error) > 0 {
+			info.ItemErrors++
+		}
+	}
+	info.Failed = info.ShardFailures > 0 || info.ItemErrors > 0
+}
@@ -0,0 +1,102 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"tcm/metric"
+	"testing"
+)
+
+func TestESOperation(t *testing.T) {
+	tests := []struct {
+		method, uri string
+		op, index   string
+	}{
+		{"GET", "/", "info", ""},
+		{"GET", "/_cluster/health", "cluster.health", ""},
+		{"GET", "/_cat/indices", "cat.indices", ""},
+		{"POST", "/_bulk", "bulk", ""},
+		{"GET", "/_nodes/_local/stats", "nodes.local", ""},
+		{"POST", "/logs-2026.10.18/_search", "search", "logs-*"},
+		{"GET", "/.ds-logs-000001,logs-2026.10.17/_count", "count", ".ds-logs-*,logs-*"},
+		{"PUT", "/orders-7/_doc/123", "doc.index", "orders-*"},
+		{"GET", "/orders/_doc/123", "doc.get", "orders"},
+		{"DELETE", "/orders/_doc/123", "doc.delete", "orders"},
+		{"POST", "/orders/_update/123", "doc.update", "orders"},
+		{"GET", "/orders/_source/123", "doc.get", "orders"},
+		{"PUT", "/metrics-2026-10", "index.create", "metrics-*"},
+		{"HEAD", "/metrics-2026-10", "index.exists", "metrics-*"},
+	}
+	for _, test := range tests {
+		op, index := esOperation(test.method, test.uri)
+		if op != test.op || index != test.index {
+			t.Errorf("%s %s got %s %s, want %s %s", test.method, test.uri, op, index, test.op, test.index)
+		}
+	}
+}
+
+func TestESInspect(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		status   int
+		response string
+		want     metric.HTTPMessage
+	}{
+		{
+			name: "search", uri: "/logs-2026.10.18/_search", status: 200,
+			response: `{"took":12,"timed_out":false,"_shards":{"total":5,"successful":4,"failed":1},"hits":{}}`,
+			want:     metric.HTTPMessage{URI: "search logs-*", EngineTime: 12000000, ShardFailures: 1, Failed: true},
+		},
+		{
+			name: "bulk item errors", uri: "/_bulk", status: 200,
+			response: `{"took":3,"errors":true,"items":[{"index":{"status":201}},{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`,
+			want:     metric.HTTPMessage{URI: "bulk", EngineTime: 3000000, ItemErrors: 1, Failed: true},
+		},
+		{
+			name: "msearch", uri: "/logs/_msearch", status: 200,
+			response: `{"took":5,"responses":[{"_shards":{"failed":0}},{"error":{"type":"index_not_found_exception"}}]}`,
+			want:     metric.HTTPMessage{URI: "msearch logs", EngineTime: 5000000, ItemErrors: 1, Failed: true},
+		},
+		{
+			name: "truncated bulk", uri: "/_bulk", status: 200,
+			response: `{"took":7,"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},{"index":{"status":201`,
+			want:     metric.HTTPMessage{URI: "bulk", EngineTime: 7000000, ItemErrors: 1, Failed: true},
+		},
+		{
+			name: "error status skips the body", uri: "/missing/_search", status: 404,
+			response: `{"error":{"type":"index_not_found_exception"},"status":404}`,
+			want:     metric.HTTPMessage{URI: "search missing"},
+		},
+	}
+	e := newESInspector()
+	for _, test := range tests {
+		r := &httpRequest{method: "POST", uri: test.uri}
+		info := &metric.HTTPMessage{URI: test.uri, Dimensions: map[string]string{"tenant": "a"}}
+		out := e.inspect(info, r, &httpResponse{request: r, status: test.status}, []byte(test.response))
+		m := out[0]
+		if len(out) != 1 || m.URI != test.want.URI || m.EngineTime != test.want.EngineTime || m.ShardFailures != test.want.ShardFailures ||
+			m.ItemErrors != test.want.ItemErrors || m.Failed != test.want.Failed {
+			t.Errorf("%s: got %s took %d shards %d items %d failed %v", test.name, m.URI, m.EngineTime, m.ShardFailures, m.ItemErrors, m.Failed)
+		}
+		if m.Dimensions["tenant"] != "a" || m.Dimensions["es_operation"] == "" {
+			t.Errorf("%s: dimensions are %v", test.name, m.Dimensions)
+		}
+	}
+}
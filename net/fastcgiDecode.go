@@ -0,0 +1,260 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+)
+
+//FastCGI记录类型
+const (
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+)
+
+//fcgiHeadLimit 解析STDOUT中CGI响应头时读取的最大长度
+const fcgiHeadLimit = 4096
+
+//fcgiRequest 一个FastCGI请求
+type fcgiRequest struct {
+	params      []byte
+	paramsDone  bool
+	info        *metric.HTTPMessage
+	headersDone bool
+	//STDOUT中响应头之前的数据
+	head []byte
+}
+
+//FastCGIDecode nginx与php-fpm之间的FastCGI协议解码，生成与http相同的监控数据
+type FastCGIDecode struct {
+	*tcpStream
+	pathNormalizer *PathNormalizer
+	hostFolder     *hostFolder
+	uaClassifier   *uaClassifier
+}
+
+//CreateFastCGIDecode CreateFastCGIDecode
+func CreateFastCGIDecode(option *config.Option, port config.Port) *FastCGIDecode {
+	d := &FastCGIDecode{
+		pathNormalizer: NewPathNormalizer(port.Routes),
+		hostFolder:     newHostFolder(port),
+		uaClassifier:   getUAClassifier(option.UARulesFile, option.Close),
+	}
+	d.tcpStream = newTCPStream("fastcgi", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *FastCGIDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 8 {
+		return 0, 0
+	}
+	if buf[0] != 1 || buf[1] == 0 || buf[1] > 11 {
+		return -1, 0
+	}
+	total = 8 + int(binary.BigEndian.Uint16(buf[4:6])) + int(buf[6])
+	switch buf[1] {
+	case fcgiStdin, fcgiStderr:
+		return total, 8
+	case fcgiStdout:
+		if total > 8+fcgiHeadLimit {
+			return total, 8 + fcgiHeadLimit
+		}
+	}
+	return total, total
+}
+
+func (d *FastCGIDecode) requests(c *streamConn) map[uint16]*fcgiRequest {
+	if c.state == nil {
+		c.state = make(map[uint16]*fcgiRequest)
+	}
+	return c.state.(map[uint16]*fcgiRequest)
+}
+
+func (d *FastCGIDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	id := binary.BigEndian.Uint16(frame[2:4])
+	length := int(binary.BigEndian.Uint16(frame[4:6]))
+	content := frame[8:]
+	if len(content) > length {
+		content = content[:length]
+	}
+	reqs := d.requests(c)
+	r := reqs[id]
+	switch frame[1] {
+	case fcgiBeginRequest:
+		r = &fcgiRequest{info: &metric.HTTPMessage{RemoteAddr: c.client, StatusCode: 200}}
+		reqs[id] = r
+		c.call(uint64(id), r)
+	case fcgiParams:
+		if r == nil || r.paramsDone {
+			return
+		}
+		if length == 0 {
+			r.paramsDone = true
+			d.readParams(r)
+			return
+		}
+		if len(r.params)+len(content) <= maxFrameBuffer {
+			r.params = append(r.params, content...)
+		}
+	case fcgiStdin:
+		if r != nil {
+			r.info.RequestLength += length
+		}
+	case fcgiStdout:
+		if r == nil {
+			return
+		}
+		if r.headersDone {
+			r.info.ContentLength += length
+			return
+		}
+		r.head = append(r.head, content...)
+		if i := bytes.Index(r.head, []byte("\r\n\r\n")); i > -1 {
+			r.headersDone = true
+			readCGIHeaders(r.info, r.head[:i])
+			r.info.ContentLength += len(r.head) - i - 4 + length - len(content)
+			r.head = nil
+		} else if len(r.head) > fcgiHeadLimit {
+			r.headersDone = true
+			r.head = nil
+		}
+	case fcgiEndRequest:
+		call := c.reply(uint64(id))
+		delete(reqs, id)
+		if call == nil || r == nil {
+			return
+		}
+		//protocolStatus不为0表示php-fpm拒绝了请求，如过载
+		if len(content) >= 5 && content[4] != 0 {
+			r.info.Failed = true
+		}
+		elapsed := int64(c.elapsed(call))
+		r.info.TimeConsum, r.info.TimeToLastByte = elapsed, elapsed
+		s.store.Input(d.fill(r.info))
+	case fcgiAbortRequest:
+		if call := c.reply(uint64(id)); call != nil && r != nil {
+			delete(reqs, id)
+			d.unanswered(s, c, call, metric.ResultAborted)
+		}
+	}
+}
+
+func (d *FastCGIDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	r := call.value.(*fcgiRequest)
+	r.info.Result = result
+	r.info.StatusCode = 0
+	s.store.Input(d.fill(r.info))
+}
+
+//fill 归并地址与Host，补充User-Agent分类
+func (d *FastCGIDecode) fill(info *metric.HTTPMessage) *metric.HTTPMessage {
+	info.URI = d.pathNormalizer.Normalize(info.URI)
+	info.Host = d.hostFolder.fold(info.Host)
+	ua := d.uaClassifier.classify(info.UserAgent)
+	info.UACategory, info.UABrowser, info.UAOS, info.UADevice = ua.Category, ua.Browser, ua.OS, ua.Device
+	return info
+}
+
+//readParams 从PARAMS中获取请求信息
+func (d *FastCGIDecode) readParams(r *fcgiRequest) {
+	var script, uri string
+	p := r.params
+	for len(p) > 0 {
+		var nl, vl int
+		nl, p = fcgiLength(p)
+		vl, p = fcgiLength(p)
+		if nl < 0 || vl < 0 || nl+vl > len(p) {
+			break
+		}
+		name, value := string(p[:nl]), string(p[nl:nl+vl])
+		p = p[nl+vl:]
+		switch name {
+		case "REQUEST_METHOD":
+			r.info.Method = value
+		case "SCRIPT_NAME":
+			script = value
+		case "REQUEST_URI":
+			uri = value
+		case "HTTP_HOST":
+			r.info.Host = value
+		case "HTTP_USER_AGENT":
+			r.info.UserAgent = value
+		case "REMOTE_ADDR":
+			r.info.RemoteAddr = value
+		}
+	}
+	//REQUEST_URI为浏览器请求的地址，没有时使用执行的脚本
+	if i := strings.Index(uri, "?"); i > -1 {
+		uri = uri[:i]
+	}
+	if uri == "" {
+		uri = script
+	}
+	r.info.URI = uri
+	r.params = nil
+}
+
+//fcgiLength 读取名称或值的长度，最高位为1时长度为4字节
+func fcgiLength(p []byte) (int, []byte) {
+	if len(p) == 0 {
+		return -1, p
+	}
+	if p[0]&0x80 == 0 {
+		return int(p[0]), p[1:]
+	}
+	if len(p) < 4 {
+		return -1, p
+	}
+	return int(binary.BigEndian.Uint32(p[:4]) & 0x7fffffff), p[4:]
+}
+
+//readCGIHeaders 从CGI响应头获取状态码，没有Status时有Location为302，否则为200
+func readCGIHeaders(info *metric.HTTPMessage, head []byte) {
+	for _, line := range strings.Split(string(head), "\r\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.EqualFold(name, "Status"):
+			if len(value) >= 3 {
+				if code, err := strconv.Atoi(value[:3]); err == nil {
+					info.StatusCode = code
+					return
+				}
+			}
+		case strings.EqualFold(name, "Location"):
+			info.StatusCode = 302
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/config"
+	"tcm/metric"
+	"testing"
+	"time"
+)
+
+//fcgiRecord 生成FastCGI记录，填充长度为内容长度除以3的余数
+func fcgiRecord(kind byte, id uint16, content []byte) []byte {
+	padding := len(content) % 3
+	r := []byte{1, kind, 0, 0, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(r[2:], id)
+	binary.BigEndian.PutUint16(r[4:], uint16(len(content)))
+	r = append(r, content...)
+	return append(r, make([]byte, padding)...)
+}
+
+//fcgiPairs 编码PARAMS中的名称与值
+func fcgiPairs(pairs ...string) []byte {
+	var p []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		p = append(p, byte(len(pairs[i])), byte(len(pairs[i+1])))
+		p = append(p, pairs[i]...)
+		p = append(p, pairs[i+1]...)
+	}
+	return p
+}
+
+//fcgiBegin 开始一个请求的记录，包括PARAMS与STDIN
+func fcgiBegin(id uint16, body string, pairs ...string) []byte {
+	req := fcgiRecord(fcgiBeginRequest, id, []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	req = append(req, fcgiRecord(fcgiParams, id, fcgiPairs(pairs...))...)
+	req = append(req, fcgiRecord(fcgiParams, id, nil)...)
+	if body != "" {
+		req = append(req, fcgiRecord(fcgiStdin, id, []byte(body))...)
+	}
+	return append(req, fcgiRecord(fcgiStdin, id, nil)...)
+}
+
+//fcgiEnd 请求的STDOUT与END_REQUEST记录
+func fcgiEnd(id uint16, status byte, stdout ...string) []byte {
+	var res []byte
+	for _, out := range stdout {
+		res = append(res, fcgiRecord(fcgiStdout, id, []byte(out))...)
+	}
+	return append(res, fcgiRecord(fcgiEndRequest, id, []byte{0, 0, 0, 0, status, 0, 0, 0})...)
+}
+
+func TestFastCGIDecode(t *testing.T) {
+	large := string(make([]byte, fcgiHeadLimit+100))
+	tests := []struct {
+		name     string
+		request  []byte
+		response []byte
+		//sweep 检查超时，close 连接关闭
+		sweep, close bool
+		want         metric.HTTPMessage
+	}{
+		{
+			name:     "php error page",
+			request:  fcgiBegin(1, "a=1", "REQUEST_METHOD", "POST", "REQUEST_URI", "/index.php/user/123?x=1", "HTTP_HOST", "Shop.example.com:80", "REMOTE_ADDR", "203.0.113.7"),
+			response: fcgiEnd(1, 0, "X-Powered-By: PHP\r\nStatus: 404 Not Found\r\nContent-type: text/html\r\n\r\nhello", "world"),
+			want:     metric.HTTPMessage{Method: "POST", URI: "/index.php/user/{num}", Host: "shop.example.com", RemoteAddr: "203.0.113.7", StatusCode: 404, RequestLength: 3, ContentLength: 10},
+		},
+		{
+			name:     "redirect without status",
+			request:  fcgiBegin(2, "", "REQUEST_METHOD", "GET", "SCRIPT_NAME", "/login.php"),
+			response: fcgiEnd(2, 0, "Location: /home\r\n\r\n"),
+			want:     metric.HTTPMessage{Method: "GET", URI: "/login.php", RemoteAddr: "10.0.0.2", StatusCode: 302},
+		},
+		{
+			name:     "large body after headers",
+			request:  fcgiBegin(3, "", "REQUEST_METHOD", "GET", "REQUEST_URI", "/report"),
+			response: fcgiEnd(3, 0, "Content-type: text/csv\r\n\r\n"+large),
+			want:     metric.HTTPMessage{Method: "GET", URI: "/report", RemoteAddr: "10.0.0.2", StatusCode: 200, ContentLength: len(large)},
+		},
+		{
+			name:     "overloaded",
+			request:  fcgiBegin(4, "", "REQUEST_METHOD", "GET", "REQUEST_URI", "/"),
+			response: fcgiEnd(4, 2),
+			want:     metric.HTTPMessage{Method: "GET", URI: "/", RemoteAddr: "10.0.0.2", StatusCode: 200, Failed: true},
+		},
+		{
+			name:    "abort request",
+			request: append(fcgiBegin(5, "", "REQUEST_METHOD", "GET", "REQUEST_URI", "/slow"), fcgiRecord(fcgiAbortRequest, 5, nil)...),
+			want:    metric.HTTPMessage{Method: "GET", URI: "/slow", RemoteAddr: "10.0.0.2", Result: metric.ResultAborted},
+		},
+		{
+			name:    "timeout",
+			request: fcgiBegin(6, "", "REQUEST_METHOD", "GET", "REQUEST_URI", "/slow"),
+			sweep:   true,
+			want:    metric.HTTPMessage{Method: "GET", URI: "/slow", RemoteAddr: "10.0.0.2", Result: metric.ResultTimeout},
+		},
+		{
+			name:    "connection closed",
+			request: fcgiBegin(7, "", "REQUEST_METHOD", "GET", "REQUEST_URI", "/slow"),
+			close:   true,
+			want:    metric.HTTPMessage{Method: "GET", URI: "/slow", RemoteAddr: "10.0.0.2", Result: metric.ResultAborted},
+		},
+	}
+	for _, test := range tests {
+		d := &FastCGIDecode{pathNormalizer: NewPathNormalizer(nil), hostFolder: newHostFolder(config.Port{}), uaClassifier: getUAClassifier("", nil)}
+		s, st := newTestStream(d)
+		d.tcpStream = s
+		start := time.Now()
+		c := newTestConn(start)
+		s.conns["10.0.0.2:40000"] = c
+		//逐字节输入请求，检查跨报文的记录
+		for i := range test.request {
+			s.feed(c, true, test.request[i:i+1])
+		}
+		c.now = start.Add(50 * time.Millisecond)
+		if half := len(test.response) / 2; half > 0 {
+			s.feed(c, false, test.response[:half])
+			s.feed(c, false, test.response[half:])
+		}
+		if test.sweep {
+			s.sweep(start.Add(2 * time.Second))
+		}
+		if test.close {
+			s.close(c)
+		}
+		if len(st.msgs) != 1 {
+			t.Errorf("%s: got %d messages", test.name, len(st.msgs))
+			continue
+		}
+		m, want := st.msgs[0].(*metric.HTTPMessage), test.want
+		if m.Method != want.Method || m.URI != want.URI || m.Host != want.Host || m.RemoteAddr != want.RemoteAddr || m.StatusCode != want.StatusCode ||
+			m.RequestLength != want.RequestLength || m.ContentLength != want.ContentLength || m.Failed != want.Failed || m.Result != want.Result {
+			t.Errorf("%s: got %+v", test.name, m)
+		}
+		if want.Result == "" && m.TimeConsum != int64(50*time.Millisecond) {
+			t.Errorf("%s: time is %d", test.name, m.TimeConsum)
+		}
+	}
+}
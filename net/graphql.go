@@ -0,0 +1,275 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"tcm/metric"
+)
+
+const (
+	//maxGraphQLOperations 统计的最大操作数量，超出后归入otherOperation
+	maxGraphQLOperations = 500
+	//otherOperation 超出数量限制的操作
+	otherOperation = "other"
+)
+
+//graphqlRequest 请求中的一个GraphQL操作
+type graphqlRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+	Extensions    struct {
+		PersistedQuery *struct {
+			Sha256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+//operation 是否包含GraphQL请求的字段，其他JSON请求不按GraphQL统计
+func (q *graphqlRequest) operation() bool {
+	return q.Query != "" || q.OperationName != "" || q.Extensions.PersistedQuery != nil
+}
+
+type graphqlResponse struct {
+	Errors []json.RawMessage `json:"errors"`
+}
+
+//graphqlInspector GraphQL模式，按操作类型与名称代替地址统计
+type graphqlInspector struct {
+	operations *labelFolder
+}
+
+func newGraphQLInspector() *graphqlInspector {
+	operations := newLabelFolder(maxGraphQLOperations)
+	operations.overflow = otherOperation
+	return &graphqlInspector{operations: operations}
+}
+
+func (g *graphqlInspector) bodyLimits() (request, response int) {
+	return maxInspectBody, maxInspectBody
+}
+
+//inspect 批量请求中的每个操作生成一条监控数据，请求的字节数与客户端只计入第一个操作
+func (g *graphqlInspector) inspect(info *metric.HTTPMessage, r *httpRequest, rs *httpResponse, body []byte) []*metric.HTTPMessage {
+	reqs := parseGraphQLRequests(r)
+	if len(reqs) == 0 {
+		return []*metric.HTTPMessage{info}
+	}
+	var failed []bool
+	if rs != nil {
+		failed = graphqlErrors(body, len(reqs))
+	}
+	out := make([]*metric.HTTPMessage, 0, len(reqs))
+	for i, q := range reqs {
+		m := *info
+		m.URI = g.operations.fold(graphqlOperation(q))
+		m.Failed = failed != nil && failed[i]
+		if i > 0 {
+			m.Batched = true
+			m.RequestLength, m.ContentLength = 0, 0
+		}
+		out = append(out, &m)
+	}
+	return out
+}
+
+//parseGraphQLRequests 从请求报文体或GET请求的查询参数中获取操作，支持批量请求与持久化查询
+func parseGraphQLRequests(r *httpRequest) []graphqlRequest {
+	var body []byte
+	if r.body != nil {
+		body = bytes.TrimSpace(r.body.capture)
+	}
+	var reqs []graphqlRequest
+	switch {
+	case len(body) > 0 && body[0] == '[':
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			return nil
+		}
+		for i := range reqs {
+			if !reqs[i].operation() {
+				return nil
+			}
+		}
+	case len(body) > 0 && body[0] == '{':
+		var q graphqlRequest
+		if err := json.Unmarshal(body, &q); err != nil || !q.operation() {
+			return nil
+		}
+		reqs = append(reqs, q)
+	case len(body) > 0:
+		//application/graphql，报文体即查询文档
+		reqs = append(reqs, graphqlRequest{Query: string(body)})
+	case r.query != "":
+		values, err := url.ParseQuery(r.query)
+		if err != nil || (values.Get("query") == "" && values.Get("extensions") == "") {
+			return nil
+		}
+		q := graphqlRequest{Query: values.Get("query"), OperationName: values.Get("operationName")}
+		if ext := values.Get("extensions"); ext != "" {
+			json.Unmarshal([]byte(ext), &q.Extensions)
+		}
+		reqs = append(reqs, q)
+	}
+	return reqs
+}
+
+//graphqlOperation 返回 操作类型 操作名称，如 query GetUser
+func graphqlOperation(q graphqlRequest) string {
+	kind, name := parseGraphQLOperation(q.Query, q.OperationName)
+	if q.Query == "" {
+		kind = "persisted"
+		if name == "" {
+			if q.Extensions.PersistedQuery != nil {
+				name = q.Extensions.PersistedQuery.Sha256Hash
+			}
+			if len(name) > 12 {
+				name = name[:12]
+			}
+		}
+	}
+	if name == "" {
+		name = "anonymous"
+	}
+	if len(name) > maxDimensionValueLength {
+		name = name[:maxDimensionValueLength]
+	}
+	return kind + " " + name
+}
+
+//parseGraphQLOperation 找到查询文档中要执行的操作，有多个操作时按operationName选择
+func parseGraphQLOperation(doc, operationName string) (kind, name string) {
+	type operation struct{ kind, name string }
+	var ops []operation
+	depth := 0
+	//definition 顶层定义的关键字之后，expectName 等待操作名称
+	definition, expectName := false, false
+	for i := 0; i < len(doc); i++ {
+		c := doc[i]
+		switch {
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			if i+2 < len(doc) && doc[i+1] == '"' && doc[i+2] == '"' {
+				end := -1
+				for j := i + 3; j+2 < len(doc); j++ {
+					if doc[j] == '"' && doc[j+1] == '"' && doc[j+2] == '"' && doc[j-1] != '\\' {
+						end = j + 2
+						break
+					}
+				}
+				if end < 0 {
+					i = len(doc)
+				} else {
+					i = end
+				}
+				continue
+			}
+			for i++; i < len(doc) && doc[i] != '"'; i++ {
+				if doc[i] == '\\' {
+					i++
+				}
+			}
+		case c == '{' || c == '(' || c == '[':
+			if depth == 0 && c == '{' && !definition {
+				//简写的匿名查询
+				ops = append(ops, operation{kind: "query"})
+			}
+			if depth == 0 && c == '{' {
+				definition = false
+			}
+			expectName = false
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			if depth > 0 {
+				depth--
+			}
+		case c == '@':
+			expectName = false
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9':
+			j := i
+			for j < len(doc) && (doc[j] == '_' || 'a' <= doc[j] && doc[j] <= 'z' || 'A' <= doc[j] && doc[j] <= 'Z' || '0' <= doc[j] && doc[j] <= '9') {
+				j++
+			}
+			word := doc[i:j]
+			i = j - 1
+			if depth > 0 {
+				continue
+			}
+			switch {
+			case expectName:
+				ops[len(ops)-1].name = word
+				expectName = false
+			case definition:
+			case word == "query" || word == "mutation" || word == "subscription":
+				ops = append(ops, operation{kind: word})
+				definition, expectName = true, true
+			case word == "fragment":
+				definition = true
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return "query", operationName
+	}
+	for _, op := range ops {
+		if operationName != "" && op.name == operationName {
+			return op.kind, op.name
+		}
+	}
+	if ops[0].name == "" {
+		return ops[0].kind, operationName
+	}
+	return ops[0].kind, ops[0].name
+}
+
+//graphqlErrors 响应中每个操作是否有errors，批量请求的响应为数组
+func graphqlErrors(body []byte, n int) []bool {
+	failed := make([]bool, n)
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return failed
+	}
+	if body[0] == '[' {
+		var res []graphqlResponse
+		if err := json.Unmarshal(body, &res); err == nil {
+			for i := range failed {
+				failed[i] = i < len(res) && len(res[i].Errors) > 0
+			}
+			return failed
+		}
+	} else {
+		var res graphqlResponse
+		if err := json.Unmarshal(body, &res); err == nil {
+			for i := range failed {
+				failed[i] = len(res.Errors) > 0
+			}
+			return failed
+		}
+	}
+	//报文体不完整时按是否有errors字段判断
+	has := bytes.Contains(body, []byte(`"errors"`))
+	for i := range failed {
+		failed[i] = has
+	}
+	return failed
+}
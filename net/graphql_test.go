@@ -0,0 +1,118 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"tcm/metric"
+	"testing"
+)
+
+func TestGraphQLInspect(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		response string
+		uris     []string
+		failed   []bool
+	}{
+		{
+			name: "named query",
+			body: `{"query":"query GetUser($id: ID!) { user(id: $id) { name } }","variables":{"id":"1"}}`,
+			uris: []string{"query GetUser"}, failed: []bool{false},
+		},
+		{
+			name:     "operation name selects the operation",
+			body:     `{"query":"query A { a } mutation B { b }","operationName":"B"}`,
+			response: `{"data":null,"errors":[{"message":"denied"}]}`,
+			uris:     []string{"mutation B"}, failed: []bool{true},
+		},
+		{
+			name: "anonymous shorthand with fragment and comment",
+			body: `{"query":"# mutation Fake\n{ ...F } fragment F on Query { me { id } }"}`,
+			uris: []string{"query anonymous"}, failed: []bool{false},
+		},
+		{
+			name: "persisted query",
+			body: `{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"ecf4edb46db40b5132295c0291d62fb65d6759a9eedfa4d5d612dd5ec54a6b38"}}}`,
+			uris: []string{"persisted ecf4edb46db4"}, failed: []bool{false},
+		},
+		{
+			name:     "batch",
+			body:     `[{"query":"query A { a }"},{"query":"subscription S { s }"}]`,
+			response: `[{"data":{"a":1}},{"errors":[{"message":"x"}]}]`,
+			uris:     []string{"query A", "subscription S"}, failed: []bool{false, true},
+		},
+		{
+			name:     "truncated response",
+			body:     `{"query":"query A { a }"}`,
+			response: `{"errors":[{"message":"x"`,
+			uris:     []string{"query A"}, failed: []bool{true},
+		},
+		{
+			name:  "get",
+			query: "query=query%20Search%20%7B%20s%20%7D&operationName=Search",
+			uris:  []string{"query Search"}, failed: []bool{false},
+		},
+		{
+			name: "application/graphql",
+			body: `mutation Login { login }`,
+			uris: []string{"mutation Login"}, failed: []bool{false},
+		},
+		{
+			name: "other json keeps the path",
+			body: `{"username":"a","password":"b"}`,
+			uris: []string{"/login"}, failed: []bool{false},
+		},
+		{
+			name: "batch with other json keeps the path",
+			body: `[{"query":"query A { a }"},{"id":1}]`,
+			uris: []string{"/login"}, failed: []bool{false},
+		},
+	}
+	g := newGraphQLInspector()
+	for _, test := range tests {
+		r := &httpRequest{method: "POST", uri: "/login", query: test.query, body: &bodyReader{capture: []byte(test.body)}}
+		info := &metric.HTTPMessage{URI: "/login", RequestLength: 100}
+		out := g.inspect(info, r, &httpResponse{request: r, status: 200}, []byte(test.response))
+		if len(out) != len(test.uris) {
+			t.Errorf("%s: got %d messages", test.name, len(out))
+			continue
+		}
+		for i, m := range out {
+			if m.URI != test.uris[i] || m.Failed != test.failed[i] || m.Batched != (i > 0) {
+				t.Errorf("%s: message %d is %s failed %v batched %v", test.name, i, m.URI, m.Failed, m.Batched)
+			}
+			if i > 0 && m.RequestLength != 0 {
+				t.Errorf("%s: batched message %d counts %d request bytes", test.name, i, m.RequestLength)
+			}
+		}
+	}
+}
+
+func TestGraphQLOperationLimit(t *testing.T) {
+	g := newGraphQLInspector()
+	g.operations.max = 1
+	for _, test := range []struct{ name, want string }{{"A", "query A"}, {"B", otherOperation}, {"A", "query A"}} {
+		r := &httpRequest{body: &bodyReader{capture: []byte(`{"query":"query ` + test.name + ` { x }"}`)}}
+		if out := g.inspect(&metric.HTTPMessage{}, r, nil, nil); out[0].URI != test.want {
+			t.Errorf("operation %s got %s", test.name, out[0].URI)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"net"
+	"strings"
+	"tcm/config"
+	"time"
+)
+
+//defaultMaxHosts 每个端口默认统计的最大Host数量
+const defaultMaxHosts = 50
+
+//hostIdleTimeout 与Host统计的缓存时间相同，超过该时长未出现的Host让出名额
+const hostIdleTimeout = 5 * time.Minute
+
+//otherHost 超出数量限制或未知的Host归入该值
+const otherHost = "other"
+
+//hostFolder 规范化请求的Host并限制Host维度的数量
+type hostFolder struct {
+	foldUnknown bool
+	known       map[string]bool
+	admitted    *labelFolder
+}
+
+func newHostFolder(port config.Port) *hostFolder {
+	max := port.MaxHosts
+	if max <= 0 {
+		max = defaultMaxHosts
+	}
+	f := &hostFolder{
+		foldUnknown: port.FoldUnknownHosts,
+		known:       make(map[string]bool),
+		admitted:    newLabelFolder(max),
+	}
+	f.admitted.overflow = otherHost
+	f.admitted.idle = hostIdleTimeout
+	for _, h := range port.Hosts {
+		f.known[normalizeHost(h)] = true
+	}
+	return f
+}
+
+//fold 返回用于统计的Host
+func (f *hostFolder) fold(host string) string {
+	host = normalizeHost(host)
+	if host == "" || f.known[host] {
+		return host
+	}
+	if f.foldUnknown {
+		return otherHost
+	}
+	return f.admitted.fold(host)
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
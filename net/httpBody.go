@@ -0,0 +1,236 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	//报文体没有内容
+	bodyNone = iota
+	//报文体长度由Content-Length给出
+	bodyLength
+	//chunked编码
+	bodyChunked
+	//没有声明长度，读到连接关闭为止
+	bodyUntilClose
+)
+
+const (
+	chunkSize = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+)
+
+//bodyReader 按照报文头声明的传输方式统计报文体长度，不保存报文内容
+type bodyReader struct {
+	mode   int
+	remain int64
+	//已经读到的报文体字节数，chunked编码时为解码后的长度
+	n    int64
+	done bool
+	//chunked解析状态
+	state   int
+	chunk   int64
+	ext     bool
+	lineLen int
+	//有数据的chunk数量
+	chunks uint64
+	//text/event-stream响应统计事件数量，空行表示一个事件结束
+	sse     bool
+	events  uint64
+	newline bool
+	//limit大于0时保存解码后的报文体，最多limit字节
+	limit   int
+	capture []byte
+}
+
+func newBodyReader(mode int, length int64) *bodyReader {
+	b := &bodyReader{mode: mode, remain: length}
+	if mode == bodyNone || (mode == bodyLength && length <= 0) {
+		b.done = true
+	}
+	return b
+}
+
+//requestBodyReader 根据请求头创建报文体读取器
+func requestBodyReader(r *httpRequest) *bodyReader {
+	if r.chunked {
+		return newBodyReader(bodyChunked, 0)
+	}
+	if r.contentLength > 0 {
+		return newBodyReader(bodyLength, r.contentLength)
+	}
+	return newBodyReader(bodyNone, 0)
+}
+
+//responseBodyReader 根据请求方法与响应头创建报文体读取器
+func responseBodyReader(method string, r *httpResponse) *bodyReader {
+	if method == "HEAD" || (r.status >= 100 && r.status < 200) || r.status == 204 || r.status == 304 {
+		return newBodyReader(bodyNone, 0)
+	}
+	if r.chunked {
+		return newBodyReader(bodyChunked, 0)
+	}
+	if r.contentLength >= 0 {
+		return newBodyReader(bodyLength, r.contentLength)
+	}
+	return newBodyReader(bodyUntilClose, 0)
+}
+
+//feed 读取一段报文体
+func (b *bodyReader) feed(p []byte) {
+	if b.done {
+		return
+	}
+	switch b.mode {
+	case bodyLength:
+		n := int64(len(p))
+		if n > b.remain {
+			n = b.remain
+		}
+		b.n += n
+		b.remain -= n
+		b.data(p[:n])
+		if b.remain == 0 {
+			b.done = true
+		}
+	case bodyUntilClose:
+		b.n += int64(len(p))
+		b.data(p)
+	case bodyChunked:
+		b.feedChunked(p)
+	}
+}
+
+func (b *bodyReader) feedChunked(p []byte) {
+	for len(p) > 0 && !b.done {
+		switch b.state {
+		case chunkSize:
+			c := p[0]
+			p = p[1:]
+			switch {
+			case c == '\n':
+				if b.chunk == 0 {
+					b.state = chunkTrailer
+				} else {
+					b.remain = b.chunk
+					b.state = chunkData
+					b.chunks++
+				}
+				b.chunk, b.ext = 0, false
+			case c == ';':
+				b.ext = true
+			case b.ext || c == '\r' || c == ' ' || c == '\t':
+			default:
+				v := unhex(c)
+				if v < 0 || b.chunk > 1<<40 {
+					//非法的chunk头，放弃继续解析
+					b.done = true
+					return
+				}
+				b.chunk = b.chunk<<4 | v
+			}
+		case chunkData:
+			n := int64(len(p))
+			if n > b.remain {
+				n = b.remain
+			}
+			b.n += n
+			b.remain -= n
+			b.data(p[:n])
+			p = p[n:]
+			if b.remain == 0 {
+				b.state = chunkDataEnd
+			}
+		case chunkDataEnd:
+			if p[0] == '\n' {
+				b.state = chunkSize
+			}
+			p = p[1:]
+		case chunkTrailer:
+			c := p[0]
+			p = p[1:]
+			if c == '\n' {
+				if b.lineLen == 0 {
+					b.done = true
+				}
+				b.lineLen = 0
+			} else if c != '\r' {
+				b.lineLen++
+			}
+		}
+	}
+}
+
+//data 读取解码后的报文体数据
+func (b *bodyReader) data(p []byte) {
+	if n := b.limit - len(b.capture); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.capture = append(b.capture, p[:n]...)
+	}
+	if !b.sse {
+		return
+	}
+	for _, c := range p {
+		switch c {
+		case '\n':
+			if b.newline {
+				b.events++
+			}
+			b.newline = true
+		case '\r':
+		default:
+			b.newline = false
+		}
+	}
+}
+
+//decodeBody 解压gzip编码的报文体，报文体不完整时返回已经解压的部分
+func decodeBody(encoding string, body []byte) []byte {
+	if len(body) == 0 || !strings.Contains(strings.ToLower(encoding), "gzip") {
+		return body
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	out, _ := ioutil.ReadAll(io.LimitReader(r, maxInspectBody))
+	return out
+}
+
+func unhex(c byte) int64 {
+	switch {
+	case '0' <= c && c <= '9':
+		return int64(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int64(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int64(c - 'A' + 10)
+	}
+	return -1
+}
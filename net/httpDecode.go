@@ -19,19 +19,17 @@
 package net
 
 import (
-	"bufio"
 	"bytes"
-	"context"
 	"fmt"
-	"net/http"
+	"strconv"
 	"strings"
 	"tcm/config"
 	"tcm/metric"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
-	conv "github.com/cstockton/go-conv"
 	cache "github.com/patrickmn/go-cache"
 	"github.com/prometheus/common/log"
 )
@@ -40,6 +38,22 @@ import (
 type HTTPDecode struct {
 	httpmanager *HTTPManager
 	port        config.Port
+	clientIP    *clientIPResolver
+	//需要从请求头、响应头中复制的头部
+	requestHeaders  []string
+	responseHeaders []string
+	//按模式解析报文体时需要保存查询参数
+	inspect bool
+	//按客户端地址缓存跨分段的请求头与响应头
+	heads map[string]*httpHeads
+}
+
+//maxHeadConns 缓存未完成头部的连接数量超过该值时清理过期的头部
+const maxHeadConns = 1024
+
+//httpHeads 一个连接上两个方向未完成的头部
+type httpHeads struct {
+	request, response headBuffer
 }
 
 //CreateHTTPDecode CreateHTTPDecode
@@ -49,74 +63,296 @@ func CreateHTTPDecode(option *config.Option, port config.Port) *HTTPDecode {
 		log.Errorf("create http manager error,%s", err.Error())
 		return nil
 	}
-	md := &HTTPDecode{httpmanager: manager, port: port}
+	proxies := port.TrustedProxies
+	if len(proxies) == 0 {
+		proxies = option.TrustedProxies
+	}
+	md := &HTTPDecode{
+		httpmanager:     manager,
+		port:            port,
+		clientIP:        newClientIPResolver(proxies),
+		requestHeaders:  []string{"If-None-Match", "If-Modified-Since"},
+		responseHeaders: []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "X-Cache", "Age", "Content-Type", "Upgrade"},
+		heads:           make(map[string]*httpHeads),
+	}
+	if port.Mode != "" {
+		md.inspect = true
+		md.responseHeaders = append(md.responseHeaders, "Content-Encoding")
+	}
+	for _, d := range port.Dimensions {
+		if strings.EqualFold(d.From, "response") {
+			md.responseHeaders = append(md.responseHeaders, d.Header)
+		} else {
+			md.requestHeaders = append(md.requestHeaders, d.Header)
+		}
+	}
 	return md
 }
 
 //Decode 解码
 func (h *HTTPDecode) Decode(data *SourceData) {
-	bufer := bytes.NewBuffer(data.Source)
-	//fmt.Println(string(data.Source))
 	if data.TCP == nil {
 		log.Errorln("TCP is nil, so it may be is not http")
 		return
 	}
-	if data.TCP.SrcPort.String() == "" {
-		log.Errorln("TCP SrcPort is empty, so it may be is not http")
-		return
-	}
-	if strings.HasPrefix(data.TCP.SrcPort.String(), fmt.Sprintf("%d(", h.port.Port)) { //Response,通过源端口判断
-		//抛弃数据包，只分析报文头部包
-		if string(data.Source[0:4]) == "HTTP" {
-			var rm ResponseMessage
-			rm.RequestKey = conv.String(data.TCP.Seq) + data.TargetHost.String() + ":" + data.TargetPoint.String()
-			rm.ReceiveTime = data.ReceiveDate
-			response, err := http.ReadResponse(bufio.NewReader(bufer), nil)
+	var head httpHead
+	if int(data.TCP.SrcPort) == h.port.Port { //Response,通过源端口判断
+		connKey := data.TargetHost.String() + ":" + data.TargetPoint.String()
+		//头部包解析为响应，其余的包作为响应报文体统计
+		if hs := h.heads[connKey]; (hs != nil && hs.response.pending()) || bytes.HasPrefix(data.Source, []byte("HTTP")) {
+			buf, source, err := h.parseHead(connKey, true, data, &head)
+			if err == errHTTPIncomplete && !data.TCP.FIN && !data.TCP.RST {
+				return
+			}
 			if err != nil {
 				log.With("error", err.Error()).Errorln("Decode the data to http response error.")
+				return
 			}
-			if response != nil {
-				// log.Infof("To Host %s Port %s Time: %s ", data.TargetHost.String(), data.TargetPoint.String(), conv.String(data.ReceiveDate))
-				// log.Infof("Response ACK %b:%d  SEQ %d  Content-length:%s", data.TCP.ACK, data.TCP.Ack, data.TCP.Seq, response.Header.Get("Content-Length"))
-				rm.Response = response
-				h.httpmanager.MessageChan <- rm
+			h.httpmanager.MessageChan <- ResponseMessage{
+				Response: &httpResponse{
+					status:        head.status,
+					header:        head.copyHeaders(h.responseHeaders),
+					contentLength: head.contentLength,
+					chunked:       head.chunked,
+					resTime:       buf.start,
+				},
+				RequestKey:  strconv.FormatUint(uint64(buf.seq), 10) + connKey,
+				ConnKey:     connKey,
+				Body:        source[head.headerLength:],
+				ReceiveTime: data.ReceiveDate,
 			}
 		} else {
-			log.Warnln("Discarded Response body package ", data.Source[0:4])
+			h.httpmanager.MessageChan <- BodyMessage{
+				ConnKey:     connKey,
+				Response:    true,
+				Payload:     data.Source,
+				Close:       data.TCP.FIN || data.TCP.RST,
+				ReceiveTime: data.ReceiveDate,
+			}
 		}
 	} else { //Request
-		//log.Infof("From Host %s Port %s  Time: %s ", data.SourceHost.String(), data.SourcePoint.String(), conv.String(data.ReceiveDate))
-		request, err := http.ReadRequest(bufio.NewReader(bufer))
+		connKey := data.SourceHost.String() + ":" + data.SourcePoint.String()
+		if len(data.Source) == 0 {
+			if data.TCP.FIN || data.TCP.RST {
+				delete(h.heads, connKey)
+				h.httpmanager.MessageChan <- BodyMessage{ConnKey: connKey, Close: true, ReceiveTime: data.ReceiveDate}
+			}
+			return
+		}
+		buf, source, err := h.parseHead(connKey, false, data, &head)
+		if err == errHTTPIncomplete && !data.TCP.FIN && !data.TCP.RST {
+			return
+		}
 		if err != nil {
-			log.With("error", err.Error()).Errorln("Decode the data to http request error.")
+			//不是请求头部的包作为上一个请求的报文体统计
+			h.httpmanager.MessageChan <- BodyMessage{
+				ConnKey:     connKey,
+				Payload:     data.Source,
+				Close:       data.TCP.FIN || data.TCP.RST,
+				ReceiveTime: data.ReceiveDate,
+			}
+			return
+		}
+		remote := data.SourceHost.String()
+		if data.ProxyClient != nil {
+			remote = data.ProxyClient.Host
+		}
+		request := &httpRequest{
+			method:        string(head.method),
+			host:          string(head.peek("Host")),
+			uri:           head.path(),
+			userAgent:     string(head.peek("User-Agent")),
+			remoteAddr:    h.clientIP.resolve(remote, &head),
+			header:        head.copyHeaders(h.requestHeaders),
+			contentLength: head.contentLength,
+			chunked:       head.chunked,
+			reqTime:       buf.start,
+		}
+		if h.inspect {
+			request.query = head.query()
+		}
+		h.httpmanager.MessageChan <- RequestMessage{
+			Request:     request,
+			RequestKey:  strconv.FormatUint(uint64(buf.seq), 10) + connKey,
+			ConnKey:     connKey,
+			Body:        source[head.headerLength:],
+			ReceiveTime: data.ReceiveDate,
 		}
-		if request != nil && data.TCP != nil {
-			// log.Infof("From Request Path %s ", request.RequestURI)
-			// log.Infof("Request ACK %b:%d  SEQ %d ", data.TCP.ACK, data.TCP.Ack, data.TCP.Seq)
-			request.RemoteAddr = data.SourceHost.String()
-			key := conv.String(data.TCP.Ack) + data.SourceHost.String() + ":" + data.SourcePoint.String()
-			request = request.WithContext(context.WithValue(context.Background(), metric.MapKey("key"), key))
-			request = request.WithContext(context.WithValue(request.Context(), metric.MapKey("ReqTime"), data.ReceiveDate))
-			h.httpmanager.MessageChan <- request
+	}
+}
+
+//parseHead 解析请求头或响应头，头部不完整时缓存分段并返回errHTTPIncomplete，
+//连接关闭时丢弃未完成的头部
+func (h *HTTPDecode) parseHead(connKey string, response bool, data *SourceData, head *httpHead) (*headBuffer, []byte, error) {
+	heads := h.heads[connKey]
+	buf := &headBuffer{}
+	if heads != nil {
+		buf = &heads.request
+		if response {
+			buf = &heads.response
+		}
+	}
+	if !buf.pending() {
+		buf.seq, buf.start = data.TCP.Ack, data.ReceiveDate
+		if response {
+			buf.seq = data.TCP.Seq
+		}
+	}
+	parse := parseRequestHead
+	if response {
+		parse = parseResponseHead
+	}
+	source, err := buf.feed(data.Source, parse, head)
+	switch {
+	case err == errHTTPIncomplete && (data.TCP.FIN || data.TCP.RST):
+		delete(h.heads, connKey)
+	case err == errHTTPIncomplete && heads == nil:
+		heads = h.newHeads(connKey, data.ReceiveDate)
+		if response {
+			heads.response = *buf
+		} else {
+			heads.request = *buf
+		}
+	case heads != nil && !heads.request.pending() && !heads.response.pending():
+		delete(h.heads, connKey)
+	}
+	return buf, source, err
+}
+
+//newHeads 保存连接未完成的头部，连接较多时清理长时间没有后续分段的头部
+func (h *HTTPDecode) newHeads(connKey string, now time.Time) *httpHeads {
+	if len(h.heads) >= maxHeadConns {
+		for k, hs := range h.heads {
+			if (!hs.request.pending() || now.Sub(hs.request.start) > bodyIdleTimeout) &&
+				(!hs.response.pending() || now.Sub(hs.response.start) > bodyIdleTimeout) {
+				delete(h.heads, k)
+			}
 		}
 	}
+	hs := &httpHeads{}
+	h.heads[connKey] = hs
+	return hs
 }
 
 //HTTPManager 监控信息存储
 type HTTPManager struct {
-	cache                      *cache.Cache
+	cache *cache.Cache
+	//按客户端地址保存正在传输报文体的请求与响应
+	conns                      map[string]*httpConn
 	MessageChan                chan interface{}
 	RequestsLock, ResponseLock sync.Mutex
-	httpMetricStore            metric.Store
+	//cache中超时移除的请求，由监控协程定时处理
+	expiredLock     sync.Mutex
+	expired         []TimeoutMessage
+	httpMetricStore metric.Store
+	pathNormalizer  *PathNormalizer
+	hostFolder      *hostFolder
+	uaClassifier    *uaClassifier
+	dimensions      []*headerDimension
+	//配置为长轮询的地址，以*结尾时按前缀匹配
+	longPollRoutes []string
+	inspector      bodyInspector
+}
+
+//httpConn 一个客户端连接上正在传输的请求与响应
+type httpConn struct {
+	//等待响应的请求
+	pending      map[string]*pendingRequest
+	request      *bodyReader
+	response     *httpResponse
+	responseBody *bodyReader
+	//按Content-Type识别的流式响应类型
+	stream string
+	//协议升级之后的连接
+	upgrade  *httpUpgrade
+	lastByte time.Time
+	lastSeen time.Time
+}
+
+//httpUpgrade 响应101之后升级为WebSocket或其他协议的连接
+type httpUpgrade struct {
+	kind     string
+	response *httpResponse
+	in, out  wsReader
+}
+
+//pendingRequest 等待响应的请求，done在得到响应、超时或连接关闭时置为1
+type pendingRequest struct {
+	request *httpRequest
+	connKey string
+	done    int32
+}
+
+//finish 只有第一次调用返回true，保证每个请求只统计一次
+func (p *pendingRequest) finish() bool {
+	return atomic.CompareAndSwapInt32(&p.done, 0, 1)
+}
+
+//TimeoutMessage 超过期限没有得到响应的请求
+type TimeoutMessage struct {
+	RequestKey string
+	Pending    *pendingRequest
+}
+
+//RequestMessage request message
+type RequestMessage struct {
+	Request     *httpRequest
+	RequestKey  string
+	ConnKey     string
+	Body        []byte
+	ReceiveTime time.Time
 }
 
 //ResponseMessage response message
 type ResponseMessage struct {
-	Response    *http.Response
+	Response    *httpResponse
 	RequestKey  string
+	ConnKey     string
+	Body        []byte
 	ReceiveTime time.Time
 }
 
+//BodyMessage 头部包之后的报文体，Close表示连接已经关闭
+type BodyMessage struct {
+	ConnKey     string
+	Response    bool
+	Payload     []byte
+	Close       bool
+	ReceiveTime time.Time
+}
+
+//bodyInspector 按端口模式解析请求与响应报文体，生成按操作统计的监控数据
+type bodyInspector interface {
+	//bodyLimits 需要保存的请求与响应报文体长度
+	bodyLimits() (request, response int)
+	//inspect 没有得到响应时rs与body为nil，body为解码后的响应报文体
+	inspect(info *metric.HTTPMessage, r *httpRequest, rs *httpResponse, body []byte) []*metric.HTTPMessage
+}
+
+func newBodyInspector(mode string) bodyInspector {
+	switch strings.ToLower(mode) {
+	case "":
+		return nil
+	case "graphql":
+		return newGraphQLInspector()
+	case "elasticsearch":
+		return newESInspector()
+	}
+	log.Errorf("http mode %s is not supported", mode)
+	return nil
+}
+
+const (
+	//maxInspectBody 按模式解析时保存的报文体最大长度
+	maxInspectBody = 64 << 10
+	//bodyIdleTimeout 报文体超过该时间没有新数据时认为响应已经结束
+	bodyIdleTimeout = 30 * time.Second
+	//sessionIdleTimeout WebSocket与流式响应超过该时间没有新数据时认为已经结束
+	sessionIdleTimeout = 10 * time.Minute
+	//streamDuration 报文体传输超过该时间的响应作为流式响应统计
+	streamDuration = 30 * time.Second
+)
+
 //CreateHTTPManager 创建httpmanager
 func CreateHTTPManager(option *config.Option, port config.Port) (*HTTPManager, error) {
 
@@ -124,11 +360,26 @@ func CreateHTTPManager(option *config.Option, port config.Port) (*HTTPManager, e
 	if ms == nil {
 		return nil, fmt.Errorf("create metric store error")
 	}
+	timeout := option.RequestTimeout
+	if port.RequestTimeout > 0 {
+		timeout = time.Duration(port.RequestTimeout) * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
 	httpmanager := &HTTPManager{
-		cache:           cache.New(10*time.Second, 1*time.Minute),
-		MessageChan:     make(chan interface{}, 100),
+		cache:           cache.New(timeout, time.Second),
+		conns:           make(map[string]*httpConn),
+		MessageChan:     make(chan interface{}, 1024),
 		httpMetricStore: ms,
+		pathNormalizer:  NewPathNormalizer(port.Routes),
+		hostFolder:      newHostFolder(port),
+		uaClassifier:    getUAClassifier(option.UARulesFile, option.Close),
+		dimensions:      newHeaderDimensions(port.Dimensions),
+		longPollRoutes:  port.LongPollRoutes,
+		inspector:       newBodyInspector(port.Mode),
 	}
+	httpmanager.cache.OnEvicted(httpmanager.onEvicted)
 	go httpmanager.handleMessageChan(option.Close)
 	go ms.Start()
 	return httpmanager, nil
@@ -144,35 +395,316 @@ func (m *HTTPManager) Close() {
 	}
 }
 func (m *HTTPManager) handleMessageChan(close chan struct{}) {
+	tick := time.NewTicker(5 * time.Second)
+	expire := time.NewTicker(time.Second)
 	for {
 		select {
 		case <-close:
+			tick.Stop()
+			expire.Stop()
 			log.Infoln("stop read request message chan")
 			return
+		case now := <-tick.C:
+			m.flushIdle(now)
+		case <-expire.C:
+			m.handleExpired()
 		case message := <-m.MessageChan:
 			switch message.(type) {
-			case *http.Request:
-				request := message.(*http.Request)
-				key := request.Context().Value(metric.MapKey("key")).(string)
-				m.cache.Set(key, request, cache.DefaultExpiration)
-				//log.Infof("Request number:%d", len(m.requests))
+			case RequestMessage:
+				m.handleRequest(message.(RequestMessage))
 			case ResponseMessage:
-				response := message.(ResponseMessage)
-				key := response.RequestKey
-				if re, ok := m.cache.Get(key); ok {
-					if r, ok := re.(*http.Request); ok {
-						r = r.WithContext(context.WithValue(r.Context(), metric.MapKey("ResTime"), response.ReceiveTime))
-						response.Response.Request = r
-						m.cache.Delete(key)
-						info := metric.CreateHTTPMessage(response.Response)
-						m.httpMetricStore.Input(info)
-					}
-				} else {
-					log.Warnf("request key %s not found", key)
-					continue
-				}
+				m.handleResponse(message.(ResponseMessage))
+			case BodyMessage:
+				m.handleBody(message.(BodyMessage))
+			}
+		}
+	}
+}
 
+func (m *HTTPManager) conn(key string) *httpConn {
+	c, ok := m.conns[key]
+	if !ok {
+		c = &httpConn{}
+		m.conns[key] = c
+	}
+	return c
+}
+
+func (m *HTTPManager) handleRequest(request RequestMessage) {
+	c := m.conn(request.ConnKey)
+	//同一连接上出现新的请求，上一个响应已经结束
+	m.finishResponse(c)
+	m.finishUpgrade(c)
+	c.request = requestBodyReader(request.Request)
+	request.Request.body = c.request
+	if m.inspector != nil {
+		c.request.limit, _ = m.inspector.bodyLimits()
+	}
+	c.request.feed(request.Body)
+	c.lastSeen = request.ReceiveTime
+	p := &pendingRequest{request: request.Request, connKey: request.ConnKey}
+	if c.pending == nil {
+		c.pending = make(map[string]*pendingRequest)
+	}
+	c.pending[request.RequestKey] = p
+	m.cache.Set(request.RequestKey, p, cache.DefaultExpiration)
+	//log.Infof("Request number:%d", len(m.requests))
+}
+
+//onEvicted 请求从cache中移除时调用，超时移除时在janitor协程中执行，不能阻塞
+func (m *HTTPManager) onEvicted(key string, value interface{}) {
+	if p, ok := value.(*pendingRequest); ok && atomic.LoadInt32(&p.done) == 0 {
+		m.expiredLock.Lock()
+		m.expired = append(m.expired, TimeoutMessage{RequestKey: key, Pending: p})
+		m.expiredLock.Unlock()
+	}
+}
+
+//handleExpired 统计cache中超时移除的请求
+func (m *HTTPManager) handleExpired() {
+	m.expiredLock.Lock()
+	expired := m.expired
+	m.expired = nil
+	m.expiredLock.Unlock()
+	for _, t := range expired {
+		m.handleTimeout(t)
+	}
+}
+
+func (m *HTTPManager) handleTimeout(t TimeoutMessage) {
+	if c, ok := m.conns[t.Pending.connKey]; ok {
+		delete(c.pending, t.RequestKey)
+	}
+	if t.Pending.finish() {
+		m.reportUnanswered(t.Pending.request, metric.ResultTimeout)
+	}
+}
+
+//reportUnanswered 统计没有得到响应的请求
+func (m *HTTPManager) reportUnanswered(r *httpRequest, result string) {
+	info := r.message()
+	info.Result = result
+	m.fillMessage(info, r.header, nil)
+	m.input(info, r, nil, nil)
+}
+
+func (m *HTTPManager) handleResponse(response ResponseMessage) {
+	key := response.RequestKey
+	re, ok := m.cache.Get(key)
+	if !ok {
+		log.Warnf("request key %s not found", key)
+		return
+	}
+	p, ok := re.(*pendingRequest)
+	if !ok || !p.finish() {
+		return
+	}
+	m.cache.Delete(key)
+	c := m.conn(response.ConnKey)
+	delete(c.pending, key)
+	m.finishResponse(c)
+	response.Response.request = p.request
+	c.lastByte = response.ReceiveTime
+	c.lastSeen = response.ReceiveTime
+	if response.Response.status == 101 {
+		c.request = nil
+		c.upgrade = &httpUpgrade{kind: metric.SessionUpgrade, response: response.Response}
+		if strings.EqualFold(response.Response.header.Get("Upgrade"), "websocket") {
+			c.upgrade.kind = metric.SessionWebSocket
+		} else {
+			//其他协议只统计字节数
+			c.upgrade.in.broken, c.upgrade.out.broken = true, true
+		}
+		c.upgrade.out.feed(response.Body)
+		return
+	}
+	c.response = response.Response
+	c.responseBody = responseBodyReader(p.request.method, response.Response)
+	c.stream = streamType(response.Response.header.Get("Content-Type"))
+	c.responseBody.sse = c.stream == metric.SessionSSE
+	if m.inspector != nil {
+		_, c.responseBody.limit = m.inspector.bodyLimits()
+	}
+	c.responseBody.feed(response.Body)
+	if c.responseBody.done {
+		m.finishResponse(c)
+	}
+}
+
+func (m *HTTPManager) handleBody(body BodyMessage) {
+	c, ok := m.conns[body.ConnKey]
+	if !ok {
+		return
+	}
+	if c.upgrade != nil {
+		if body.Response {
+			c.upgrade.out.feed(body.Payload)
+		} else {
+			c.upgrade.in.feed(body.Payload)
+		}
+		if len(body.Payload) > 0 {
+			c.lastByte = body.ReceiveTime
+		}
+	} else if body.Response && c.response != nil && len(body.Payload) > 0 {
+		c.responseBody.feed(body.Payload)
+		c.lastByte = body.ReceiveTime
+		if c.responseBody.done {
+			m.finishResponse(c)
+		}
+	} else if !body.Response && c.request != nil {
+		c.request.feed(body.Payload)
+	}
+	c.lastSeen = body.ReceiveTime
+	if body.Close {
+		m.finishResponse(c)
+		m.finishUpgrade(c)
+		//连接在得到响应之前关闭
+		for key, p := range c.pending {
+			if p.finish() {
+				m.cache.Delete(key)
+				m.reportUnanswered(p.request, metric.ResultAborted)
 			}
 		}
+		delete(m.conns, body.ConnKey)
+	}
+}
+
+//finishResponse 响应传输结束，生成监控数据
+func (m *HTTPManager) finishResponse(c *httpConn) {
+	if c.response == nil {
+		return
+	}
+	r, rs := c.response.request, c.response
+	if kind := m.sessionKind(c); kind != "" {
+		session := m.sessionMessage(kind, r, rs, c.lastByte)
+		session.FramesOut = c.responseBody.chunks
+		session.MessagesOut = c.responseBody.chunks
+		if kind == metric.SessionSSE {
+			session.MessagesOut = c.responseBody.events
+		}
+		if c.request != nil {
+			session.BytesIn = uint64(c.request.n)
+		}
+		session.BytesOut = uint64(c.responseBody.n)
+		m.httpMetricStore.Input(session)
+		c.request, c.response, c.responseBody, c.stream = nil, nil, nil, ""
+		return
+	}
+	info := r.message()
+	info.StatusCode = rs.status
+	info.Cache = metric.CreateHTTPCache(r.method, rs.status, r.header, rs.header)
+	info.TimeConsum = rs.resTime.Sub(r.reqTime).Nanoseconds()
+	m.fillMessage(info, r.header, rs.header)
+	if c.request != nil {
+		info.RequestLength = int(c.request.n)
+	}
+	info.ContentLength = int(c.responseBody.n)
+	info.TimeToLastByte = c.lastByte.Sub(r.reqTime).Nanoseconds()
+	m.input(info, r, rs, c.responseBody.capture)
+	c.request, c.response, c.responseBody, c.stream = nil, nil, nil, ""
+}
+
+//input 有解析模式时由模式生成监控数据
+func (m *HTTPManager) input(info *metric.HTTPMessage, r *httpRequest, rs *httpResponse, body []byte) {
+	if m.inspector == nil {
+		m.httpMetricStore.Input(info)
+		return
+	}
+	if rs != nil {
+		body = decodeBody(rs.header.Get("Content-Encoding"), body)
+	}
+	for _, message := range m.inspector.inspect(info, r, rs, body) {
+		m.httpMetricStore.Input(message)
+	}
+}
+
+//finishUpgrade 升级之后的连接结束，生成会话监控数据
+func (m *HTTPManager) finishUpgrade(c *httpConn) {
+	if c.upgrade == nil {
+		return
+	}
+	u := c.upgrade
+	session := m.sessionMessage(u.kind, u.response.request, u.response, c.lastByte)
+	session.FramesIn, session.FramesOut = u.in.frames, u.out.frames
+	session.MessagesIn, session.MessagesOut = u.in.messages, u.out.messages
+	session.BytesIn, session.BytesOut = u.in.bytes, u.out.bytes
+	//优先使用服务端发出的关闭状态码
+	session.CloseCode = u.out.closeCode
+	if session.CloseCode == 0 {
+		session.CloseCode = u.in.closeCode
+	}
+	m.httpMetricStore.Input(session)
+	c.upgrade = nil
+}
+
+//sessionKind 判断响应是否作为流式会话统计，普通响应返回空
+func (m *HTTPManager) sessionKind(c *httpConn) string {
+	if c.stream != "" {
+		return c.stream
+	}
+	if len(m.longPollRoutes) > 0 && m.isLongPoll(m.pathNormalizer.Normalize(c.response.request.uri)) {
+		return metric.SessionLongPoll
+	}
+	if c.lastByte.Sub(c.response.resTime) > streamDuration {
+		return metric.SessionStream
+	}
+	return ""
+}
+
+func (m *HTTPManager) isLongPoll(uri string) bool {
+	for _, r := range m.longPollRoutes {
+		if r == uri || (strings.HasSuffix(r, "*") && strings.HasPrefix(uri, r[:len(r)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+//sessionMessage 通过请求与响应构造会话监控数据，end为最后一个报文的时间
+func (m *HTTPManager) sessionMessage(kind string, r *httpRequest, rs *httpResponse, end time.Time) *metric.HTTPSession {
+	return &metric.HTTPSession{
+		Kind:       kind,
+		Method:     r.method,
+		Host:       m.hostFolder.fold(r.host),
+		URI:        m.pathNormalizer.Normalize(r.uri),
+		StatusCode: rs.status,
+		Duration:   end.Sub(r.reqTime).Nanoseconds(),
+	}
+}
+
+//streamType 按Content-Type识别流式响应
+func streamType(contentType string) string {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "text/event-stream"):
+		return metric.SessionSSE
+	case strings.HasPrefix(ct, "application/x-ndjson"), strings.HasPrefix(ct, "application/stream+json"),
+		strings.HasPrefix(ct, "multipart/x-mixed-replace"):
+		return metric.SessionStream
+	}
+	return ""
+}
+
+//fillMessage 归并地址与Host，补充User-Agent分类与自定义维度
+func (m *HTTPManager) fillMessage(info *metric.HTTPMessage, req, res headerSet) {
+	info.URI = m.pathNormalizer.Normalize(info.URI)
+	info.Host = m.hostFolder.fold(info.Host)
+	ua := m.uaClassifier.classify(info.UserAgent)
+	info.UACategory, info.UABrowser, info.UAOS, info.UADevice = ua.Category, ua.Browser, ua.OS, ua.Device
+	info.Dimensions = headerDimensionValues(m.dimensions, req, res)
+}
+
+//flushIdle 结束长时间没有数据的响应，清理不再活动的连接
+func (m *HTTPManager) flushIdle(now time.Time) {
+	for k, c := range m.conns {
+		limit := bodyIdleTimeout
+		if c.upgrade != nil || c.stream != "" {
+			limit = sessionIdleTimeout
+		}
+		if now.Sub(c.lastSeen) > limit {
+			m.finishResponse(c)
+			m.finishUpgrade(c)
+			delete(m.conns, k)
+		}
 	}
 }
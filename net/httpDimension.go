@@ -0,0 +1,146 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"regexp"
+	"strings"
+	"tcm/config"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	//defaultMaxDimensionValues 每个维度默认统计的最大取值数量
+	defaultMaxDimensionValues = 100
+	//maxDimensionValueLength 维度取值的最大长度
+	maxDimensionValueLength = 64
+	//dimensionMissing 没有该头时的取值
+	dimensionMissing = "none"
+	//dimensionOther 不在allow中或超出数量限制的取值
+	dimensionOther = "other"
+)
+
+//headerDimension 从http头中获取一个统计维度
+type headerDimension struct {
+	name      string
+	header    string
+	response  bool
+	normalize string
+	pattern   *regexp.Regexp
+	allow     map[string]bool
+	values    *labelFolder
+}
+
+func newHeaderDimensions(dims []config.Dimension) []*headerDimension {
+	var out []*headerDimension
+	for _, d := range dims {
+		if d.Header == "" {
+			log.Errorf("dimension %s has no header, ignore it", d.Name)
+			continue
+		}
+		hd := &headerDimension{
+			name:      d.Name,
+			header:    d.Header,
+			response:  strings.EqualFold(d.From, "response"),
+			normalize: strings.ToLower(d.Normalize),
+		}
+		if hd.name == "" {
+			hd.name = strings.ToLower(d.Header)
+		}
+		max := d.MaxValues
+		if max <= 0 {
+			max = defaultMaxDimensionValues
+		}
+		hd.values = newLabelFolder(max)
+		hd.values.overflow = dimensionOther
+		if d.Pattern != "" {
+			reg, err := regexp.Compile(d.Pattern)
+			if err != nil {
+				log.Errorf("dimension %s pattern is invalid,%s", hd.name, err.Error())
+				continue
+			}
+			hd.pattern = reg
+		}
+		if len(d.Allow) > 0 {
+			hd.allow = make(map[string]bool)
+			for _, a := range d.Allow {
+				hd.allow[hd.normalizeValue(a)] = true
+			}
+		}
+		out = append(out, hd)
+	}
+	return out
+}
+
+func (d *headerDimension) normalizeValue(v string) string {
+	v = strings.TrimSpace(v)
+	switch d.normalize {
+	case "lower":
+		v = strings.ToLower(v)
+	case "upper":
+		v = strings.ToUpper(v)
+	}
+	return v
+}
+
+//value 返回请求对应的维度取值
+func (d *headerDimension) value(req, res headerSet) string {
+	h := req
+	if d.response {
+		h = res
+	}
+	v := d.normalizeValue(h.Get(d.header))
+	if v != "" && d.pattern != nil {
+		m := d.pattern.FindStringSubmatch(v)
+		switch {
+		case m == nil:
+			v = ""
+		case len(m) > 1:
+			v = m[1]
+		default:
+			v = m[0]
+		}
+	}
+	if v == "" {
+		return dimensionMissing
+	}
+	if len(v) > maxDimensionValueLength {
+		v = v[:maxDimensionValueLength]
+	}
+	if d.allow != nil {
+		if d.allow[v] {
+			return v
+		}
+		return dimensionOther
+	}
+	return d.values.fold(v)
+}
+
+//headerDimensionValues 返回所有维度的取值
+func headerDimensionValues(dims []*headerDimension, req, res headerSet) map[string]string {
+	if len(dims) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(dims))
+	for _, d := range dims {
+		values[d.name] = d.value(req, res)
+	}
+	return values
+}
@@ -0,0 +1,372 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"tcm/metric"
+	"time"
+)
+
+//maxHTTPHeaders 保存的请求头数量上限，超出的头部只用于判断报文体长度
+const maxHTTPHeaders = 48
+
+//maxHTTPHead 跨分段缓存的头部最大长度，超出时认为不是HTTP头部
+const maxHTTPHead = 64 << 10
+
+var (
+	errHTTPIncomplete = errors.New("http head is incomplete")
+	errHTTPMalformed  = errors.New("http head is malformed")
+)
+
+type headerField struct {
+	name  []byte
+	value []byte
+}
+
+//httpHead 解析出的请求或响应头部
+//所有字段都引用原始报文，不复制数据，报文在解析结果使用期间不能被修改
+type httpHead struct {
+	//请求行
+	method []byte
+	target []byte
+	//状态行
+	status int
+	proto  []byte
+	//Content-Length，没有声明时为-1
+	contentLength int64
+	chunked       bool
+	//头部长度，包含结尾的空行
+	headerLength int
+	headers      [maxHTTPHeaders]headerField
+	nheaders     int
+}
+
+//parseRequestHead 解析请求行与请求头
+func parseRequestHead(data []byte, h *httpHead) error {
+	line, rest, err := nextLine(data)
+	if err != nil {
+		//请求行不完整时只有以请求方法开始的数据才可能是头部
+		method := data
+		if sp := bytes.IndexByte(data, ' '); sp >= 0 {
+			method = data[:sp]
+		}
+		if len(method) == 0 || !isMethod(method) {
+			return errHTTPMalformed
+		}
+		return err
+	}
+	sp := bytes.IndexByte(line, ' ')
+	if sp <= 0 || !isMethod(line[:sp]) {
+		return errHTTPMalformed
+	}
+	h.method = line[:sp]
+	line = line[sp+1:]
+	sp = bytes.IndexByte(line, ' ')
+	if sp <= 0 {
+		return errHTTPMalformed
+	}
+	h.target = line[:sp]
+	h.proto = line[sp+1:]
+	if !bytes.HasPrefix(h.proto, []byte("HTTP/1.")) {
+		return errHTTPMalformed
+	}
+	h.status = 0
+	return parseHeaders(data, rest, h)
+}
+
+//parseResponseHead 解析状态行与响应头
+func parseResponseHead(data []byte, h *httpHead) error {
+	line, rest, err := nextLine(data)
+	if err != nil {
+		return err
+	}
+	if len(line) < 12 || !bytes.HasPrefix(line, []byte("HTTP/1.")) || line[8] != ' ' {
+		return errHTTPMalformed
+	}
+	h.proto = line[:8]
+	h.status = 0
+	for _, c := range line[9:12] {
+		if c < '0' || c > '9' {
+			return errHTTPMalformed
+		}
+		h.status = h.status*10 + int(c-'0')
+	}
+	h.method, h.target = nil, nil
+	return parseHeaders(data, rest, h)
+}
+
+func parseHeaders(data, rest []byte, h *httpHead) error {
+	h.contentLength = -1
+	h.chunked = false
+	h.nheaders = 0
+	for {
+		line, next, err := nextLine(rest)
+		if err != nil {
+			return err
+		}
+		rest = next
+		if len(line) == 0 {
+			h.headerLength = len(data) - len(rest)
+			return nil
+		}
+		//不支持的折行头部直接跳过
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			return errHTTPMalformed
+		}
+		name, value := line[:colon], trimSpace(line[colon+1:])
+		switch {
+		case equalFold(name, "Content-Length"):
+			var n int64
+			for _, c := range value {
+				if c < '0' || c > '9' || n > 1<<50 {
+					return errHTTPMalformed
+				}
+				n = n*10 + int64(c-'0')
+			}
+			h.contentLength = n
+		case equalFold(name, "Transfer-Encoding"):
+			h.chunked = containsFold(value, "chunked")
+		}
+		if h.nheaders < maxHTTPHeaders {
+			h.headers[h.nheaders] = headerField{name: name, value: value}
+			h.nheaders++
+		}
+	}
+}
+
+//headBuffer 缓存跨TCP分段的头部，头部完整后再解析，之前的分段不作为报文体统计
+type headBuffer struct {
+	data []byte
+	//第一个分段用于匹配请求与响应的序号与时间
+	seq   uint32
+	start time.Time
+}
+
+//pending 是否有未完成的头部
+func (b *headBuffer) pending() bool {
+	return len(b.data) > 0
+}
+
+//feed 追加一个分段并解析，头部不完整时缓存数据并返回errHTTPIncomplete，
+//解析成功时返回头部所在的完整数据
+func (b *headBuffer) feed(p []byte, parse func([]byte, *httpHead) error, h *httpHead) ([]byte, error) {
+	data := p
+	if b.pending() {
+		b.data = append(b.data, p...)
+		data = b.data
+	}
+	err := parse(data, h)
+	if err != errHTTPIncomplete {
+		b.data = nil
+		return data, err
+	}
+	if len(data) > maxHTTPHead {
+		b.data = nil
+		return nil, errHTTPMalformed
+	}
+	if !b.pending() {
+		//分段的数据在解码之后可能被复用，需要复制
+		b.data = append([]byte(nil), p...)
+	}
+	return nil, err
+}
+
+//nextLine 返回去掉换行符的一行与剩余的数据
+func nextLine(data []byte) (line, rest []byte, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, nil, errHTTPIncomplete
+	}
+	line = data[:i]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, data[i+1:], nil
+}
+
+//peek 返回第一个名称匹配的头部的值，不分配内存
+func (h *httpHead) peek(name string) []byte {
+	for i := 0; i < h.nheaders; i++ {
+		if equalFold(h.headers[i].name, name) {
+			return h.headers[i].value
+		}
+	}
+	return nil
+}
+
+//Get 返回第一个名称匹配的头部的值
+func (h *httpHead) Get(name string) string {
+	if h == nil {
+		return ""
+	}
+	return string(h.peek(name))
+}
+
+//values 依次返回所有名称匹配的头部的值
+func (h *httpHead) values(name string) []string {
+	var out []string
+	for i := 0; h != nil && i < h.nheaders; i++ {
+		if equalFold(h.headers[i].name, name) {
+			out = append(out, string(h.headers[i].value))
+		}
+	}
+	return out
+}
+
+//path 去掉查询参数的请求地址
+func (h *httpHead) path() string {
+	if i := bytes.IndexByte(h.target, '?'); i > -1 {
+		return string(h.target[:i])
+	}
+	return string(h.target)
+}
+
+//query 请求地址中的查询参数
+func (h *httpHead) query() string {
+	if i := bytes.IndexByte(h.target, '?'); i > -1 {
+		return string(h.target[i+1:])
+	}
+	return ""
+}
+
+//headerValue 从报文中复制出的头部
+type headerValue struct {
+	name  string
+	value string
+}
+
+//headerSet 统计需要的少量头部，请求结束前一直保存
+type headerSet []headerValue
+
+//Get 返回第一个名称匹配的头部的值
+func (s headerSet) Get(name string) string {
+	for _, h := range s {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+//copyHeaders 只复制names中列出的头部
+func (h *httpHead) copyHeaders(names []string) headerSet {
+	var s headerSet
+	for i := 0; i < h.nheaders; i++ {
+		for _, name := range names {
+			if equalFold(h.headers[i].name, name) {
+				s = append(s, headerValue{name: name, value: string(h.headers[i].value)})
+				break
+			}
+		}
+	}
+	return s
+}
+
+//httpRequest 请求中需要统计的字段
+type httpRequest struct {
+	method        string
+	host          string
+	uri           string
+	userAgent     string
+	remoteAddr    string
+	header        headerSet
+	contentLength int64
+	chunked       bool
+	reqTime       time.Time
+	//按模式解析报文体时保存查询参数与请求报文体
+	query string
+	body  *bodyReader
+}
+
+//httpResponse 响应中需要统计的字段，request为与之对应的请求
+type httpResponse struct {
+	request       *httpRequest
+	status        int
+	header        headerSet
+	contentLength int64
+	chunked       bool
+	resTime       time.Time
+}
+
+//message 通过请求构造监控数据
+func (r *httpRequest) message() *metric.HTTPMessage {
+	return &metric.HTTPMessage{
+		Method:     r.method,
+		Host:       r.host,
+		URI:        r.uri,
+		UserAgent:  r.userAgent,
+		RemoteAddr: r.remoteAddr,
+	}
+}
+
+func isMethod(b []byte) bool {
+	for _, c := range b {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return len(b) <= 16
+}
+
+func trimSpace(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+//equalFold 不区分大小写比较ASCII字符串
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		if lower(b[i]) != lower(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//containsFold 不区分大小写判断b中是否包含s
+func containsFold(b []byte, s string) bool {
+	for i := 0; i+len(s) <= len(b); i++ {
+		if equalFold(b[i:i+len(s)], s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+var benchRequest = []byte("GET /api/v1/users/12345/orders?page=2 HTTP/1.1\r\n" +
+	"Host: api.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36\r\n" +
+	"Accept: application/json\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Accept-Language: zh-CN,zh;q=0.9\r\n" +
+	"Cookie: session=0123456789abcdef; theme=dark\r\n" +
+	"X-Forwarded-For: 203.0.113.7, 10.0.0.2\r\n" +
+	"If-None-Match: \"5d8c72a5edda8\"\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n")
+
+var benchResponse = []byte("HTTP/1.1 200 OK\r\n" +
+	"Server: nginx\r\n" +
+	"Date: Mon, 02 Jan 2017 15:04:05 GMT\r\n" +
+	"Content-Type: application/json; charset=utf-8\r\n" +
+	"Content-Length: 27\r\n" +
+	"Cache-Control: max-age=60\r\n" +
+	"ETag: \"5d8c72a5edda8\"\r\n" +
+	"Vary: Accept-Encoding\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n" +
+	`{"id":12345,"orders":[1,2]}`)
+
+func TestParseRequestHead(t *testing.T) {
+	var head httpHead
+	if err := parseRequestHead(benchRequest, &head); err != nil {
+		t.Fatal(err)
+	}
+	std, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(benchRequest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head.method) != std.Method || string(head.target) != std.RequestURI || head.path() != std.URL.Path {
+		t.Errorf("request line is %s %s", head.method, head.target)
+	}
+	if head.Get("host") != std.Host || head.Get("User-Agent") != std.UserAgent() {
+		t.Errorf("headers are %q %q", head.Get("Host"), head.Get("User-Agent"))
+	}
+	if head.contentLength != -1 || head.chunked || head.headerLength != len(benchRequest) {
+		t.Errorf("body is %d %v %d", head.contentLength, head.chunked, head.headerLength)
+	}
+	if err := parseRequestHead(benchRequest[:40], &head); err != errHTTPIncomplete {
+		t.Errorf("parse incomplete head got %v", err)
+	}
+	if err := parseRequestHead([]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\r\n"), &head); err != errHTTPMalformed {
+		t.Errorf("parse binary data got %v", err)
+	}
+}
+
+func TestParseResponseHead(t *testing.T) {
+	var head httpHead
+	if err := parseResponseHead(benchResponse, &head); err != nil {
+		t.Fatal(err)
+	}
+	if head.status != 200 || head.contentLength != 27 || string(benchResponse[head.headerLength:]) != `{"id":12345,"orders":[1,2]}` {
+		t.Errorf("response is %d %d %d", head.status, head.contentLength, head.headerLength)
+	}
+	set := head.copyHeaders([]string{"cache-control", "ETag"})
+	if len(set) != 2 || set.Get("Cache-Control") != "max-age=60" || set.Get("Server") != "" {
+		t.Errorf("copied headers are %v", set)
+	}
+	chunked := []byte("HTTP/1.1 404 Not Found\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n")
+	if err := parseResponseHead(chunked, &head); err != nil || head.status != 404 || !head.chunked || head.contentLength != -1 {
+		t.Errorf("parse chunked response got %v %d %v", err, head.status, head.chunked)
+	}
+}
+
+func TestHeadBuffer(t *testing.T) {
+	var buf headBuffer
+	var head httpHead
+	for _, split := range []int{3, 40, len(benchRequest) - 1} {
+		if _, err := buf.feed(benchRequest[:split], parseRequestHead, &head); err != errHTTPIncomplete || !buf.pending() {
+			t.Fatalf("feed %d bytes got %v", split, err)
+		}
+		data, err := buf.feed(benchRequest[split:], parseRequestHead, &head)
+		if err != nil || buf.pending() || head.headerLength != len(benchRequest) || head.Get("Host") != "api.example.com" {
+			t.Errorf("resume after %d bytes got %v %d", split, err, head.headerLength)
+		}
+		if string(data) != string(benchRequest) {
+			t.Errorf("resume after %d bytes got data %q", split, data)
+		}
+	}
+	head.headerLength = 0
+	if _, err := buf.feed(benchResponse[:30], parseResponseHead, &head); err != errHTTPIncomplete {
+		t.Fatalf("feed response got %v", err)
+	}
+	if data, err := buf.feed(benchResponse[30:], parseResponseHead, &head); err != nil || head.status != 200 || string(data[head.headerLength:]) != `{"id":12345,"orders":[1,2]}` {
+		t.Errorf("resume response got %v %d", err, head.status)
+	}
+	//不以请求方法开始的报文体分段不缓存
+	if _, err := buf.feed([]byte(`{"query":"{ user }"`), parseRequestHead, &head); err != errHTTPMalformed || buf.pending() {
+		t.Errorf("feed body got %v", err)
+	}
+}
+
+func BenchmarkStdReadRequest(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchRequest)))
+	for i := 0; i < b.N; i++ {
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(benchRequest)))
+		if err != nil || r.Method != "GET" {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRequestHead(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchRequest)))
+	var head httpHead
+	for i := 0; i < b.N; i++ {
+		if err := parseRequestHead(benchRequest, &head); err != nil || head.peek("Host") == nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStdReadResponse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchResponse)))
+	for i := 0; i < b.N; i++ {
+		r, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(benchResponse)), nil)
+		if err != nil || r.StatusCode != 200 {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseResponseHead(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchResponse)))
+	var head httpHead
+	for i := 0; i < b.N; i++ {
+		if err := parseResponseHead(benchResponse, &head); err != nil || head.status != 200 {
+			b.Fatal(err)
+		}
+	}
+}
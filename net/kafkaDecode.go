@@ -0,0 +1,587 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+)
+
+//Kafka API
+const (
+	kafkaProduce     = 0
+	kafkaFetch       = 1
+	kafkaMetadata    = 3
+	kafkaAPIVersions = 18
+)
+
+const (
+	//maxKafkaMessage 认为是Kafka请求的最大长度，超出时重新同步
+	maxKafkaMessage = 100 << 20
+	//maxKafkaTopics 统计的最大topic数量，超出后归入other
+	maxKafkaTopics = 500
+	//maxKafkaClients 统计字节数的最大client id数量，超出后归入other
+	maxKafkaClients = 200
+	//maxKafkaTopicIDs 从Metadata响应中记录的topic id数量
+	maxKafkaTopicIDs = 10000
+)
+
+//kafkaAPIs API名称
+var kafkaAPIs = map[int16]string{
+	0: "Produce", 1: "Fetch", 2: "ListOffsets", 3: "Metadata", 4: "LeaderAndIsr",
+	5: "StopReplica", 6: "UpdateMetadata", 7: "ControlledShutdown", 8: "OffsetCommit",
+	9: "OffsetFetch", 10: "FindCoordinator", 11: "JoinGroup", 12: "Heartbeat",
+	13: "LeaveGroup", 14: "SyncGroup", 15: "DescribeGroups", 16: "ListGroups",
+	17: "SaslHandshake", 18: "ApiVersions", 19: "CreateTopics", 20: "DeleteTopics",
+	21: "DeleteRecords", 22: "InitProducerId", 23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn", 25: "AddOffsetsToTxn", 26: "EndTxn", 27: "WriteTxnMarkers",
+	28: "TxnOffsetCommit", 29: "DescribeAcls", 30: "CreateAcls", 31: "DeleteAcls",
+	32: "DescribeConfigs", 33: "AlterConfigs", 34: "AlterReplicaLogDirs",
+	35: "DescribeLogDirs", 36: "SaslAuthenticate", 37: "CreatePartitions",
+	38: "CreateDelegationToken", 39: "RenewDelegationToken", 40: "ExpireDelegationToken",
+	41: "DescribeDelegationToken", 42: "DeleteGroups", 43: "ElectLeaders",
+	44: "IncrementalAlterConfigs", 45: "AlterPartitionReassignments",
+	46: "ListPartitionReassignments", 47: "OffsetDelete", 48: "DescribeClientQuotas",
+	49: "AlterClientQuotas", 50: "DescribeUserScramCredentials",
+	51: "AlterUserScramCredentials", 55: "DescribeQuorum", 56: "AlterPartition",
+	57: "UpdateFeatures", 60: "DescribeCluster", 61: "DescribeProducers",
+	65: "DescribeTransactions", 66: "ListTransactions", 67: "AllocateProducerIds",
+	68: "ConsumerGroupHeartbeat", 69: "ConsumerGroupDescribe",
+	71: "GetTelemetrySubscriptions", 72: "PushTelemetry",
+}
+
+//kafkaFlexible 请求与响应头部开始包含tagged fields的版本，只记录需要解析响应的API
+//ApiVersions的响应头部总是不包含tagged fields，不需要记录
+var kafkaFlexible = map[int16]int16{
+	kafkaProduce: 9, kafkaFetch: 12, kafkaMetadata: 9, 10: 3, 11: 6, 12: 4, 13: 4, 14: 4,
+	22: 2, 36: 2,
+}
+
+//kafkaTopError 响应开头有错误码的API，取值为[错误码之前有throttle_time_ms的最低版本, 有顶层错误码的最高版本]
+var kafkaTopError = map[int16][2]int16{
+	10: {1, 3}, 11: {2, 99}, 12: {1, 99}, 13: {1, 99}, 14: {1, 99},
+	17: {99, 99}, kafkaAPIVersions: {99, 99}, 22: {0, 99}, 36: {99, 99},
+}
+
+//kafkaErrors 常见的错误码名称
+var kafkaErrors = map[int16]string{
+	-1: "UNKNOWN_SERVER_ERROR", 1: "OFFSET_OUT_OF_RANGE", 2: "CORRUPT_MESSAGE",
+	3: "UNKNOWN_TOPIC_OR_PARTITION", 5: "LEADER_NOT_AVAILABLE", 6: "NOT_LEADER_OR_FOLLOWER",
+	7: "REQUEST_TIMED_OUT", 10: "MESSAGE_TOO_LARGE", 14: "COORDINATOR_LOAD_IN_PROGRESS",
+	15: "COORDINATOR_NOT_AVAILABLE", 16: "NOT_COORDINATOR", 19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND", 22: "ILLEGAL_GENERATION", 25: "UNKNOWN_MEMBER_ID",
+	27: "REBALANCE_IN_PROGRESS", 29: "TOPIC_AUTHORIZATION_FAILED",
+	30: "GROUP_AUTHORIZATION_FAILED", 31: "CLUSTER_AUTHORIZATION_FAILED",
+	35: "UNSUPPORTED_VERSION", 41: "NOT_CONTROLLER", 47: "INVALID_PRODUCER_EPOCH",
+	58: "SASL_AUTHENTICATION_FAILED", 74: "FENCED_LEADER_EPOCH", 75: "UNKNOWN_LEADER_EPOCH",
+	79: "MEMBER_ID_REQUIRED", 100: "UNKNOWN_TOPIC_ID",
+}
+
+//kafkaRequest 等待响应的请求
+type kafkaRequest struct {
+	api      int16
+	version  int16
+	clientID string
+	//Produce与Fetch请求中的topic，Produce时记录消息字节数
+	topics []*kafkaTopic
+	length int
+}
+
+type kafkaTopic struct {
+	name  string
+	bytes uint64
+	code  string
+}
+
+//KafkaDecode Kafka协议解码
+type KafkaDecode struct {
+	*tcpStream
+	topics  *labelFolder
+	clients *labelFolder
+	//新版本Produce与Fetch使用topic id，从Metadata响应中获取名称
+	topicNames map[[16]byte]string
+}
+
+//CreateKafkaDecode CreateKafkaDecode
+func CreateKafkaDecode(option *config.Option, port config.Port) *KafkaDecode {
+	d := &KafkaDecode{
+		topics:     newLabelFolder(maxKafkaTopics),
+		clients:    newLabelFolder(maxKafkaClients),
+		topicNames: make(map[[16]byte]string),
+	}
+	d.tcpStream = newTCPStream("kafka", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *KafkaDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 8 {
+		return 0, 0
+	}
+	size := int(int32(binary.BigEndian.Uint32(buf)))
+	if size < 4 || size > maxKafkaMessage {
+		return -1, 0
+	}
+	if request {
+		api := int16(binary.BigEndian.Uint16(buf[4:]))
+		version := int16(binary.BigEndian.Uint16(buf[6:]))
+		if size < 10 || api < 0 || api > 100 || version < 0 || version > 30 {
+			return -1, 0
+		}
+	}
+	return size + 4, size + 4
+}
+
+func (d *KafkaDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	if request {
+		d.request(s, c, frame, total)
+		return
+	}
+	call := c.reply(uint64(binary.BigEndian.Uint32(frame[4:])))
+	if call == nil {
+		return
+	}
+	r := call.value.(*kafkaRequest)
+	kr := &kafkaReader{p: frame[8:], flexible: r.flexible()}
+	kr.tags()
+	code := ""
+	switch r.api {
+	case kafkaProduce:
+		d.produceResponse(kr, r)
+	case kafkaFetch:
+		code = d.fetchResponse(kr, r)
+	case kafkaMetadata:
+		d.metadataResponse(kr, r)
+	default:
+		if e, ok := kafkaTopError[r.api]; ok && r.version <= e[1] {
+			if r.version >= e[0] {
+				kr.skip(4)
+			}
+			if n := kr.int16(); !kr.err {
+				code = kafkaError(n)
+			}
+		}
+	}
+	elapsed := c.elapsed(call)
+	for _, msg := range d.messages(c, r, total) {
+		msg.ReqTime = elapsed
+		if msg.Code == "" {
+			msg.Code = code
+		}
+		s.store.Input(msg)
+	}
+}
+
+func (d *KafkaDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	for _, msg := range d.messages(c, call.value.(*kafkaRequest), 0) {
+		msg.Result = result
+		s.store.Input(msg)
+	}
+}
+
+//request 解析请求头部，Produce与Fetch解析topic，acks为0的Produce没有响应
+func (d *KafkaDecode) request(s *tcpStream, c *streamConn, frame []byte, total int) {
+	kr := &kafkaReader{p: frame[4:]}
+	r := &kafkaRequest{api: kr.int16(), version: kr.int16(), length: total}
+	correlationID := uint64(uint32(kr.int32()))
+	//头部的client id总是非compact的字符串
+	if n := int(kr.int16()); n > 0 {
+		r.clientID = string(kr.take(n))
+	}
+	if kr.err {
+		return
+	}
+	kr.flexible = r.flexible()
+	kr.tags()
+	switch r.api {
+	case kafkaProduce:
+		if r.version >= 3 {
+			kr.str()
+		}
+		acks := kr.int16()
+		if kr.err {
+			return
+		}
+		kr.skip(4)
+		d.produceTopics(kr, r)
+		if acks == 0 {
+			for _, msg := range d.messages(c, r, 0) {
+				s.store.Input(msg)
+			}
+			return
+		}
+	case kafkaFetch:
+		d.fetchTopics(kr, r)
+	}
+	c.call(correlationID, r)
+}
+
+func (r *kafkaRequest) flexible() bool {
+	v, ok := kafkaFlexible[r.api]
+	return ok && r.version >= v
+}
+
+//topic 查找或添加topic
+func (r *kafkaRequest) topic(name string) *kafkaTopic {
+	for _, t := range r.topics {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &kafkaTopic{name: name}
+	r.topics = append(r.topics, t)
+	return t
+}
+
+//topicName v13开始使用topic id代替名称
+func (d *KafkaDecode) topicName(kr *kafkaReader, version int16) string {
+	if version < 13 {
+		return kr.str()
+	}
+	id := kr.uuid()
+	if name, ok := d.topicNames[id]; ok {
+		return name
+	}
+	return hex.EncodeToString(id[:8])
+}
+
+func (d *KafkaDecode) produceTopics(kr *kafkaReader, r *kafkaRequest) {
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		t := r.topic(d.topicName(kr, r.version))
+		for j, m := 0, kr.array(); j < m && !kr.err; j++ {
+			kr.skip(4)
+			size := kr.bytesLength()
+			if size > 0 {
+				t.bytes += uint64(size)
+			}
+			kr.skip(size)
+			kr.tags()
+		}
+		kr.tags()
+	}
+}
+
+func (d *KafkaDecode) fetchTopics(kr *kafkaReader, r *kafkaRequest) {
+	v := r.version
+	fixed := 0
+	if v <= 14 {
+		fixed += 4
+	}
+	fixed += 8
+	if v >= 3 {
+		fixed += 4
+	}
+	if v >= 4 {
+		fixed++
+	}
+	if v >= 7 {
+		fixed += 8
+	}
+	kr.skip(fixed)
+	//每个分区的长度
+	partition := 4 + 8 + 4
+	if v >= 9 {
+		partition += 4
+	}
+	if v >= 12 {
+		partition += 4
+	}
+	if v >= 5 {
+		partition += 8
+	}
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		r.topic(d.topicName(kr, v))
+		for j, m := 0, kr.array(); j < m && !kr.err; j++ {
+			kr.skip(partition)
+			kr.tags()
+		}
+		kr.tags()
+	}
+}
+
+func (d *KafkaDecode) produceResponse(kr *kafkaReader, r *kafkaRequest) {
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		t := r.topic(d.topicName(kr, r.version))
+		for j, m := 0, kr.array(); j < m && !kr.err; j++ {
+			kr.skip(4)
+			if code := kr.int16(); code != 0 && t.code == "" && !kr.err {
+				t.code = kafkaError(code)
+			}
+			kr.skip(8)
+			if r.version >= 2 {
+				kr.skip(8)
+			}
+			if r.version >= 5 {
+				kr.skip(8)
+			}
+			if r.version >= 8 {
+				for k, l := 0, kr.array(); k < l && !kr.err; k++ {
+					kr.skip(4)
+					kr.str()
+					kr.tags()
+				}
+				kr.str()
+			}
+			kr.tags()
+		}
+		kr.tags()
+	}
+}
+
+//fetchResponse 获取各topic的错误码与消息字节数，返回顶层错误码
+func (d *KafkaDecode) fetchResponse(kr *kafkaReader, r *kafkaRequest) string {
+	v := r.version
+	code := ""
+	if v >= 1 {
+		kr.skip(4)
+	}
+	if v >= 7 {
+		if n := kr.int16(); n != 0 && !kr.err {
+			code = kafkaError(n)
+		}
+		kr.skip(4)
+	}
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		t := r.topic(d.topicName(kr, v))
+		for j, m := 0, kr.array(); j < m && !kr.err; j++ {
+			kr.skip(4)
+			if n := kr.int16(); n != 0 && t.code == "" && !kr.err {
+				t.code = kafkaError(n)
+			}
+			kr.skip(8)
+			if v >= 4 {
+				kr.skip(8)
+			}
+			if v >= 5 {
+				kr.skip(8)
+			}
+			if v >= 4 {
+				for k, l := 0, kr.array(); k < l && !kr.err; k++ {
+					kr.skip(16)
+					kr.tags()
+				}
+			}
+			if v >= 11 {
+				kr.skip(4)
+			}
+			//报文被截断时仍然可以得到消息的长度
+			if size := kr.bytesLength(); size > 0 {
+				t.bytes += uint64(size)
+				kr.skip(size)
+			}
+			kr.tags()
+		}
+		kr.tags()
+	}
+	return code
+}
+
+//metadataResponse 记录topic id与名称的对应关系
+func (d *KafkaDecode) metadataResponse(kr *kafkaReader, r *kafkaRequest) {
+	v := r.version
+	if v < 10 {
+		return
+	}
+	kr.skip(4)
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		kr.skip(4)
+		kr.str()
+		kr.skip(4)
+		kr.str()
+		kr.tags()
+	}
+	kr.str()
+	kr.skip(4)
+	for i, n := 0, kr.array(); i < n && !kr.err; i++ {
+		kr.skip(2)
+		name := kr.str()
+		id := kr.uuid()
+		if !kr.err && name != "" && len(d.topicNames) < maxKafkaTopicIDs {
+			d.topicNames[id] = name
+		}
+		kr.skip(1)
+		for j, m := 0, kr.array(); j < m && !kr.err; j++ {
+			kr.skip(2 + 4 + 4 + 4)
+			for k := 0; k < 3; k++ {
+				kr.skip(4 * kr.array())
+			}
+			kr.tags()
+		}
+		kr.skip(4)
+		kr.tags()
+	}
+}
+
+//messages Produce与Fetch请求每个topic生成一条监控数据，报文长度与client id的字节数只计入第一条
+func (d *KafkaDecode) messages(c *streamConn, r *kafkaRequest, responseLength int) []*metric.ProtocolMessage {
+	command, ok := kafkaAPIs[r.api]
+	if !ok {
+		command = "api" + strconv.Itoa(int(r.api))
+	}
+	base := metric.ProtocolMessage{
+		Command:        command,
+		RemoteAddr:     c.client,
+		RequestLength:  uint64(r.length),
+		ResponseLength: uint64(responseLength),
+	}
+	if r.clientID != "" {
+		client := metric.StatsdName(d.clients.fold(r.clientID))
+		switch r.api {
+		case kafkaProduce:
+			base.Counters = map[string]uint64{"produce.bytes": uint64(r.length), "client." + client + ".produce.bytes": uint64(r.length)}
+		case kafkaFetch:
+			if responseLength > 0 {
+				base.Counters = map[string]uint64{"fetch.bytes": uint64(responseLength), "client." + client + ".fetch.bytes": uint64(responseLength)}
+			}
+		}
+	}
+	if len(r.topics) == 0 {
+		return []*metric.ProtocolMessage{&base}
+	}
+	msgs := make([]*metric.ProtocolMessage, 0, len(r.topics))
+	for i, t := range r.topics {
+		msg := base
+		if i > 0 {
+			//其他topic只按topic统计，请求只计数一次
+			msg.Counters, msg.RequestLength, msg.ResponseLength = nil, 0, 0
+			msg.Batched = true
+		}
+		msg.Resource = d.topics.fold(t.name)
+		msg.Code = t.code
+		//排行中的字节数为该topic的消息字节数
+		if r.api == kafkaProduce {
+			msg.RequestLength = t.bytes
+		} else {
+			msg.ResponseLength = t.bytes
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs
+}
+
+//kafkaError 错误码名称
+func kafkaError(code int16) string {
+	if code == 0 {
+		return ""
+	}
+	if name, ok := kafkaErrors[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+//kafkaReader 按Kafka协议的类型读取，flexible版本使用compact类型，数据不足时err为true
+type kafkaReader struct {
+	p        []byte
+	flexible bool
+	err      bool
+}
+
+func (k *kafkaReader) take(n int) []byte {
+	if k.err || n < 0 || n > len(k.p) {
+		k.err = true
+		return nil
+	}
+	b := k.p[:n]
+	k.p = k.p[n:]
+	return b
+}
+
+func (k *kafkaReader) skip(n int) {
+	k.take(n)
+}
+
+func (k *kafkaReader) int16() int16 {
+	if b := k.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (k *kafkaReader) int32() int32 {
+	if b := k.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (k *kafkaReader) uvarint() int {
+	if k.err {
+		return 0
+	}
+	v, n := binary.Uvarint(k.p)
+	if n <= 0 || v > maxKafkaMessage {
+		k.err = true
+		return 0
+	}
+	k.p = k.p[n:]
+	return int(v)
+}
+
+func (k *kafkaReader) uuid() (id [16]byte) {
+	copy(id[:], k.take(16))
+	return
+}
+
+//length 字符串、数组与字节的长度，compact类型为长度加1，null为-1
+func (k *kafkaReader) length(wide bool) int {
+	if k.flexible {
+		return k.uvarint() - 1
+	}
+	if wide {
+		return int(k.int32())
+	}
+	return int(k.int16())
+}
+
+func (k *kafkaReader) str() string {
+	if n := k.length(false); n > 0 {
+		return string(k.take(n))
+	}
+	return ""
+}
+
+func (k *kafkaReader) array() int {
+	n := k.length(true)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+//bytesLength 字节类型的长度，不读取内容
+func (k *kafkaReader) bytesLength() int {
+	return k.length(true)
+}
+
+//tags 跳过flexible版本中的tagged fields
+func (k *kafkaReader) tags() {
+	if !k.flexible {
+		return
+	}
+	for i, n := 0, k.uvarint(); i < n && !k.err; i++ {
+		k.uvarint()
+		k.skip(k.uvarint())
+	}
+}
@@ -0,0 +1,132 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//kafkaWriter 按Kafka协议的非compact类型生成报文
+type kafkaWriter struct {
+	p []byte
+}
+
+func (w *kafkaWriter) i8(v int8) *kafkaWriter { w.p = append(w.p, byte(v)); return w }
+
+func (w *kafkaWriter) i16(v int16) *kafkaWriter {
+	w.p = append(w.p, byte(uint16(v)>>8), byte(v))
+	return w
+}
+
+func (w *kafkaWriter) i32(v int32) *kafkaWriter {
+	w.p = append(w.p, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.p[len(w.p)-4:], uint32(v))
+	return w
+}
+
+func (w *kafkaWriter) i64(v int64) *kafkaWriter { return w.i32(int32(v >> 32)).i32(int32(v)) }
+
+func (w *kafkaWriter) str(s string) *kafkaWriter {
+	w.i16(int16(len(s)))
+	w.p = append(w.p, s...)
+	return w
+}
+
+func (w *kafkaWriter) bytes(b string) *kafkaWriter {
+	w.i32(int32(len(b)))
+	w.p = append(w.p, b...)
+	return w
+}
+
+//frame 加上长度前缀
+func (w *kafkaWriter) frame() []byte {
+	return append((&kafkaWriter{}).i32(int32(len(w.p))).p, w.p...)
+}
+
+//kafkaRequestHeader 请求头部，flexible版本的头部之后有tagged fields
+func kafkaRequestHeader(api, version int16, correlationID int32, clientID string) *kafkaWriter {
+	return (&kafkaWriter{}).i16(api).i16(version).i32(correlationID).str(clientID)
+}
+
+func TestKafkaDecode(t *testing.T) {
+	produce := func(correlationID int32, acks int16) streamSegment {
+		w := kafkaRequestHeader(kafkaProduce, 3, correlationID, "billing")
+		w.i16(-1).i16(acks).i32(30000).i32(2)
+		w.str("orders").i32(1).i32(0).bytes("0123456789")
+		w.str("payments").i32(1).i32(2).bytes("abcd")
+		return streamSegment{true, w.frame()}
+	}
+	produceResponse := (&kafkaWriter{}).i32(1).i32(2).
+		str("orders").i32(1).i32(0).i16(0).i64(100).i64(-1).
+		str("payments").i32(1).i32(2).i16(6).i64(-1).i64(-1).
+		i32(0).frame()
+	fetch := kafkaRequestHeader(kafkaFetch, 4, 2, "reporting").
+		i32(-1).i32(500).i32(1).i32(1 << 20).i8(0).
+		i32(1).str("orders").i32(1).i32(0).i64(100).i32(1 << 20).frame()
+	fetchResponse := (&kafkaWriter{}).i32(2).i32(0).
+		i32(1).str("orders").i32(1).i32(0).i16(0).i64(120).i64(120).i32(0).bytes("0123456789abcdefghij").frame()
+	//Heartbeat v4为flexible版本，头部与响应中有tagged fields
+	heartbeat := kafkaRequestHeader(12, 4, 3, "billing").i8(0)
+	heartbeat.p = append(heartbeat.p, 6, 'g', 'r', 'o', 'u', 'p', 0, 0, 0, 1, 2, 'm', 0, 0)
+	heartbeatResponse := (&kafkaWriter{}).i32(3).i8(0).i32(0).i16(27).i8(0).frame()
+	runStreamTests(t, func() streamParser {
+		return &KafkaDecode{topics: newLabelFolder(maxKafkaTopics), clients: newLabelFolder(maxKafkaClients), topicNames: make(map[[16]byte]string)}
+	}, []streamTest{
+		{
+			name:     "produce to two topics",
+			segments: []streamSegment{produce(1, 1), {false, produceResponse}},
+			want: []metric.ProtocolMessage{
+				{Command: "Produce", Resource: "orders", RequestLength: 10, Counters: map[string]uint64{"client.billing.produce.bytes": uint64(len(produce(1, 1).data))}},
+				{Command: "Produce", Resource: "payments", Code: "NOT_LEADER_OR_FOLLOWER", RequestLength: 4, Batched: true},
+			},
+		},
+		{
+			name:     "produce without acks",
+			segments: []streamSegment{produce(1, 0)},
+			want: []metric.ProtocolMessage{
+				{Command: "Produce", Resource: "orders", RequestLength: 10},
+				{Command: "Produce", Resource: "payments", RequestLength: 4, Batched: true},
+			},
+		},
+		{
+			name:     "fetch",
+			segments: []streamSegment{{true, fetch}, {false, fetchResponse}},
+			want: []metric.ProtocolMessage{
+				{Command: "Fetch", Resource: "orders", ResponseLength: 20, Counters: map[string]uint64{"client.reporting.fetch.bytes": uint64(len(fetchResponse))}},
+			},
+		},
+		{
+			name:     "flexible heartbeat error",
+			segments: []streamSegment{{true, heartbeat.frame()}, {false, heartbeatResponse}},
+			want:     []metric.ProtocolMessage{{Command: "Heartbeat", Code: "REBALANCE_IN_PROGRESS"}},
+		},
+		{
+			name:     "metadata timeout",
+			segments: []streamSegment{{true, kafkaRequestHeader(kafkaMetadata, 1, 4, "").i32(0).frame()}},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "Metadata", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "not kafka",
+			segments: []streamSegment{{true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")}},
+		},
+	})
+}
@@ -0,0 +1,73 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import "time"
+
+//otherLabel 超出数量限制的集合、topic等协议标签归入该值
+const otherLabel = "other"
+
+//labelFolder 限制统计标签的数量，超出后归入overflow
+type labelFolder struct {
+	max      int
+	overflow string
+	//idle 大于0时，名额用尽后超过该时长未出现的标签让出名额
+	idle     time.Duration
+	swept    time.Time
+	admitted map[string]time.Time
+}
+
+func newLabelFolder(max int) *labelFolder {
+	return &labelFolder{max: max, overflow: otherLabel, admitted: make(map[string]time.Time)}
+}
+
+func (f *labelFolder) fold(label string) string {
+	if label == "" {
+		return label
+	}
+	var now time.Time
+	if f.idle > 0 {
+		now = time.Now()
+	}
+	if _, ok := f.admitted[label]; ok {
+		f.admitted[label] = now
+		return label
+	}
+	if len(f.admitted) >= f.max {
+		f.evict(now)
+	}
+	if len(f.admitted) >= f.max {
+		return f.overflow
+	}
+	f.admitted[label] = now
+	return label
+}
+
+//evict 删除空闲的标签，每秒最多检查一次
+func (f *labelFolder) evict(now time.Time) {
+	if f.idle <= 0 || now.Sub(f.swept) < time.Second {
+		return
+	}
+	f.swept = now
+	for label, seen := range f.admitted {
+		if now.Sub(seen) > f.idle {
+			delete(f.admitted, label)
+		}
+	}
+}
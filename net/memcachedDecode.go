@@ -0,0 +1,374 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	//maxMemcachedLine 文本协议命令行与响应行的最大长度
+	maxMemcachedLine = 2048
+	//maxMemcachedKey memcached允许的最大key长度
+	maxMemcachedKey = 250
+	mcRequestMagic  = 0x80
+	mcResponseMagic = 0x81
+)
+
+//mcBinaryCommands 二进制协议的操作码，quiet操作与普通操作统计为同一命令
+var mcBinaryCommands = map[byte]string{
+	0x00: "get", 0x01: "set", 0x02: "add", 0x03: "replace", 0x04: "delete",
+	0x05: "incr", 0x06: "decr", 0x07: "quit", 0x08: "flush_all", 0x09: "get",
+	0x0a: "noop", 0x0b: "version", 0x0c: "get", 0x0d: "get", 0x0e: "append",
+	0x0f: "prepend", 0x10: "stats", 0x11: "set", 0x12: "add", 0x13: "replace",
+	0x14: "delete", 0x15: "incr", 0x16: "decr", 0x17: "quit", 0x18: "flush_all",
+	0x19: "append", 0x1a: "prepend", 0x1c: "touch", 0x1d: "gat", 0x1e: "gat",
+	0x1f: "gat", 0x20: "sasl_list_mechs", 0x21: "sasl_auth", 0x22: "sasl_step",
+}
+
+//mcQuietCommands 成功(get为未命中)时没有响应的二进制操作
+var mcQuietCommands = map[byte]bool{
+	0x09: true, 0x0d: true, 0x11: true, 0x12: true, 0x13: true, 0x14: true, 0x15: true,
+	0x16: true, 0x17: true, 0x18: true, 0x19: true, 0x1a: true, 0x1e: true,
+}
+
+//mcBinaryStatus 二进制协议中作为异常统计的状态，未命中、key已存在与未保存是正常结果
+var mcBinaryStatus = map[uint16]string{
+	0x03: "VALUE_TOO_LARGE", 0x04: "INVALID_ARGUMENTS", 0x06: "NON_NUMERIC",
+	0x20: "AUTH_ERROR", 0x81: "UNKNOWN_COMMAND", 0x82: "OUT_OF_MEMORY",
+	0x83: "NOT_SUPPORTED", 0x84: "INTERNAL_ERROR", 0x85: "BUSY", 0x86: "TEMPORARY_FAILURE",
+}
+
+//mcRequest 等待响应的请求
+type mcRequest struct {
+	command string
+	keys    []string
+	hits    int
+	//写入或读取的value字节数
+	written uint64
+	read    uint64
+	values  []metric.TopEntry
+	//请求长度与已经收到的响应长度
+	length   int
+	response int
+	//二进制协议的quiet操作与请求顺序
+	quiet bool
+	seq   uint64
+}
+
+//mcConn 连接的协议与请求顺序
+type mcConn struct {
+	binary bool
+	seq    uint64
+}
+
+//MemcachedDecode memcached文本协议与二进制协议解码
+type MemcachedDecode struct {
+	*tcpStream
+}
+
+//CreateMemcachedDecode CreateMemcachedDecode
+func CreateMemcachedDecode(option *config.Option, port config.Port) *MemcachedDecode {
+	d := &MemcachedDecode{}
+	d.tcpStream = newTCPStream("memcached", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *MemcachedDecode) conn(c *streamConn, buf []byte) *mcConn {
+	if c.state == nil {
+		c.state = &mcConn{binary: buf[0] == mcRequestMagic || buf[0] == mcResponseMagic}
+	}
+	return c.state.(*mcConn)
+}
+
+func (d *MemcachedDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if d.conn(c, buf).binary {
+		if len(buf) < 24 {
+			return 0, 0
+		}
+		if buf[0] != mcRequestMagic && buf[0] != mcResponseMagic {
+			return -1, 0
+		}
+		total = 24 + int(binary.BigEndian.Uint32(buf[8:]))
+		//只需要extras与key，value只统计长度
+		need = 24 + int(buf[4]) + int(binary.BigEndian.Uint16(buf[2:]))
+		if need > total {
+			return -1, 0
+		}
+		return total, need
+	}
+	i := bytes.Index(buf, []byte("\r\n"))
+	if i < 0 {
+		if len(buf) > maxMemcachedLine {
+			return -1, 0
+		}
+		return 0, 0
+	}
+	total = i + 2
+	//带有数据块的命令与响应，数据块不需要缓存
+	if n := mcDataLength(request, buf[:i]); n >= 0 {
+		return total + n + 2, total
+	}
+	return total, total
+}
+
+//mcDataLength 文本协议命令行或响应行之后数据块的长度，没有数据块时返回-1
+func mcDataLength(request bool, line []byte) int {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return -1
+	}
+	index := -1
+	switch string(fields[0]) {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if request {
+			index = 4
+		}
+	case "ms":
+		if request {
+			index = 2
+		}
+	case "VALUE":
+		if !request {
+			index = 3
+		}
+	case "VA":
+		if !request {
+			index = 1
+		}
+	}
+	if index < 0 || index >= len(fields) {
+		return -1
+	}
+	n, err := strconv.Atoi(string(fields[index]))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+func (d *MemcachedDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	mc := c.state.(*mcConn)
+	if mc.binary {
+		d.handleBinary(s, c, mc, request, frame, total)
+		return
+	}
+	i := bytes.Index(frame, []byte("\r\n"))
+	if i < 0 {
+		return
+	}
+	fields := bytes.Fields(frame[:i])
+	if len(fields) == 0 {
+		return
+	}
+	if request {
+		d.asciiRequest(s, c, fields, total)
+		return
+	}
+	if len(c.queue) == 0 {
+		return
+	}
+	r := c.queue[0].value.(*mcRequest)
+	switch word := string(fields[0]); word {
+	case "VALUE", "VA":
+		//命中，get等待END，mg只有一个响应
+		r.hits++
+		r.response += total
+		size := uint64(total - i - 4)
+		r.read += size
+		if word == "VALUE" && len(fields) > 1 {
+			r.value(mcKey(fields[1]), size)
+		} else if len(r.keys) > 0 {
+			r.value(r.keys[0], size)
+		}
+		if word == "VA" {
+			d.finish(s, c, c.pop(), "", 0)
+		}
+	case "STAT":
+	case "ERROR", "CLIENT_ERROR", "SERVER_ERROR":
+		d.finish(s, c, c.pop(), word, total)
+	default:
+		if word == "HD" && r.command == "mg" {
+			r.hits++
+		}
+		d.finish(s, c, c.pop(), "", total)
+	}
+}
+
+//asciiRequest 文本协议的命令，noreply的命令没有响应
+func (d *MemcachedDecode) asciiRequest(s *tcpStream, c *streamConn, fields [][]byte, total int) {
+	r := &mcRequest{command: string(fields[0]), length: total}
+	noreply := string(fields[len(fields)-1]) == "noreply"
+	switch r.command {
+	case "get", "gets":
+		for _, k := range fields[1:] {
+			r.keys = append(r.keys, mcKey(k))
+		}
+	case "gat", "gats":
+		//第一个参数为过期时间
+		if len(fields) > 2 {
+			for _, k := range fields[2:] {
+				r.keys = append(r.keys, mcKey(k))
+			}
+		}
+	case "set", "add", "replace", "append", "prepend", "cas", "ms":
+		if len(fields) > 1 {
+			r.keys = []string{mcKey(fields[1])}
+		}
+		if n := mcDataLength(true, bytes.Join(fields, []byte(" "))); n > 0 && len(r.keys) > 0 {
+			r.written = uint64(n)
+			r.value(r.keys[0], r.written)
+		}
+	case "mg", "delete", "incr", "decr", "touch", "md", "ma":
+		if len(fields) > 1 {
+			r.keys = []string{mcKey(fields[1])}
+		}
+	case "quit":
+		noreply = true
+	}
+	if noreply {
+		s.store.Input(d.message(c, r))
+		return
+	}
+	c.push(r)
+}
+
+//handleBinary 二进制协议按opaque匹配请求与响应
+func (d *MemcachedDecode) handleBinary(s *tcpStream, c *streamConn, mc *mcConn, request bool, frame []byte, total int) {
+	opcode := frame[1]
+	keyLength := int(binary.BigEndian.Uint16(frame[2:]))
+	extLength := int(frame[4])
+	status := binary.BigEndian.Uint16(frame[6:])
+	opaque := uint64(binary.BigEndian.Uint32(frame[12:]))
+	key := ""
+	if keyLength > 0 {
+		key = mcKey(frame[24+extLength : 24+extLength+keyLength])
+	}
+	value := uint64(total - 24 - extLength - keyLength)
+	if request {
+		command, ok := mcBinaryCommands[opcode]
+		if !ok {
+			command = "unknown"
+		}
+		mc.seq++
+		r := &mcRequest{command: command, length: total, quiet: mcQuietCommands[opcode], seq: mc.seq}
+		if key != "" {
+			r.keys = []string{key}
+		}
+		switch command {
+		case "set", "add", "replace", "append", "prepend":
+			r.written = value
+			r.value(key, value)
+		}
+		c.call(opaque, r)
+		return
+	}
+	call := c.reply(opaque)
+	if call == nil {
+		return
+	}
+	r := call.value.(*mcRequest)
+	if status == 0 && (r.command == "get" || r.command == "gat") {
+		r.hits++
+		r.read = value
+		if len(r.keys) > 0 {
+			r.value(r.keys[0], value)
+		}
+	}
+	d.finish(s, c, call, mcBinaryStatus[status], total)
+	if r.quiet {
+		return
+	}
+	//服务端按顺序处理，之前没有响应的quiet请求已经成功(get为未命中)
+	for id, q := range c.pending {
+		if qr := q.value.(*mcRequest); qr.quiet && qr.seq < r.seq {
+			delete(c.pending, id)
+			d.finish(s, c, q, "", 0)
+		}
+	}
+}
+
+//value 记录读取或写入的value大小，用于大value排行
+func (r *mcRequest) value(key string, size uint64) {
+	if key != "" {
+		r.values = append(r.values, metric.TopEntry{List: "largevalues", Key: key, Bytes: size, ByBytes: true})
+	}
+}
+
+//finish 统计得到响应的请求，get未命中的数量为key数量减去命中数量
+func (d *MemcachedDecode) finish(s *tcpStream, c *streamConn, call *streamCall, code string, length int) {
+	if call == nil {
+		return
+	}
+	r := call.value.(*mcRequest)
+	msg := d.message(c, r)
+	msg.Code = code
+	msg.ResponseLength = uint64(r.response + length)
+	msg.ReqTime = c.elapsed(call)
+	switch r.command {
+	case "get", "gets", "gat", "gats", "mg":
+		if code == "" && len(r.keys) >= r.hits {
+			msg.Counters["get.hits"] = uint64(r.hits)
+			msg.Counters["get.misses"] = uint64(len(r.keys) - r.hits)
+		}
+	}
+	s.store.Input(msg)
+}
+
+func (d *MemcachedDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := d.message(c, call.value.(*mcRequest))
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//message 请求的key计入热点key排行
+func (d *MemcachedDecode) message(c *streamConn, r *mcRequest) *metric.ProtocolMessage {
+	msg := &metric.ProtocolMessage{
+		Command:       r.command,
+		RemoteAddr:    c.client,
+		RequestLength: uint64(r.length),
+		Counters:      make(map[string]uint64),
+		Tops:          r.values,
+	}
+	for _, k := range r.keys {
+		msg.Tops = append(msg.Tops, metric.TopEntry{List: "hotkeys", Key: k})
+	}
+	if r.read > 0 {
+		msg.Counters["value.bytes.read"] = r.read
+	}
+	if r.written > 0 {
+		msg.Counters["value.bytes.written"] = r.written
+	}
+	return msg
+}
+
+//mcKey 限制key的长度
+func mcKey(k []byte) string {
+	if len(k) > maxMemcachedKey {
+		k = k[:maxMemcachedKey]
+	}
+	return string(k)
+}
@@ -0,0 +1,128 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//mcPacket 生成二进制协议的报文，request时status为vbucket
+func mcPacket(request bool, opcode byte, status uint16, opaque uint32, extras, key, value string) []byte {
+	p := make([]byte, 24)
+	p[0], p[1], p[4] = mcResponseMagic, opcode, byte(len(extras))
+	if request {
+		p[0] = mcRequestMagic
+	}
+	binary.BigEndian.PutUint16(p[2:], uint16(len(key)))
+	binary.BigEndian.PutUint16(p[6:], status)
+	binary.BigEndian.PutUint32(p[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(p[12:], opaque)
+	return append(p, extras+key+value...)
+}
+
+func TestMemcachedDecode(t *testing.T) {
+	req := func(s string) streamSegment { return streamSegment{true, []byte(s)} }
+	res := func(s string) streamSegment { return streamSegment{false, []byte(s)} }
+	binReq := func(opcode byte, opaque uint32, key, value string) streamSegment {
+		extras := ""
+		if value != "" {
+			extras = "\x00\x00\x00\x00\x00\x00\x00\x00"
+		}
+		return streamSegment{true, mcPacket(true, opcode, 0, opaque, extras, key, value)}
+	}
+	binRes := func(opcode byte, status uint16, opaque uint32, value string) streamSegment {
+		extras := ""
+		if value != "" {
+			extras = "\x00\x00\x00\x00"
+		}
+		return streamSegment{false, mcPacket(false, opcode, status, opaque, extras, "", value)}
+	}
+	runStreamTests(t, func() streamParser { return &MemcachedDecode{} }, []streamTest{
+		{
+			name:     "multi get",
+			segments: []streamSegment{req("get a b c\r\n"), res("VALUE a 0 3\r\nabc\r\nVALUE c 0 1\r\nx\r\nEND\r\n")},
+			want: []metric.ProtocolMessage{{Command: "get", RequestLength: 11, ResponseLength: 39,
+				Counters: map[string]uint64{"get.hits": 2, "get.misses": 1, "value.bytes.read": 4}}},
+		},
+		{
+			name:     "set",
+			segments: []streamSegment{req("set k 0 0 5\r\nhello\r\n"), res("STORED\r\n"), req("set k 0 0 1\r\nx\r\n"), res("SERVER_ERROR out of memory\r\n")},
+			want: []metric.ProtocolMessage{
+				{Command: "set", RequestLength: 20, Counters: map[string]uint64{"value.bytes.written": 5}},
+				{Command: "set", Code: "SERVER_ERROR"},
+			},
+		},
+		{
+			name:     "noreply",
+			segments: []streamSegment{req("set k 0 0 1 noreply\r\nx\r\ndelete k noreply\r\nget k\r\n"), res("END\r\n"), req("quit\r\n")},
+			want: []metric.ProtocolMessage{
+				{Command: "set", Counters: map[string]uint64{"value.bytes.written": 1}},
+				{Command: "delete"},
+				{Command: "get", Counters: map[string]uint64{"get.hits": 0, "get.misses": 1}},
+				{Command: "quit"},
+			},
+		},
+		{
+			name:     "meta commands",
+			segments: []streamSegment{req("mg foo v\r\nmg bar v\r\nms baz 2\r\nhi\r\n"), res("VA 3\r\nabc\r\nEN\r\nHD\r\n")},
+			want: []metric.ProtocolMessage{
+				{Command: "mg", Counters: map[string]uint64{"get.hits": 1, "get.misses": 0, "value.bytes.read": 3}},
+				{Command: "mg", Counters: map[string]uint64{"get.hits": 0, "get.misses": 1}},
+				{Command: "ms", Counters: map[string]uint64{"value.bytes.written": 2}},
+			},
+		},
+		{
+			name:     "text timeout",
+			segments: []streamSegment{req("incr n 1\r\n")},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "incr", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "binary get",
+			segments: []streamSegment{binReq(0x00, 1, "k", ""), binRes(0x00, 0, 1, "abc"), binReq(0x00, 2, "m", ""), binRes(0x00, 1, 2, "")},
+			want: []metric.ProtocolMessage{
+				{Command: "get", Counters: map[string]uint64{"get.hits": 1, "get.misses": 0, "value.bytes.read": 3}},
+				{Command: "get", Counters: map[string]uint64{"get.hits": 0, "get.misses": 1}},
+			},
+		},
+		{
+			name: "binary quiet",
+			//getq未命中与setq成功没有响应，在noop的响应到达时统计
+			segments: []streamSegment{binReq(0x09, 1, "a", ""), binReq(0x09, 2, "b", ""), binReq(0x0a, 3, "", ""), binRes(0x09, 0, 2, "xy"), binRes(0x0a, 0, 3, "")},
+			want: []metric.ProtocolMessage{
+				{Command: "get", Counters: map[string]uint64{"get.hits": 1, "get.misses": 0}},
+				{Command: "noop"},
+				{Command: "get", Counters: map[string]uint64{"get.hits": 0, "get.misses": 1}},
+			},
+		},
+		{
+			name:     "binary quiet error",
+			segments: []streamSegment{binReq(0x11, 5, "k", "value"), binRes(0x11, 0x82, 5, "")},
+			want:     []metric.ProtocolMessage{{Command: "set", Code: "OUT_OF_MEMORY", Counters: map[string]uint64{"value.bytes.written": 5}}},
+		},
+		{
+			name:     "binary aborted",
+			segments: []streamSegment{binReq(0x00, 9, "k", "")},
+			close:    true,
+			want:     []metric.ProtocolMessage{{Command: "get", Result: metric.ResultAborted}},
+		},
+	})
+}
@@ -0,0 +1,435 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+)
+
+//MongoDB操作码
+const (
+	mongoOpReply      = 1
+	mongoOpQuery      = 2004
+	mongoOpCompressed = 2012
+	mongoOpMsg        = 2013
+)
+
+const (
+	//maxMongoMessage MongoDB允许的最大消息长度
+	maxMongoMessage = 48 << 20
+	//maxMongoCollections 统计的最大集合数量，超出后归入other
+	maxMongoCollections = 500
+	//maxMongoShapes 排行中查询条件的最大数量，超出后归入other
+	maxMongoShapes = 1000
+	//OP_MSG标志位
+	mongoChecksumPresent = 1
+	mongoMoreToCome      = 2
+	//OP_REPLY标志位
+	mongoQueryFailure = 2
+)
+
+//mongoCommand 等待响应的命令
+type mongoCommand struct {
+	command    string
+	db         string
+	collection string
+	shape      string
+	//OP_QUERY发送的命令，响应的第一个文档为命令结果
+	legacyCommand bool
+	length        int
+}
+
+//MongoDecode MongoDB协议解码，支持OP_MSG与早期的OP_QUERY/OP_REPLY
+type MongoDecode struct {
+	*tcpStream
+	collections *labelFolder
+	shapes      *labelFolder
+}
+
+//CreateMongoDecode CreateMongoDecode
+func CreateMongoDecode(option *config.Option, port config.Port) *MongoDecode {
+	d := &MongoDecode{
+		collections: newLabelFolder(maxMongoCollections),
+		shapes:      newLabelFolder(maxMongoShapes),
+	}
+	d.tcpStream = newTCPStream("mongodb", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *MongoDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 16 {
+		return 0, 0
+	}
+	total = int(int32(binary.LittleEndian.Uint32(buf)))
+	op := binary.LittleEndian.Uint32(buf[12:])
+	if total < 16 || total > maxMongoMessage || !mongoOpCode(op) {
+		return -1, 0
+	}
+	return total, total
+}
+
+//mongoOpCode 是否为已知的操作码，包括已经废弃的操作
+func mongoOpCode(op uint32) bool {
+	switch {
+	case op == mongoOpReply, op >= 2001 && op <= 2007, op >= 2010 && op <= 2013:
+		return true
+	}
+	return false
+}
+
+func (d *MongoDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	requestID := binary.LittleEndian.Uint32(frame[4:])
+	responseTo := binary.LittleEndian.Uint32(frame[8:])
+	op := binary.LittleEndian.Uint32(frame[12:])
+	body := frame[16:]
+	complete := len(frame) == total
+	if op == mongoOpCompressed {
+		op, body, complete = mongoDecompress(body, complete)
+	}
+	if request {
+		cmd, moreToCome := d.readRequest(op, body, complete)
+		if cmd == nil {
+			return
+		}
+		cmd.length = total
+		//moreToCome的消息没有响应，如w:0的写操作
+		if moreToCome {
+			s.store.Input(d.message(c, cmd))
+			return
+		}
+		c.call(uint64(requestID), cmd)
+		return
+	}
+	call := c.reply(uint64(responseTo))
+	if call == nil {
+		return
+	}
+	cmd := call.value.(*mongoCommand)
+	msg := d.message(c, cmd)
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	switch op {
+	case mongoOpMsg:
+		if doc, _ := mongoSections(body, complete); doc != nil {
+			mongoReplyDoc(doc, msg)
+		}
+	case mongoOpReply:
+		mongoLegacyReply(cmd, body, msg)
+	}
+	s.store.Input(msg)
+}
+
+func (d *MongoDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := d.message(c, call.value.(*mongoCommand))
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//message 排行的key为 命令 数据库.集合 查询条件
+func (d *MongoDecode) message(c *streamConn, cmd *mongoCommand) *metric.ProtocolMessage {
+	ns := cmd.db
+	msg := &metric.ProtocolMessage{
+		Command:       cmd.command,
+		RemoteAddr:    c.client,
+		RequestLength: uint64(cmd.length),
+	}
+	if cmd.collection != "" {
+		ns = d.collections.fold(cmd.db + "." + cmd.collection)
+		msg.Resource = ns
+	}
+	msg.Key = cmd.command
+	if ns != "" {
+		msg.Key += " " + ns
+	}
+	if cmd.shape != "" {
+		msg.Key += " " + d.shapes.fold(cmd.shape)
+	}
+	return msg
+}
+
+//readRequest 读取请求中的命令，返回是否需要响应
+func (d *MongoDecode) readRequest(op uint32, body []byte, complete bool) (*mongoCommand, bool) {
+	switch op {
+	case mongoOpMsg:
+		doc, seq := mongoSections(body, complete)
+		if doc == nil {
+			return nil, false
+		}
+		cmd := mongoReadCommand(doc, seq)
+		if e, ok := doc.lookup("$db"); ok {
+			cmd.db = e.str()
+		}
+		return cmd, binary.LittleEndian.Uint32(body)&mongoMoreToCome != 0
+	case mongoOpQuery:
+		return mongoLegacyQuery(body), false
+	case 0:
+		//不支持的压缩算法，只统计数量与响应时间
+		return &mongoCommand{command: "compressed"}, false
+	}
+	return nil, false
+}
+
+//mongoSections 读取OP_MSG的命令文档与文档序列，文档序列只保留第一个文档
+func mongoSections(body []byte, complete bool) (bsonDoc, map[string]bsonDoc) {
+	if len(body) < 5 {
+		return nil, nil
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	p := body[4:]
+	if flags&mongoChecksumPresent != 0 && complete && len(p) >= 4 {
+		p = p[:len(p)-4]
+	}
+	var doc bsonDoc
+	var seq map[string]bsonDoc
+	for len(p) > 0 {
+		switch p[0] {
+		case 0:
+			d, n := readBSON(p[1:])
+			if d == nil {
+				return doc, seq
+			}
+			doc = d
+			if 1+n > len(p) {
+				return doc, seq
+			}
+			p = p[1+n:]
+		case 1:
+			if len(p) < 5 {
+				return doc, seq
+			}
+			size := int(int32(binary.LittleEndian.Uint32(p[1:])))
+			s := p[5:]
+			if size > 4 && size-4 < len(s) {
+				s = s[:size-4]
+			}
+			i := bytes.IndexByte(s, 0)
+			if i < 0 {
+				return doc, seq
+			}
+			if first, _ := readBSON(s[i+1:]); first != nil {
+				if seq == nil {
+					seq = make(map[string]bsonDoc)
+				}
+				seq[string(s[:i])] = first
+			}
+			if size < 5 || 1+size > len(p) {
+				return doc, seq
+			}
+			p = p[1+size:]
+		default:
+			return doc, seq
+		}
+	}
+	return doc, seq
+}
+
+//mongoReadCommand 从命令文档获取命令名称、集合与查询条件
+func mongoReadCommand(doc bsonDoc, seq map[string]bsonDoc) *mongoCommand {
+	first, ok := doc.first()
+	if !ok {
+		return &mongoCommand{command: "unknown"}
+	}
+	cmd := &mongoCommand{command: string(first.name), collection: first.str()}
+	var filter bsonDoc
+	switch cmd.command {
+	case "getMore":
+		if e, ok := doc.lookup("collection"); ok {
+			cmd.collection = e.str()
+		}
+	case "find":
+		filter = mongoField(doc, "filter")
+	case "count", "distinct", "findAndModify", "findandmodify":
+		filter = mongoField(doc, "query")
+	case "update", "delete":
+		//过滤条件为第一个操作的q，操作可能在命令文档中或在文档序列中
+		op := seq[cmd.command+"s"]
+		if op == nil {
+			op = mongoField(mongoField(doc, cmd.command+"s"), "0")
+		}
+		filter = mongoField(op, "q")
+	case "aggregate":
+		if stage := mongoField(mongoField(doc, "pipeline"), "0"); stage != nil {
+			filter = mongoField(stage, "$match")
+		}
+	}
+	if filter != nil {
+		cmd.shape = bsonShape(filter)
+	}
+	return cmd
+}
+
+//mongoField 文档或数组类型的字段
+func mongoField(doc bsonDoc, name string) bsonDoc {
+	if doc == nil {
+		return nil
+	}
+	e, ok := doc.lookup(name)
+	if !ok {
+		return nil
+	}
+	return e.doc()
+}
+
+//mongoLegacyQuery 读取OP_QUERY，集合为$cmd时为命令，否则为查询
+func mongoLegacyQuery(body []byte) *mongoCommand {
+	if len(body) < 4 {
+		return nil
+	}
+	p := body[4:]
+	i := bytes.IndexByte(p, 0)
+	if i < 0 || len(p) < i+9 {
+		return nil
+	}
+	name := string(p[:i])
+	doc, _ := readBSON(p[i+9:])
+	db, coll := name, ""
+	if j := strings.Index(name, "."); j > -1 {
+		db, coll = name[:j], name[j+1:]
+	}
+	//带有读偏好、排序等选项时命令或查询条件在$query中，查询条件也可能在query中
+	wraps := []string{"$query"}
+	if coll != "$cmd" {
+		wraps = append(wraps, "query")
+	}
+	query := doc
+	for _, wrap := range wraps {
+		if inner := mongoField(doc, wrap); inner != nil {
+			query = inner
+			break
+		}
+	}
+	if coll == "$cmd" {
+		cmd := mongoReadCommand(query, nil)
+		cmd.db, cmd.legacyCommand = db, true
+		return cmd
+	}
+	cmd := &mongoCommand{command: "find", db: db, collection: coll}
+	if query != nil {
+		cmd.shape = bsonShape(query)
+	}
+	return cmd
+}
+
+//mongoLegacyReply 读取OP_REPLY
+func mongoLegacyReply(cmd *mongoCommand, body []byte, msg *metric.ProtocolMessage) {
+	if len(body) < 20 {
+		return
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	returned := binary.LittleEndian.Uint32(body[16:])
+	doc, _ := readBSON(body[20:])
+	switch {
+	case flags&mongoQueryFailure != 0:
+		msg.Code = "QueryFailure"
+		if doc != nil {
+			if code := bsonErrorCode(doc); code != "" {
+				msg.Code = code
+			}
+		}
+	case cmd.legacyCommand:
+		if doc != nil {
+			mongoReplyDoc(doc, msg)
+		}
+	default:
+		msg.Counters = map[string]uint64{"documents.returned": uint64(returned)}
+	}
+}
+
+//mongoReplyDoc 读取命令结果中的ok、错误码、写错误与返回的文档数量
+func mongoReplyDoc(doc bsonDoc, msg *metric.ProtocolMessage) {
+	var returned, writeErrors int
+	doc.each(func(e bsonElement) bool {
+		switch string(e.name) {
+		case "ok":
+			if n, ok := e.number(); ok && n == 0 {
+				msg.Code = bsonErrorCode(doc)
+				if msg.Code == "" {
+					msg.Code = "failed"
+				}
+			}
+		case "cursor":
+			for _, batch := range []string{"firstBatch", "nextBatch"} {
+				if docs := mongoField(e.doc(), batch); docs != nil {
+					returned = docs.count()
+				}
+			}
+		case "writeErrors":
+			writeErrors = e.doc().count()
+			if first := mongoField(e.doc(), "0"); first != nil && msg.Code == "" {
+				msg.Code = bsonErrorCode(first)
+			}
+		case "writeConcernError":
+			if msg.Code == "" && e.doc() != nil {
+				msg.Code = bsonErrorCode(e.doc())
+			}
+		}
+		return true
+	})
+	if returned > 0 || writeErrors > 0 {
+		msg.Counters = map[string]uint64{}
+		if returned > 0 {
+			msg.Counters["documents.returned"] = uint64(returned)
+		}
+		if writeErrors > 0 {
+			msg.Counters["write.errors"] = uint64(writeErrors)
+		}
+	}
+}
+
+//mongoDecompress 解压OP_COMPRESSED，支持zlib，不支持的压缩算法返回操作码0
+func mongoDecompress(body []byte, complete bool) (uint32, []byte, bool) {
+	if len(body) < 9 {
+		return 0, nil, false
+	}
+	op := binary.LittleEndian.Uint32(body)
+	size := int(int32(binary.LittleEndian.Uint32(body[4:])))
+	data := body[9:]
+	//解压后的长度为负数或压缩数据不为空时长度为0，不是有效的报文
+	if size < 0 || (size == 0 && len(data) > 0) {
+		return 0, nil, false
+	}
+	switch body[8] {
+	case 0:
+		return op, data, complete
+	case 2:
+		if size > maxFrameBuffer {
+			size, complete = maxFrameBuffer, false
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return 0, nil, false
+		}
+		out := make([]byte, size)
+		n, err := io.ReadFull(r, out)
+		if err != nil {
+			complete = false
+		}
+		return op, out[:n], complete
+	}
+	return 0, nil, false
+}
@@ -0,0 +1,246 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"tcm/metric"
+	"testing"
+	"time"
+)
+
+//bsonTestArray 测试中数组类型的值，内容为以下标为名称的文档
+type bsonTestArray []byte
+
+//bsonTestDoc 按名称与值生成BSON文档，值支持string、int、float64、嵌套文档与数组
+func bsonTestDoc(pairs ...interface{}) []byte {
+	var b []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name := pairs[i].(string)
+		var kind byte
+		var value []byte
+		switch v := pairs[i+1].(type) {
+		case string:
+			kind = 2
+			value = make([]byte, 4)
+			binary.LittleEndian.PutUint32(value, uint32(len(v)+1))
+			value = append(append(value, v...), 0)
+		case int:
+			kind = 0x10
+			value = make([]byte, 4)
+			binary.LittleEndian.PutUint32(value, uint32(v))
+		case float64:
+			kind = 1
+			value = make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, math.Float64bits(v))
+		case bsonTestArray:
+			kind, value = 4, v
+		case []byte:
+			kind, value = 3, v
+		}
+		b = append(b, kind)
+		b = append(b, name...)
+		b = append(b, 0)
+		b = append(b, value...)
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(b)+5))
+	return append(append(size, b...), 0)
+}
+
+//mongoHeader 加上消息头部
+func mongoHeader(requestID, responseTo, op uint32, body []byte) []byte {
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint32(h, uint32(16+len(body)))
+	binary.LittleEndian.PutUint32(h[4:], requestID)
+	binary.LittleEndian.PutUint32(h[8:], responseTo)
+	binary.LittleEndian.PutUint32(h[12:], op)
+	return append(h, body...)
+}
+
+//mongoTestMsg 生成OP_MSG，seq不为空时加上名称为seqName的文档序列
+func mongoTestMsg(requestID, responseTo, flags uint32, doc []byte, seqName string, seq ...[]byte) []byte {
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint32(body, flags)
+	body = append(body, 0)
+	body = append(body, doc...)
+	if len(seq) > 0 {
+		section := make([]byte, 4)
+		section = append(append(section, seqName...), 0)
+		for _, d := range seq {
+			section = append(section, d...)
+		}
+		binary.LittleEndian.PutUint32(section, uint32(len(section)))
+		body = append(append(body, 1), section...)
+	}
+	return mongoHeader(requestID, responseTo, mongoOpMsg, body)
+}
+
+//mongoTestQuery 生成OP_QUERY
+func mongoTestQuery(requestID uint32, ns string, doc []byte) []byte {
+	body := make([]byte, 4)
+	body = append(append(body, ns...), 0)
+	body = append(body, make([]byte, 8)...)
+	return mongoHeader(requestID, 0, mongoOpQuery, append(body, doc...))
+}
+
+//mongoTestReply 生成OP_REPLY
+func mongoTestReply(responseTo, flags uint32, docs ...[]byte) []byte {
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body, flags)
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(docs)))
+	for _, d := range docs {
+		body = append(body, d...)
+	}
+	return mongoHeader(responseTo, responseTo, mongoOpReply, body)
+}
+
+//mongoTestCompressed 用zlib压缩消息
+func mongoTestCompressed(msg []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(msg[16:])
+	w.Close()
+	body := make([]byte, 9)
+	binary.LittleEndian.PutUint32(body, binary.LittleEndian.Uint32(msg[12:]))
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(msg)-16))
+	body[8] = 2
+	return mongoHeader(binary.LittleEndian.Uint32(msg[4:]), binary.LittleEndian.Uint32(msg[8:]), mongoOpCompressed, append(body, buf.Bytes()...))
+}
+
+func TestMongoDecode(t *testing.T) {
+	okCursor := func(batch ...[]byte) []byte {
+		var docs []interface{}
+		for i, d := range batch {
+			docs = append(docs, string(rune('0'+i)), d)
+		}
+		return bsonTestDoc("cursor", bsonTestDoc("firstBatch", bsonTestArray(bsonTestDoc(docs...)), "id", 0), "ok", 1.0)
+	}
+	find := bsonTestDoc("find", "users", "filter", bsonTestDoc("status", "A", "age", bsonTestDoc("$gt", 30)), "$db", "app")
+	tests := []struct {
+		name     string
+		request  []byte
+		response []byte
+		//noReply 请求没有响应，直接统计
+		noReply bool
+		want    metric.ProtocolMessage
+		counter map[string]uint64
+	}{
+		{
+			name:     "find",
+			request:  mongoTestMsg(1, 0, 0, find, ""),
+			response: mongoTestMsg(100, 1, 0, okCursor(bsonTestDoc("a", 1), bsonTestDoc("a", 2)), ""),
+			want:     metric.ProtocolMessage{Command: "find", Resource: "app.users", Key: "find app.users {status: ?, age: {$gt: ?}}"},
+			counter:  map[string]uint64{"documents.returned": 2},
+		},
+		{
+			name:     "command error",
+			request:  mongoTestMsg(2, 0, 0, bsonTestDoc("insert", "users", "$db", "app"), "documents", bsonTestDoc("_id", 1)),
+			response: mongoTestMsg(101, 2, 0, bsonTestDoc("ok", 0.0, "errmsg", "not primary", "code", 10107, "codeName", "NotWritablePrimary"), ""),
+			want:     metric.ProtocolMessage{Command: "insert", Resource: "app.users", Key: "insert app.users", Code: "NotWritablePrimary"},
+		},
+		{
+			name:     "update with document sequence and write errors",
+			request:  mongoTestMsg(3, 0, 0, bsonTestDoc("update", "users", "$db", "app"), "updates", bsonTestDoc("q", bsonTestDoc("_id", 5), "u", bsonTestDoc("$set", bsonTestDoc("a", 1)))),
+			response: mongoTestMsg(102, 3, 0, bsonTestDoc("n", 0, "writeErrors", bsonTestArray(bsonTestDoc("0", bsonTestDoc("index", 0, "code", 11000, "codeName", "DuplicateKey"))), "ok", 1.0), ""),
+			want:     metric.ProtocolMessage{Command: "update", Resource: "app.users", Key: "update app.users {_id: ?}", Code: "DuplicateKey"},
+			counter:  map[string]uint64{"write.errors": 1},
+		},
+		{
+			name:    "unacknowledged write",
+			request: mongoTestMsg(4, 0, mongoMoreToCome, bsonTestDoc("delete", "logs", "$db", "app", "deletes", bsonTestArray(bsonTestDoc("0", bsonTestDoc("q", bsonTestDoc("day", 1), "limit", 0)))), ""),
+			noReply: true,
+			want:    metric.ProtocolMessage{Command: "delete", Resource: "app.logs", Key: "delete app.logs {day: ?}"},
+		},
+		{
+			name:     "legacy command",
+			request:  mongoTestQuery(5, "admin.$cmd", bsonTestDoc("$query", bsonTestDoc("isMaster", 1), "$readPreference", bsonTestDoc("mode", "primary"))),
+			response: mongoTestReply(5, 0, bsonTestDoc("ismaster", 1, "ok", 1.0)),
+			want:     metric.ProtocolMessage{Command: "isMaster", Key: "isMaster admin"},
+		},
+		{
+			name:     "legacy query failure",
+			request:  mongoTestQuery(6, "app.users", bsonTestDoc("query", bsonTestDoc("name", "a"), "orderby", bsonTestDoc("name", 1))),
+			response: mongoTestReply(6, mongoQueryFailure, bsonTestDoc("$err", "bad", "code", 2)),
+			want:     metric.ProtocolMessage{Command: "find", Resource: "app.users", Key: "find app.users {name: ?}", Code: "2"},
+		},
+		{
+			name:     "zlib compressed",
+			request:  mongoTestCompressed(mongoTestMsg(7, 0, 0, find, "")),
+			response: mongoTestCompressed(mongoTestMsg(103, 7, 0, okCursor(bsonTestDoc("a", 1)), "")),
+			want:     metric.ProtocolMessage{Command: "find", Resource: "app.users", Key: "find app.users {status: ?, age: {$gt: ?}}"},
+			counter:  map[string]uint64{"documents.returned": 1},
+		},
+	}
+	for _, test := range tests {
+		d := &MongoDecode{collections: newLabelFolder(maxMongoCollections), shapes: newLabelFolder(maxMongoShapes)}
+		s, st := newTestStream(d)
+		d.tcpStream = s
+		start := time.Now()
+		c := newTestConn(start)
+		s.feed(c, true, test.request[:10])
+		s.feed(c, true, test.request[10:])
+		if !test.noReply && len(st.msgs) != 0 {
+			t.Errorf("%s: request is counted before the response", test.name)
+		}
+		c.now = start.Add(5 * time.Millisecond)
+		s.feed(c, false, test.response)
+		msgs := st.protocol()
+		if len(msgs) != 1 {
+			t.Errorf("%s: got %d messages", test.name, len(msgs))
+			continue
+		}
+		m, want := msgs[0], test.want
+		if m.Command != want.Command || m.Resource != want.Resource || m.Key != want.Key || m.Code != want.Code || m.RequestLength != uint64(len(test.request)) {
+			t.Errorf("%s: got %s %q %q %q %d", test.name, m.Command, m.Resource, m.Key, m.Code, m.RequestLength)
+		}
+		if !test.noReply && (m.ReqTime != uint64(5*time.Millisecond) || m.ResponseLength != uint64(len(test.response))) {
+			t.Errorf("%s: response time %d length %d", test.name, m.ReqTime, m.ResponseLength)
+		}
+		for k, v := range test.counter {
+			if m.Counters[k] != v {
+				t.Errorf("%s: counters are %v", test.name, m.Counters)
+			}
+		}
+	}
+}
+
+func TestMongoDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		op   uint32
+		n    int
+	}{
+		{"noop", append([]byte{0xdd, 7, 0, 0, 3, 0, 0, 0, 0}, 1, 2, 3), mongoOpMsg, 3},
+		{"snappy", []byte{0xdd, 7, 0, 0, 3, 0, 0, 0, 1, 1, 2, 3}, 0, 0},
+		{"negative size", []byte{0xdd, 7, 0, 0, 0xff, 0xff, 0xff, 0xff, 2, 1}, 0, 0},
+		{"zero size with data", []byte{0xdd, 7, 0, 0, 0, 0, 0, 0, 2, 1}, 0, 0},
+		{"bad zlib", []byte{0xdd, 7, 0, 0, 3, 0, 0, 0, 2, 1, 2, 3}, 0, 0},
+		{"short", []byte{0xdd, 7, 0}, 0, 0},
+	}
+	for _, test := range tests {
+		if op, body, _ := mongoDecompress(test.body, true); op != test.op || len(body) != test.n {
+			t.Errorf("%s: got op %d with %d bytes", test.name, op, len(body))
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+)
+
+//MQTT报文类型
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttAuth        = 15
+)
+
+//等待响应的报文在请求表中的key，高位区分报文类型
+const (
+	mqttKeyConnect   = 1 << 40
+	mqttKeySubscribe = 2 << 40
+	mqttKeyPublish   = 3 << 40
+	mqttKeyPubrel    = 4 << 40
+)
+
+const (
+	//maxMQTTTopics 统计的最大topic数量，超出后归入other
+	maxMQTTTopics = 500
+	//mqttHeadLimit 解析PUBLISH时读取的最大长度，payload只统计长度
+	mqttHeadLimit = 4096
+)
+
+//mqttConnectCodes MQTT 3.1.1的CONNACK返回码
+var mqttConnectCodes = map[byte]string{
+	1: "UNACCEPTABLE_PROTOCOL_VERSION", 2: "IDENTIFIER_REJECTED", 3: "SERVER_UNAVAILABLE",
+	4: "BAD_USERNAME_OR_PASSWORD", 5: "NOT_AUTHORIZED",
+}
+
+//mqttReasonCodes MQTT 5.0表示失败的原因码
+var mqttReasonCodes = map[byte]string{
+	0x80: "UNSPECIFIED_ERROR", 0x81: "MALFORMED_PACKET", 0x82: "PROTOCOL_ERROR",
+	0x83: "IMPLEMENTATION_SPECIFIC_ERROR", 0x84: "UNSUPPORTED_PROTOCOL_VERSION",
+	0x85: "CLIENT_IDENTIFIER_NOT_VALID", 0x86: "BAD_USERNAME_OR_PASSWORD", 0x87: "NOT_AUTHORIZED",
+	0x88: "SERVER_UNAVAILABLE", 0x89: "SERVER_BUSY", 0x8a: "BANNED", 0x8b: "SERVER_SHUTTING_DOWN",
+	0x8c: "BAD_AUTHENTICATION_METHOD", 0x8d: "KEEP_ALIVE_TIMEOUT", 0x8e: "SESSION_TAKEN_OVER",
+	0x8f: "TOPIC_FILTER_INVALID", 0x90: "TOPIC_NAME_INVALID", 0x91: "PACKET_IDENTIFIER_IN_USE",
+	0x92: "PACKET_IDENTIFIER_NOT_FOUND", 0x93: "RECEIVE_MAXIMUM_EXCEEDED", 0x94: "TOPIC_ALIAS_INVALID",
+	0x95: "PACKET_TOO_LARGE", 0x96: "MESSAGE_RATE_TOO_HIGH", 0x97: "QUOTA_EXCEEDED",
+	0x98: "ADMINISTRATIVE_ACTION", 0x99: "PAYLOAD_FORMAT_INVALID", 0x9a: "RETAIN_NOT_SUPPORTED",
+	0x9b: "QOS_NOT_SUPPORTED", 0x9c: "USE_ANOTHER_SERVER", 0x9d: "SERVER_MOVED",
+	0x9e: "SHARED_SUBSCRIPTIONS_NOT_SUPPORTED", 0x9f: "CONNECTION_RATE_EXCEEDED",
+	0xa0: "MAXIMUM_CONNECT_TIME", 0xa1: "SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED",
+	0xa2: "WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED",
+}
+
+//mqttConn 连接的协议版本与状态
+type mqttConn struct {
+	version   byte
+	connected bool
+	//QoS 2消息收到PUBREC后记录topic，PUBREL/PUBCOMP按该topic统计
+	released map[uint64]string
+}
+
+//mqttCall 等待响应的报文
+type mqttCall struct {
+	msg *metric.ProtocolMessage
+	//SUBSCRIBE中的topic过滤器，按SUBACK中的返回码分别统计
+	filters []string
+}
+
+//MQTTDecode MQTT 3.1.1与5.0协议解码
+type MQTTDecode struct {
+	*tcpStream
+	normalizer *PathNormalizer
+	topics     *labelFolder
+	clients    int64
+}
+
+//CreateMQTTDecode CreateMQTTDecode
+func CreateMQTTDecode(option *config.Option, port config.Port) *MQTTDecode {
+	d := &MQTTDecode{
+		normalizer: NewPathNormalizer(port.Routes),
+		topics:     newLabelFolder(maxMQTTTopics),
+	}
+	d.tcpStream = newTCPStream("mqtt", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+//mqttLength 读取剩余长度，返回剩余长度与固定头部的长度，数据不足时头部长度为0，格式错误时为-1
+func mqttLength(buf []byte) (int, int) {
+	length, shift := 0, uint(0)
+	for i := 1; i < len(buf); i++ {
+		length |= int(buf[i]&0x7f) << shift
+		if buf[i]&0x80 == 0 {
+			return length, i + 1
+		}
+		shift += 7
+		if i == 4 {
+			return 0, -1
+		}
+	}
+	return 0, 0
+}
+
+func (d *MQTTDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 2 {
+		return 0, 0
+	}
+	kind, flags := buf[0]>>4, buf[0]&0x0f
+	switch kind {
+	case 0:
+		return -1, 0
+	case mqttPublish:
+	case mqttPubrel, mqttSubscribe, mqttUnsubscribe:
+		if flags != 2 {
+			return -1, 0
+		}
+	default:
+		if flags != 0 {
+			return -1, 0
+		}
+	}
+	length, head := mqttLength(buf)
+	if head <= 0 {
+		return head, 0
+	}
+	total = head + length
+	if kind == mqttPublish && total > head+mqttHeadLimit {
+		return total, head + mqttHeadLimit
+	}
+	return total, total
+}
+
+func (d *MQTTDecode) conn(c *streamConn) *mqttConn {
+	if c.state == nil {
+		//没有看到CONNECT时按3.1.1解析
+		c.state = &mqttConn{version: 4}
+	}
+	return c.state.(*mqttConn)
+}
+
+func (d *MQTTDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	mc := d.conn(c)
+	_, head := mqttLength(frame)
+	body := &mqttReader{p: frame[head:]}
+	//发起方向，客户端为0，broker为1
+	dir, peer := uint64(0), uint64(1)
+	if !request {
+		dir, peer = 1, 0
+	}
+	switch frame[0] >> 4 {
+	case mqttConnect:
+		body.str()
+		mc.version = body.byte()
+		msg := d.message(c, "CONNECT", "")
+		msg.RequestLength = uint64(total)
+		c.call(mqttKeyConnect, &mqttCall{msg: msg})
+	case mqttConnack:
+		body.byte()
+		code := body.byte()
+		call := c.reply(mqttKeyConnect)
+		if call == nil {
+			return
+		}
+		msg := call.value.(*mqttCall).msg
+		if code == 0 {
+			mc.connected = true
+			d.clients++
+			msg.Gauges = map[string]int64{"clients": d.clients}
+		} else if mc.version == 5 {
+			msg.Code = mqttReason(code)
+		} else if msg.Code = mqttConnectCodes[code]; msg.Code == "" {
+			msg.Code = strconv.Itoa(int(code))
+		}
+		d.finish(s, c, call, total)
+	case mqttPublish:
+		d.publish(s, c, mc, request, frame[0], body, total-head)
+	case mqttPuback, mqttPubrec:
+		//确认对方发布的消息，PUBREC之后等待PUBREL/PUBCOMP
+		id := uint64(body.short())
+		call := c.reply(mqttKeyPublish | peer<<16 | id)
+		if call == nil {
+			return
+		}
+		msg := call.value.(*mqttCall).msg
+		if mc.version == 5 && len(body.p) > 0 {
+			msg.Code = mqttReason(body.byte())
+		}
+		if frame[0]>>4 == mqttPubrec && msg.Code == "" {
+			if mc.released == nil {
+				mc.released = map[uint64]string{}
+			}
+			mc.released[peer<<16|id] = msg.Resource
+		}
+		d.finish(s, c, call, 0)
+	case mqttPubrel:
+		id := uint64(body.short())
+		topic, ok := mc.released[dir<<16|id]
+		if !ok {
+			return
+		}
+		delete(mc.released, dir<<16|id)
+		c.call(mqttKeyPubrel|dir<<16|id, &mqttCall{msg: d.message(c, "PUBREL", topic)})
+	case mqttPubcomp:
+		id := uint64(body.short())
+		if call := c.reply(mqttKeyPubrel | peer<<16 | id); call != nil {
+			if mc.version == 5 && len(body.p) > 0 {
+				call.value.(*mqttCall).msg.Code = mqttReason(body.byte())
+			}
+			d.finish(s, c, call, 0)
+		}
+	case mqttSubscribe, mqttUnsubscribe:
+		id := uint64(body.short())
+		body.properties(mc.version)
+		command := "SUBSCRIBE"
+		if frame[0]>>4 == mqttUnsubscribe {
+			command = "UNSUBSCRIBE"
+		}
+		call := &mqttCall{msg: d.message(c, command, "")}
+		for len(body.p) > 0 {
+			filter := body.str()
+			if body.err {
+				break
+			}
+			if command == "SUBSCRIBE" {
+				body.byte()
+			}
+			call.filters = append(call.filters, filter)
+		}
+		c.call(mqttKeySubscribe|id, call)
+	case mqttSuback, mqttUnsuback:
+		id := uint64(body.short())
+		body.properties(mc.version)
+		call := c.reply(mqttKeySubscribe | id)
+		if call == nil {
+			return
+		}
+		//每个topic过滤器分别统计，返回码在0x80以上为失败
+		mq := call.value.(*mqttCall)
+		elapsed := c.elapsed(call)
+		for i, filter := range mq.filters {
+			msg := *mq.msg
+			msg.Resource = d.topics.fold(filter)
+			msg.ReqTime = elapsed
+			if i > 0 {
+				//其他过滤器只按topic统计，请求只计数一次
+				msg.RequestLength, msg.ResponseLength = 0, 0
+				msg.Batched = true
+			}
+			if code := body.byte(); code >= 0x80 && !body.err {
+				msg.Code = mqttReason(code)
+			}
+			s.store.Input(&msg)
+		}
+	case mqttPingreq:
+		c.push(&mqttCall{msg: d.message(c, "PINGREQ", "")})
+	case mqttPingresp:
+		if call := c.pop(); call != nil {
+			d.finish(s, c, call, 0)
+		}
+	case mqttDisconnect:
+		msg := d.message(c, "DISCONNECT", "")
+		if mc.version == 5 && len(body.p) > 0 {
+			if code := body.byte(); code >= 0x80 {
+				msg.Code = mqttReason(code)
+			}
+		}
+		s.store.Input(msg)
+		d.disconnect(s, mc)
+	case mqttAuth:
+		s.store.Input(d.message(c, "AUTH", ""))
+	}
+}
+
+//publish 客户端发布的消息为PUBLISH，broker投递给客户端的消息为DELIVER，QoS 1/2等待确认
+func (d *MQTTDecode) publish(s *tcpStream, c *streamConn, mc *mqttConn, request bool, flags byte, body *mqttReader, remaining int) {
+	start := len(body.p)
+	topic := body.str()
+	qos := flags >> 1 & 3
+	var id uint64
+	if qos > 0 {
+		id = uint64(body.short())
+	}
+	body.properties(mc.version)
+	if body.err {
+		return
+	}
+	command, counter, dir := "PUBLISH", "publish", uint64(0)
+	if !request {
+		command, counter, dir = "DELIVER", "deliver", 1
+	}
+	//payload的长度为剩余长度减去已经解析的可变头部
+	payload := uint64(remaining - (start - len(body.p)))
+	msg := d.message(c, command, d.topic(topic))
+	msg.RequestLength = payload
+	msg.Counters = map[string]uint64{counter + ".bytes": payload, counter + ".qos" + strconv.Itoa(int(qos)): 1}
+	if flags&1 != 0 {
+		msg.Counters[counter+".retained"] = 1
+	}
+	if qos == 0 {
+		s.store.Input(msg)
+		return
+	}
+	c.call(mqttKeyPublish|dir<<16|id, &mqttCall{msg: msg})
+}
+
+func (d *MQTTDecode) finish(s *tcpStream, c *streamConn, call *streamCall, total int) {
+	msg := call.value.(*mqttCall).msg
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	s.store.Input(msg)
+}
+
+func (d *MQTTDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*mqttCall).msg
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//closed 连接关闭时减少已连接的客户端数量
+func (d *MQTTDecode) closed(s *tcpStream, c *streamConn) {
+	if c.state != nil {
+		d.disconnect(s, c.state.(*mqttConn))
+	}
+}
+
+func (d *MQTTDecode) disconnect(s *tcpStream, mc *mqttConn) {
+	if mc.connected {
+		mc.connected = false
+		d.clients--
+		s.store.Input(&metric.ProtocolMessage{Gauges: map[string]int64{"clients": d.clients}})
+	}
+}
+
+func (d *MQTTDecode) message(c *streamConn, command, resource string) *metric.ProtocolMessage {
+	return &metric.ProtocolMessage{Command: command, Resource: resource, RemoteAddr: c.client}
+}
+
+//topic 规范化topic，ID类的层级替换为 +，如 devices/8231/telemetry 为 devices/+/telemetry
+func (d *MQTTDecode) topic(topic string) string {
+	return d.topics.fold(d.normalizer.NormalizeTopic(topic, "/", "+"))
+}
+
+//mqttReason MQTT 5.0原因码名称
+func mqttReason(code byte) string {
+	if code < 0x80 {
+		return ""
+	}
+	if name, ok := mqttReasonCodes[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+//mqttReader 读取可变头部，数据不足时err为true
+type mqttReader struct {
+	p   []byte
+	err bool
+}
+
+func (m *mqttReader) take(n int) []byte {
+	if m.err || n > len(m.p) {
+		m.err = true
+		return nil
+	}
+	b := m.p[:n]
+	m.p = m.p[n:]
+	return b
+}
+
+func (m *mqttReader) byte() byte {
+	if b := m.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (m *mqttReader) short() uint16 {
+	if b := m.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (m *mqttReader) str() string {
+	return string(m.take(int(m.short())))
+}
+
+//properties 跳过MQTT 5.0的属性
+func (m *mqttReader) properties(version byte) {
+	if version != 5 {
+		return
+	}
+	length, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		b := m.byte()
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	m.take(length)
+}
@@ -0,0 +1,155 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"tcm/metric"
+	"testing"
+)
+
+//mqttPacket 生成MQTT报文，body按顺序拼接在固定头部之后
+func mqttPacket(kind, flags byte, body ...string) []byte {
+	var p []byte
+	for _, b := range body {
+		p = append(p, b...)
+	}
+	head := []byte{kind<<4 | flags}
+	length := len(p)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		head = append(head, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(head, p...)
+}
+
+//mqttStr 长度前缀的字符串
+func mqttStr(s string) string {
+	return string([]byte{byte(len(s) >> 8), byte(len(s))}) + s
+}
+
+//mqttID 报文标识
+func mqttID(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+func TestMQTTDecode(t *testing.T) {
+	req := func(kind, flags byte, body ...string) streamSegment {
+		return streamSegment{true, mqttPacket(kind, flags, body...)}
+	}
+	res := func(kind, flags byte, body ...string) streamSegment {
+		return streamSegment{false, mqttPacket(kind, flags, body...)}
+	}
+	connect := func(version byte) streamSegment {
+		return req(mqttConnect, 0, mqttStr("MQTT"), string([]byte{version, 2, 0, 60}), mqttStr("sensor-1"))
+	}
+	runStreamTests(t, func() streamParser {
+		return &MQTTDecode{normalizer: NewPathNormalizer(nil), topics: newLabelFolder(maxMQTTTopics)}
+	}, []streamTest{
+		{
+			name: "connect and publish",
+			segments: []streamSegment{
+				connect(4), res(mqttConnack, 0, "\x00\x00"),
+				req(mqttPublish, 0, mqttStr("devices/8231/telemetry"), "hello"),
+				req(mqttPublish, 2, mqttStr("devices/8232/telemetry"), mqttID(7), "hi"), res(mqttPuback, 0, mqttID(7)),
+			},
+			close: true,
+			want: []metric.ProtocolMessage{
+				{Command: "CONNECT", RequestLength: 22, ResponseLength: 4, Gauges: map[string]int64{"clients": 1}},
+				{Command: "PUBLISH", Resource: "devices/+/telemetry", RequestLength: 5,
+					Counters: map[string]uint64{"publish.bytes": 5, "publish.qos0": 1}},
+				{Command: "PUBLISH", Resource: "devices/+/telemetry", RequestLength: 2,
+					Counters: map[string]uint64{"publish.bytes": 2, "publish.qos1": 1}},
+				{Gauges: map[string]int64{"clients": 0}},
+			},
+		},
+		{
+			name:     "connect rejected",
+			segments: []streamSegment{connect(4), res(mqttConnack, 0, "\x00\x05")},
+			want:     []metric.ProtocolMessage{{Command: "CONNECT", Code: "NOT_AUTHORIZED"}},
+		},
+		{
+			name:     "connect rejected v5",
+			segments: []streamSegment{connect(5), res(mqttConnack, 0, "\x00\x87\x00")},
+			want:     []metric.ProtocolMessage{{Command: "CONNECT", Code: "NOT_AUTHORIZED"}},
+		},
+		{
+			name: "qos2",
+			segments: []streamSegment{
+				req(mqttPublish, 5, mqttStr("alarms"), mqttID(9), "fire"), res(mqttPubrec, 0, mqttID(9)),
+				req(mqttPubrel, 2, mqttID(9)), res(mqttPubcomp, 0, mqttID(9)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "PUBLISH", Resource: "alarms", Counters: map[string]uint64{"publish.qos2": 1, "publish.retained": 1}},
+				{Command: "PUBREL", Resource: "alarms"},
+			},
+		},
+		{
+			name:     "deliver",
+			segments: []streamSegment{res(mqttPublish, 2, mqttStr("alarms"), mqttID(3), "smoke"), req(mqttPuback, 0, mqttID(3))},
+			want: []metric.ProtocolMessage{
+				{Command: "DELIVER", Resource: "alarms", Counters: map[string]uint64{"deliver.bytes": 5, "deliver.qos1": 1}},
+			},
+		},
+		{
+			name: "subscribe",
+			segments: []streamSegment{
+				req(mqttSubscribe, 2, mqttID(1), mqttStr("alarms/#"), "\x01", mqttStr("$SYS/#"), "\x00"),
+				res(mqttSuback, 0, mqttID(1), "\x01\x80"),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "SUBSCRIBE", Resource: "alarms/#"},
+				{Command: "SUBSCRIBE", Resource: "$SYS/#", Code: "UNSPECIFIED_ERROR", Batched: true},
+			},
+		},
+		{
+			name:     "ping",
+			segments: []streamSegment{req(mqttPingreq, 0), res(mqttPingresp, 0), req(mqttPingreq, 0)},
+			sweep:    true,
+			want: []metric.ProtocolMessage{
+				{Command: "PINGREQ"},
+				{Command: "PINGREQ", Result: metric.ResultTimeout},
+			},
+		},
+		{
+			name: "disconnect",
+			segments: []streamSegment{
+				connect(5), res(mqttConnack, 0, "\x00\x00\x00"), req(mqttDisconnect, 0, "\x8e\x00"),
+			},
+			close: true,
+			want: []metric.ProtocolMessage{
+				{Command: "CONNECT", Gauges: map[string]int64{"clients": 1}},
+				{Command: "DISCONNECT", Code: "SESSION_TAKEN_OVER"},
+				{Gauges: map[string]int64{"clients": 0}},
+			},
+		},
+		{
+			name:     "aborted",
+			segments: []streamSegment{req(mqttPublish, 2, mqttStr("alarms"), mqttID(4), "x")},
+			close:    true,
+			want:     []metric.ProtocolMessage{{Command: "PUBLISH", Resource: "alarms", Result: metric.ResultAborted}},
+		},
+	})
+}
@@ -0,0 +1,525 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+	"unicode/utf16"
+)
+
+const (
+	tdsHeadLength = 8
+	//tdsHeadLimit 每个消息缓存的最大长度，结果集只统计长度
+	tdsHeadLimit = 16 * 1024
+	//maxTDSDatabases 统计的最大数据库数量，超出后归入other
+	maxTDSDatabases = 100
+	//maxTDSApps 统计登录的最大应用名称数量
+	maxTDSApps = 200
+)
+
+//消息类型
+const (
+	tdsSQLBatch  = 0x01
+	tdsRPC       = 0x03
+	tdsResponse  = 0x04
+	tdsAttention = 0x06
+	tdsLogin7    = 0x10
+	tdsPrelogin  = 0x12
+)
+
+//tdsCommands 客户端请求的消息类型
+var tdsCommands = map[byte]string{
+	0x01: "SQLBatch", 0x02: "Login", 0x03: "RPC", 0x07: "BulkLoad", 0x0e: "TransactionManager",
+	0x10: "Login", 0x11: "SSPI", 0x12: "Prelogin",
+}
+
+//tdsProcs RPC中按ID调用的系统存储过程
+var tdsProcs = map[uint16]string{
+	1: "sp_cursor", 2: "sp_cursoropen", 3: "sp_cursorprepare", 4: "sp_cursorexecute",
+	5: "sp_cursorprepexec", 6: "sp_cursorunprepare", 7: "sp_cursorfetch", 8: "sp_cursoroption",
+	9: "sp_cursorclose", 10: "sp_executesql", 11: "sp_prepare", 12: "sp_execute",
+	13: "sp_prepexec", 14: "sp_prepexecrpc", 15: "sp_unprepare",
+}
+
+//tdsStatementParam 带有语句的存储过程中语句参数的位置
+var tdsStatementParam = map[string]int{
+	"sp_executesql": 0, "sp_prepare": 2, "sp_prepexec": 2, "sp_cursorprepexec": 3, "sp_cursoropen": 1,
+}
+
+//DONE令牌的状态位
+const (
+	tdsDoneError = 0x02
+	tdsDoneCount = 0x10
+)
+
+//tdsMessage 由一个或多个报文组成的消息
+type tdsMessage struct {
+	kind    byte
+	payload []byte
+	//消息最后的字节，用于读取结果集之后的DONE令牌
+	tail []byte
+	size int
+}
+
+//tdsConn 连接的当前数据库、加密状态与两个方向正在接收的消息
+type tdsConn struct {
+	database  string
+	encrypted bool
+	//TDS 7.2之前DONE令牌中的行数为4字节
+	legacy  bool
+	message [2]*tdsMessage
+}
+
+//MSSQLDecode SQL Server TDS协议解码
+type MSSQLDecode struct {
+	*tcpStream
+	databases *labelFolder
+	apps      *labelFolder
+}
+
+//CreateMSSQLDecode CreateMSSQLDecode
+func CreateMSSQLDecode(option *config.Option, port config.Port) *MSSQLDecode {
+	d := &MSSQLDecode{
+		databases: newLabelFolder(maxTDSDatabases),
+		apps:      newLabelFolder(maxTDSApps),
+	}
+	d.tcpStream = newTCPStream("mssql", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *MSSQLDecode) conn(c *streamConn) *tdsConn {
+	if c.state == nil {
+		c.state = &tdsConn{}
+	}
+	return c.state.(*tdsConn)
+}
+
+func (d *MSSQLDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 5 {
+		return 0, 0
+	}
+	//加密连接中的TLS记录
+	if buf[0] >= 0x14 && buf[0] <= 0x17 && buf[1] == 0x03 {
+		total = 5 + int(binary.BigEndian.Uint16(buf[3:]))
+		return total, total
+	}
+	if len(buf) < tdsHeadLength {
+		return 0, 0
+	}
+	if _, ok := tdsCommands[buf[0]]; !ok && buf[0] != tdsResponse && buf[0] != tdsAttention {
+		return -1, 0
+	}
+	total = int(binary.BigEndian.Uint16(buf[2:]))
+	if total < tdsHeadLength {
+		return -1, 0
+	}
+	return total, total
+}
+
+func (d *MSSQLDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	tc := d.conn(c)
+	if frame[1] == 0x03 && frame[0] >= 0x14 && frame[0] <= 0x17 {
+		return
+	}
+	dir := 0
+	if !request {
+		dir = 1
+	}
+	m := tc.message[dir]
+	if m == nil {
+		m = &tdsMessage{kind: frame[0]}
+		tc.message[dir] = m
+	}
+	payload := frame[tdsHeadLength:total]
+	m.size += total
+	if room := tdsHeadLimit - len(m.payload); room > 0 {
+		if len(payload) < room {
+			room = len(payload)
+		}
+		m.payload = append(m.payload, payload[:room]...)
+	}
+	m.tail = append(m.tail, payload...)
+	if len(m.tail) > 13 {
+		m.tail = append([]byte(nil), m.tail[len(m.tail)-13:]...)
+	}
+	//状态位0x01表示消息的最后一个报文
+	if frame[1]&0x01 == 0 {
+		return
+	}
+	tc.message[dir] = nil
+	if request {
+		d.request(s, c, tc, m)
+	} else if m.kind == tdsResponse {
+		d.response(s, c, tc, m)
+	}
+}
+
+//request 读取请求中的语句，请求按顺序等待响应
+func (d *MSSQLDecode) request(s *tcpStream, c *streamConn, tc *tdsConn, m *tdsMessage) {
+	if m.kind == tdsAttention {
+		//客户端取消正在执行的请求，通常是客户端的命令超时
+		if call := c.pop(); call != nil {
+			msg := call.value.(*metric.ProtocolMessage)
+			msg.Code = "ATTENTION"
+			msg.ReqTime = c.elapsed(call)
+			s.store.Input(msg)
+		}
+		return
+	}
+	if tc.encrypted {
+		return
+	}
+	msg := &metric.ProtocolMessage{Command: tdsCommands[m.kind], RemoteAddr: c.client, RequestLength: uint64(m.size)}
+	switch m.kind {
+	case tdsSQLBatch:
+		msg.Key = cleanupQuery([]byte(tdsString(tdsSkipHeaders(m.payload))))
+	case tdsRPC:
+		msg.Key = tdsRPCStatement(tdsSkipHeaders(m.payload))
+	case tdsLogin7:
+		d.login(tc, msg, m.payload)
+	}
+	if tc.database != "" {
+		msg.Resource = d.databases.fold(tc.database)
+	}
+	c.push(msg)
+}
+
+//login 读取LOGIN7中的应用名称与数据库，密码不读取
+func (d *MSSQLDecode) login(tc *tdsConn, msg *metric.ProtocolMessage, p []byte) {
+	if len(p) < 72 {
+		return
+	}
+	tc.legacy = binary.LittleEndian.Uint32(p[4:]) < 0x72000000
+	field := func(at int) string {
+		offset, length := int(binary.LittleEndian.Uint16(p[at:])), int(binary.LittleEndian.Uint16(p[at+2:]))*2
+		if offset+length > len(p) {
+			return ""
+		}
+		return tdsString(p[offset : offset+length])
+	}
+	if app := field(48); app != "" {
+		msg.Key = "Login " + d.apps.fold(app)
+	}
+	tc.database = field(68)
+}
+
+//response 读取响应中的令牌：ERROR、DONE的行数、数据库切换与登录结果
+func (d *MSSQLDecode) response(s *tcpStream, c *streamConn, tc *tdsConn, m *tdsMessage) {
+	call := c.pop()
+	if call == nil {
+		return
+	}
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(m.size)
+	if msg.Command == "Prelogin" {
+		//服务端要求加密(ENCRYPT_ON或ENCRYPT_REQ)时之后的数据都无法解析
+		if v := tdsPreloginEncryption(m.payload); v == 1 || v == 3 {
+			tc.encrypted = true
+			msg.Counters = map[string]uint64{"connections.encrypted": 1}
+		}
+		s.store.Input(msg)
+		return
+	}
+	t := &tdsTokens{conn: tc, msg: msg}
+	if !t.walk(m.payload) || m.size-tdsHeadLength > len(m.payload) {
+		//结果集无法解析时从消息最后的DONE令牌读取结果
+		done := 13
+		if tc.legacy {
+			done = 9
+		}
+		if len(m.tail) >= done && m.tail[len(m.tail)-done] >= 0xfd {
+			t.walk(m.tail[len(m.tail)-done:])
+		}
+	}
+	if msg.Code == "" && t.failed {
+		msg.Code = "Error"
+	}
+	if t.rows > 0 {
+		if msg.Counters == nil {
+			msg.Counters = map[string]uint64{}
+		}
+		msg.Counters["rows"] += t.rows
+	}
+	if tc.database != "" {
+		msg.Resource = d.databases.fold(tc.database)
+	}
+	s.store.Input(msg)
+}
+
+func (d *MSSQLDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//tdsTokens 按顺序读取响应中的令牌
+type tdsTokens struct {
+	conn   *tdsConn
+	msg    *metric.ProtocolMessage
+	rows   uint64
+	failed bool
+}
+
+//walk 读取令牌，遇到无法跳过的令牌(如结果集的列与行)时返回false
+func (t *tdsTokens) walk(p []byte) bool {
+	for len(p) > 0 {
+		switch token := p[0]; token {
+		case 0xaa, 0xab, 0xad, 0xe3, 0xa9, 0xa4, 0xa5, 0xed:
+			if len(p) < 3 {
+				return false
+			}
+			n := 3 + int(binary.LittleEndian.Uint16(p[1:]))
+			if n > len(p) {
+				return false
+			}
+			t.token(token, p[3:n])
+			p = p[n:]
+		case 0xe4, 0xee:
+			if len(p) < 5 {
+				return false
+			}
+			n := 5 + int(binary.LittleEndian.Uint32(p[1:]))
+			if n < 5 || n > len(p) {
+				return false
+			}
+			p = p[n:]
+		case 0x79:
+			if len(p) < 5 {
+				return false
+			}
+			p = p[5:]
+		case 0xfd, 0xfe, 0xff:
+			n := 13
+			if t.conn.legacy {
+				n = 9
+			}
+			if len(p) < n {
+				return false
+			}
+			status := binary.LittleEndian.Uint16(p[1:])
+			if status&tdsDoneError != 0 {
+				t.failed = true
+			}
+			if status&tdsDoneCount != 0 {
+				if n == 13 {
+					t.rows += binary.LittleEndian.Uint64(p[5:])
+				} else {
+					t.rows += uint64(binary.LittleEndian.Uint32(p[5:]))
+				}
+			}
+			p = p[n:]
+		case 0x81:
+			//没有列信息的COLMETADATA
+			if len(p) < 3 || binary.LittleEndian.Uint16(p[1:]) != 0xffff {
+				return false
+			}
+			p = p[3:]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tdsTokens) token(token byte, body []byte) {
+	switch token {
+	case 0xaa:
+		//ERROR：错误号、状态与严重级别
+		if len(body) < 6 {
+			return
+		}
+		number := int32(binary.LittleEndian.Uint32(body))
+		if t.msg.Code == "" {
+			t.msg.Code = strconv.Itoa(int(number))
+		}
+		if t.msg.Counters == nil {
+			t.msg.Counters = map[string]uint64{}
+		}
+		t.msg.Counters["errors.severity."+strconv.Itoa(int(body[5]))]++
+		t.failed = true
+	case 0xe3:
+		//ENVCHANGE类型1为切换数据库
+		if len(body) >= 2 && body[0] == 1 && 2+int(body[1])*2 <= len(body) {
+			t.conn.database = tdsString(body[2 : 2+int(body[1])*2])
+		}
+	}
+}
+
+//tdsPreloginEncryption PRELOGIN响应中的加密选项，没有时返回-1
+func tdsPreloginEncryption(p []byte) int {
+	for i := 0; i+5 <= len(p) && p[i] != 0xff; i += 5 {
+		if p[i] != 1 {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint16(p[i+1:]))
+		if offset < len(p) {
+			return int(p[offset])
+		}
+	}
+	return -1
+}
+
+//tdsSkipHeaders 跳过TDS 7.2之后请求开始的ALL_HEADERS
+func tdsSkipHeaders(p []byte) []byte {
+	if len(p) < 4 {
+		return p
+	}
+	total := int(binary.LittleEndian.Uint32(p))
+	if total < 4 || total > len(p) {
+		return p
+	}
+	if total > 4 && (total < 10 || int(binary.LittleEndian.Uint32(p[4:])) > total-4) {
+		return p
+	}
+	return p[total:]
+}
+
+//tdsRPCStatement RPC调用的语句，sp_executesql等存储过程读取语句参数，其他存储过程为 EXEC 名称
+func tdsRPCStatement(p []byte) string {
+	r := &tdsReader{p: p}
+	var name string
+	if n := r.u16(); n == 0xffff {
+		id := r.u16()
+		if name = tdsProcs[id]; name == "" {
+			name = "proc" + strconv.Itoa(int(id))
+		}
+	} else {
+		name = tdsString(r.take(int(n) * 2))
+	}
+	r.u16()
+	if r.err || name == "" {
+		return ""
+	}
+	if index, ok := tdsStatementParam[strings.ToLower(name)]; ok {
+		for i := 0; i <= index; i++ {
+			value, ok := r.param()
+			if !ok {
+				break
+			}
+			if i == index && value != "" {
+				return cleanupQuery([]byte(value))
+			}
+		}
+	}
+	return "EXEC " + name
+}
+
+//tdsReader 读取小端序的TDS数据，数据不足时err为true
+type tdsReader struct {
+	p   []byte
+	err bool
+}
+
+func (r *tdsReader) take(n int) []byte {
+	if r.err || n < 0 || n > len(r.p) {
+		r.err = true
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+//partial 读取最多n个字节，语句超过缓存长度时只读取已缓存的部分
+func (r *tdsReader) partial(n int) []byte {
+	if n > len(r.p) {
+		n = len(r.p)
+	}
+	return r.take(n)
+}
+
+func (r *tdsReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tdsReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tdsReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+//param 读取RPC的一个参数，返回字符串类型参数的值，不支持的类型返回false
+func (r *tdsReader) param() (string, bool) {
+	r.take(int(r.byte()) * 2)
+	r.byte()
+	kind := r.byte()
+	switch kind {
+	case 0x26:
+		//INTN，如sp_prepexec的句柄参数
+		r.byte()
+		r.take(int(r.byte()))
+		return "", !r.err
+	case 0xe7, 0xef, 0xa7, 0xaf:
+		//NVARCHAR、NCHAR、VARCHAR与CHAR
+		max := r.u16()
+		r.take(5)
+		var value []byte
+		if max == 0xffff {
+			//PLP：总长度之后为多个分块，以长度为0的分块结束
+			if b := r.take(8); b == nil || binary.LittleEndian.Uint64(b) == ^uint64(0) {
+				return "", !r.err
+			}
+			for !r.err && len(r.p) > 0 {
+				n := r.u32()
+				if n == 0 {
+					break
+				}
+				value = append(value, r.partial(int(n))...)
+			}
+		} else if n := r.u16(); n != 0xffff {
+			value = r.partial(int(n))
+		}
+		if r.err {
+			return "", false
+		}
+		if kind == 0xe7 || kind == 0xef {
+			return tdsString(value), true
+		}
+		return string(value), true
+	}
+	return "", false
+}
+
+//tdsString 解码UTF-16LE字符串
+func tdsString(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,193 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+	"unicode/utf16"
+)
+
+//tdsPacket 生成TDS报文，last为消息的最后一个报文
+func tdsPacket(kind byte, last bool, payload string) []byte {
+	p := []byte{kind, 0, 0, 0, 0, 0, 1, 0}
+	if last {
+		p[1] = 0x01
+	}
+	binary.BigEndian.PutUint16(p[2:], uint16(tdsHeadLength+len(payload)))
+	return append(p, payload...)
+}
+
+//tdsUCS2 编码UTF-16LE字符串
+func tdsUCS2(s string) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return string(b)
+}
+
+//tdsLE 小端序的整数，size为字节数
+func tdsLE(v uint64, size int) string {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return string(b[:size])
+}
+
+//tdsHeaders 只包含事务描述的ALL_HEADERS
+const tdsHeaders = "\x16\x00\x00\x00\x12\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00"
+
+//tdsDone DONE令牌
+func tdsDone(status uint16, rows uint64) string {
+	return "\xfd" + tdsLE(uint64(status), 2) + "\x00\x00" + tdsLE(rows, 8)
+}
+
+//tdsErrorToken ERROR令牌
+func tdsErrorToken(number uint32, class byte, text string) string {
+	body := tdsLE(uint64(number), 4) + "\x01" + string([]byte{class}) + tdsLE(uint64(len(text)), 2) + tdsUCS2(text) + "\x00\x00" + tdsLE(1, 4)
+	return "\xaa" + tdsLE(uint64(len(body)), 2) + body
+}
+
+//tdsDatabaseChange 切换数据库的ENVCHANGE令牌
+func tdsDatabaseChange(database string) string {
+	body := "\x01" + string([]byte{byte(len(database))}) + tdsUCS2(database) + "\x00"
+	return "\xe3" + tdsLE(uint64(len(body)), 2) + body
+}
+
+//tdsLogin LOGIN7消息，只填写应用名称与数据库
+func tdsLogin(app, database string) string {
+	p := make([]byte, 94)
+	binary.LittleEndian.PutUint32(p[4:], 0x74000004)
+	binary.LittleEndian.PutUint16(p[48:], 94)
+	binary.LittleEndian.PutUint16(p[50:], uint16(len(app)))
+	binary.LittleEndian.PutUint16(p[68:], uint16(94+len(app)*2))
+	binary.LittleEndian.PutUint16(p[70:], uint16(len(database)))
+	p = append(p, tdsUCS2(app)+tdsUCS2(database)...)
+	binary.LittleEndian.PutUint32(p, uint32(len(p)))
+	return string(p)
+}
+
+//tdsNVarChar RPC的NVARCHAR参数
+func tdsNVarChar(value string) string {
+	return "\x00\x00\xe7\x40\x1f\x09\x04\xd0\x00\x34" + tdsLE(uint64(len(value)*2), 2) + tdsUCS2(value)
+}
+
+func TestMSSQLDecode(t *testing.T) {
+	batch := func(query string) streamSegment {
+		return streamSegment{true, tdsPacket(tdsSQLBatch, true, tdsHeaders+tdsUCS2(query))}
+	}
+	res := func(tokens ...string) streamSegment {
+		var p string
+		for _, t := range tokens {
+			p += t
+		}
+		return streamSegment{false, tdsPacket(tdsResponse, true, p)}
+	}
+	longQuery := tdsHeaders + tdsUCS2("SELECT * FROM orders WHERE customer = 'acme'")
+	runStreamTests(t, func() streamParser {
+		return &MSSQLDecode{databases: newLabelFolder(maxTDSDatabases), apps: newLabelFolder(maxTDSApps)}
+	}, []streamTest{
+		{
+			name: "login and batch",
+			segments: []streamSegment{
+				{true, tdsPacket(tdsLogin7, true, tdsLogin("billing-api", "shop"))},
+				res(tdsDatabaseChange("shop"), tdsDone(0, 0)),
+				batch("SELECT * FROM orders WHERE id = 42"),
+				//列信息无法解析时从最后的DONE令牌读取行数
+				res("\x81\x01\x00\x00\x00\x00\x00\x26\x04\x00\xd1\x26\x04\x07\x00\x00\x00", tdsDone(tdsDoneCount, 1)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "Login", Resource: "shop", Key: "Login billing-api", RequestLength: 132},
+				{Command: "SQLBatch", Resource: "shop", Key: "SELECT * FROM orders WHERE id = ?", RequestLength: 98, ResponseLength: 38,
+					Counters: map[string]uint64{"rows": 1}},
+			},
+		},
+		{
+			name: "errors",
+			segments: []streamSegment{
+				batch("SELEC 1"), res(tdsErrorToken(102, 15, "Incorrect syntax near 'SELEC'."), tdsDone(tdsDoneError, 0)),
+				batch("RAISERROR"), res(tdsDone(tdsDoneError, 0)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "SQLBatch", Key: "SELEC ?", Code: "102", Counters: map[string]uint64{"errors.severity.15": 1}},
+				{Command: "SQLBatch", Key: "RAISERROR", Code: "Error"},
+			},
+		},
+		{
+			name: "use database",
+			segments: []streamSegment{
+				batch("USE archive"), res(tdsDatabaseChange("archive"), tdsDone(0, 0)),
+				batch("DELETE FROM orders"), res(tdsDone(tdsDoneCount, 12)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "SQLBatch", Resource: "archive", Key: "USE archive"},
+				{Command: "SQLBatch", Resource: "archive", Key: "DELETE FROM orders", Counters: map[string]uint64{"rows": 12}},
+			},
+		},
+		{
+			name: "rpc",
+			segments: []streamSegment{
+				{true, tdsPacket(tdsRPC, true, tdsHeaders+"\xff\xff\x0a\x00\x00\x00"+
+					tdsNVarChar("SELECT name FROM users WHERE id = @p0")+tdsNVarChar("@p0 int"))},
+				res(tdsDone(tdsDoneCount, 1)),
+				{true, tdsPacket(tdsRPC, true, tdsHeaders+"\x0d\x00"+tdsUCS2("dbo.GetOrders")+"\x00\x00")},
+				res(tdsDone(0, 0)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "RPC", Key: "SELECT name FROM users WHERE id = @p0", Counters: map[string]uint64{"rows": 1}},
+				{Command: "RPC", Key: "EXEC dbo.GetOrders"},
+			},
+		},
+		{
+			name: "multiple packets",
+			segments: []streamSegment{
+				{true, tdsPacket(tdsSQLBatch, false, longQuery[:40])}, {true, tdsPacket(tdsSQLBatch, true, longQuery[40:])},
+				res(tdsDone(tdsDoneCount, 3)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "SQLBatch", Key: "SELECT * FROM orders WHERE customer = ?", RequestLength: 126, Counters: map[string]uint64{"rows": 3}},
+			},
+		},
+		{
+			name:     "attention",
+			segments: []streamSegment{batch("WAITFOR DELAY '01:00'"), {true, tdsPacket(tdsAttention, true, "")}, res(tdsDone(0x20, 0))},
+			want:     []metric.ProtocolMessage{{Command: "SQLBatch", Key: "WAITFOR DELAY ?", Code: "ATTENTION"}},
+		},
+		{
+			name: "encrypted",
+			segments: []streamSegment{
+				{true, tdsPacket(tdsPrelogin, true, "\x00\x00\x0b\x00\x06\x01\x00\x11\x00\x01\xff\x0f\x00\x07\xd0\x00\x00\x00")},
+				res("\x00\x00\x0b\x00\x06\x01\x00\x11\x00\x01\xff\x0f\x00\x07\xd0\x00\x00\x01"),
+				{true, []byte("\x17\x03\x03\x00\x04abcd")},
+			},
+			want: []metric.ProtocolMessage{{Command: "Prelogin", Counters: map[string]uint64{"connections.encrypted": 1}}},
+		},
+		{
+			name:     "timeout",
+			segments: []streamSegment{batch("SELECT 1")},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "SQLBatch", Key: "SELECT ?", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "not mssql",
+			segments: []streamSegment{{true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")}},
+		},
+	})
+}
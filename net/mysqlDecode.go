@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"tcm/config"
 	"tcm/metric"
 	"time"
@@ -48,7 +49,10 @@ const (
 	COLOR_DEFAULT = "\x1b[39m"
 
 	// MySQL packet types
-	COM_QUERY = 3
+	COM_QUIT                = 1
+	COM_QUERY               = 3
+	COM_STMT_SEND_LONG_DATA = 24
+	COM_STMT_CLOSE          = 25
 
 	// These are used for formatting outputs
 	F_NONE = iota
@@ -74,6 +78,8 @@ type source struct {
 	qbytes    uint64
 	qdata     *queryData
 	qtext     string
+	//客户端地址，经过PROXY协议时为真实客户端
+	client string
 }
 
 type queryData struct {
@@ -96,6 +102,9 @@ type MysqlDecode struct {
 	format           []interface{}
 	mysqlMetricStore metric.Store
 	port             config.Port
+	//查询超过该时间没有响应时统计为超时
+	timeout time.Duration
+	lock    sync.Mutex
 }
 
 //CreateMysqlDecode CreateMysqlDecode
@@ -111,12 +120,37 @@ func CreateMysqlDecode(option *config.Option, port config.Port) *MysqlDecode {
 		chmap:            make(map[string]*source),
 		mysqlMetricStore: ms,
 		port:             port,
+		timeout:          option.RequestTimeout,
+	}
+	if port.RequestTimeout > 0 {
+		m.timeout = time.Duration(port.RequestTimeout) * time.Second
+	}
+	if m.timeout <= 0 {
+		m.timeout = 10 * time.Second
 	}
 	m.parseFormat("#s/#q")
 	rand.Seed(time.Now().UnixNano())
+	go m.run(option.Close)
 	return &m
 }
 
+// run checks for timed out queries every second, so a hung server is reported
+// even when no more packets arrive on the port.
+func (h *MysqlDecode) run(close chan struct{}) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-close:
+			return
+		case now := <-tick.C:
+			h.lock.Lock()
+			h.sweep(now)
+			h.lock.Unlock()
+		}
+	}
+}
+
 //Decode 解码
 func (h *MysqlDecode) Decode(data *SourceData) {
 	if data.TCP == nil {
@@ -127,6 +161,8 @@ func (h *MysqlDecode) Decode(data *SourceData) {
 		log.Errorln("TCP SrcPort is empty, so it may be is not http")
 		return
 	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	// This is either an inbound or outbound packet. Determine by seeing which
 	// end contains our port. Either way, we want to put this on the channel of
 	// the remote end.
@@ -141,12 +177,27 @@ func (h *MysqlDecode) Decode(data *SourceData) {
 		//log.Printf("request from %s", src)
 	}
 
+	// A FIN or RST without payload closes the connection, a query still waiting
+	// for its response is reported as aborted.
+	if len(data.Source) == 0 {
+		if rs, ok := h.chmap[src]; ok && (data.TCP.FIN || data.TCP.RST) {
+			if rs.reqSent != nil {
+				h.inputQuery(rs, "Aborted", 0)
+			}
+			delete(h.chmap, src)
+		}
+		return
+	}
+
 	// Get the data structure for this source, then do something.
 	rs, ok := h.chmap[src]
 	if !ok {
-		rs = &source{src: src, srcip: data.SourceHost.String(), synced: false}
+		rs = &source{src: src, client: src, srcip: data.SourceHost.String(), synced: false}
 		h.chmap[src] = rs
 	}
+	if data.ProxyClient != nil {
+		rs.client, rs.srcip = data.ProxyClient.String(), data.ProxyClient.Host
+	}
 	//fmt.Println(data.Source)
 	// Now with a source, process the packet.
 	h.processPacket(rs, request, data.Source)
@@ -234,15 +285,7 @@ func (h *MysqlDecode) processPacket(rs *source, request bool, data []byte) {
 				code = "EOF"
 			}
 		}
-		sqlinfo := strings.SplitN(rs.qtext, "/", 2)
-		var mm = &metric.MysqlMessage{
-			Code:          code,
-			SQL:           sqlinfo[1],
-			RemoteAddr:    sqlinfo[0],
-			Reqtime:       reqtime,
-			ContentLength: rs.qdata.bytes,
-		}
-		h.mysqlMetricStore.Input(mm)
+		h.inputQuery(rs, code, reqtime)
 		return
 	}
 
@@ -251,6 +294,12 @@ func (h *MysqlDecode) processPacket(rs *source, request bool, data []byte) {
 		//			log.Printf("[%s] ...sending two requests without a response?",
 		//				rs.src)
 	}
+	// The server sends nothing back for these commands, waiting for a response
+	// would report a closed statement as a timeout and a quit as aborted.
+	if ptype == COM_QUIT || ptype == COM_STMT_SEND_LONG_DATA || ptype == COM_STMT_CLOSE {
+		rs.reqSent = nil
+		return
+	}
 	tnow := time.Now()
 	rs.reqSent = &tnow
 
@@ -268,7 +317,7 @@ func (h *MysqlDecode) processPacket(rs *source, request bool, data []byte) {
 				if dirty {
 					text += string(pdata)
 				} else {
-					text += h.cleanupQuery(pdata)
+					text += cleanupQuery(pdata)
 				}
 			case F_ROUTE:
 				// Routes are in the query like:
@@ -282,10 +331,10 @@ func (h *MysqlDecode) processPacket(rs *source, request bool, data []byte) {
 						text += parts[2]
 					}
 				} else {
-					text += "(unknown) " + h.cleanupQuery(pdata)
+					text += "(unknown) " + cleanupQuery(pdata)
 				}
 			case F_SOURCE:
-				text += rs.src
+				text += rs.client
 			case F_SOURCEIP:
 				text += rs.srcip
 			default:
@@ -308,6 +357,32 @@ func (h *MysqlDecode) processPacket(rs *source, request bool, data []byte) {
 	rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
 }
 
+// inputQuery sends the current query of the source to the metric store.
+func (h *MysqlDecode) inputQuery(rs *source, code string, reqtime uint64) {
+	sqlinfo := strings.SplitN(rs.qtext, "/", 2)
+	if len(sqlinfo) < 2 || rs.qdata == nil {
+		return
+	}
+	var mm = &metric.MysqlMessage{
+		Code:          code,
+		SQL:           sqlinfo[1],
+		RemoteAddr:    sqlinfo[0],
+		Reqtime:       reqtime,
+		ContentLength: rs.qdata.bytes,
+	}
+	h.mysqlMetricStore.Input(mm)
+}
+
+// sweep reports queries that got no response before the deadline as timeouts.
+func (h *MysqlDecode) sweep(now time.Time) {
+	for _, rs := range h.chmap {
+		if rs.reqSent != nil && now.Sub(*rs.reqSent) > h.timeout {
+			h.inputQuery(rs, "Timeout", 0)
+			rs.reqSent = nil
+		}
+	}
+}
+
 // carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
 // those bytes from the slice.
 func (h *MysqlDecode) carvePacket(buf *[]byte) (int, []byte) {
@@ -340,7 +415,7 @@ func (h *MysqlDecode) carvePacket(buf *[]byte) (int, []byte) {
 // scans forward in the query given the current type and returns when we encounter
 // a new type and need to stop scanning.  returns the size of the last token and
 // the type of it.
-func (h *MysqlDecode) scanToken(query []byte) (length int, thistype int) {
+func scanToken(query []byte) (length int, thistype int) {
 	if len(query) < 1 {
 		log.Fatalf("scanToken called with empty query")
 	}
@@ -413,11 +488,14 @@ func (h *MysqlDecode) scanToken(query []byte) (length int, thistype int) {
 	}
 }
 
-func (h *MysqlDecode) cleanupQuery(query []byte) string {
+// cleanupQuery replaces numbers and quoted strings in a statement with ? so the
+// same statement with different values is counted together. It is shared by the
+// decoders of other SQL-like protocols.
+func cleanupQuery(query []byte) string {
 	// iterate until we hit the end of the query...
 	var qspace []string
 	for i := 0; i < len(query); {
-		length, toktype := h.scanToken(query[i:])
+		length, toktype := scanToken(query[i:])
 
 		switch toktype {
 		case TOKEN_WORD, TOKEN_OTHER:
@@ -0,0 +1,262 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	//maxNATSLine 协议行的最大长度，INFO与CONNECT的JSON较长
+	maxNATSLine = 64 * 1024
+	//maxNATSSubjects 统计的最大subject数量，超出后归入other
+	maxNATSSubjects = 500
+	//maxNATSClients 按客户端统计错误的最大客户端数量
+	maxNATSClients = 200
+	//natsInbox 请求响应模式中响应的subject前缀
+	natsInbox = "_INBOX."
+)
+
+//等待响应的操作在请求表中的key，高位区分类型，低位为响应subject的hash
+const (
+	natsKeyConnect = 1 << 60
+	natsKeyRequest = 2 << 60
+	natsKeyRespond = 3 << 60
+	natsKeyMask    = 1<<60 - 1
+)
+
+//natsConn 连接的客户端名称
+type natsConn struct {
+	client string
+}
+
+//NATSDecode NATS文本协议解码
+type NATSDecode struct {
+	*tcpStream
+	normalizer *PathNormalizer
+	subjects   *labelFolder
+	clients    *labelFolder
+}
+
+//CreateNATSDecode CreateNATSDecode
+func CreateNATSDecode(option *config.Option, port config.Port) *NATSDecode {
+	d := &NATSDecode{
+		normalizer: NewPathNormalizer(port.Routes),
+		subjects:   newLabelFolder(maxNATSSubjects),
+		clients:    newLabelFolder(maxNATSClients),
+	}
+	d.tcpStream = newTCPStream("nats", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+func (d *NATSDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	i := bytes.Index(buf, []byte("\r\n"))
+	if i < 0 {
+		if len(buf) > maxNATSLine {
+			return -1, 0
+		}
+		return 0, 0
+	}
+	fields := strings.Fields(string(buf[:i]))
+	if len(fields) == 0 {
+		return -1, 0
+	}
+	total = i + 2
+	switch strings.ToUpper(fields[0]) {
+	case "PUB", "HPUB", "MSG", "HMSG":
+		//消息内容只统计长度
+		n, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || n < 0 {
+			return -1, 0
+		}
+		return total + n + 2, total
+	case "PING", "PONG":
+	case "CONNECT", "SUB", "UNSUB":
+		if !request {
+			return -1, 0
+		}
+	case "INFO", "+OK", "-ERR":
+		if request {
+			return -1, 0
+		}
+	default:
+		return -1, 0
+	}
+	return total, total
+}
+
+func (d *NATSDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	if c.state == nil {
+		c.state = &natsConn{client: d.clients.fold(c.client)}
+	}
+	nc := c.state.(*natsConn)
+	line := string(frame[:bytes.Index(frame, []byte("\r\n"))])
+	fields := strings.Fields(line)
+	op := strings.ToUpper(fields[0])
+	if !request && op != "INFO" && op != "-ERR" {
+		//服务端的第一个响应(通常是CONNECT之后PING的PONG)表示连接已被接受
+		if call := c.reply(natsKeyConnect); call != nil {
+			d.finish(s, c, call)
+		}
+	}
+	switch op {
+	case "CONNECT":
+		var opts struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(line[len(fields[0]):])), &opts) == nil && opts.Name != "" {
+			nc.client = d.clients.fold(opts.Name)
+		}
+		c.call(natsKeyConnect, d.message(c, "CONNECT", "", uint64(total)))
+	case "PUB", "HPUB":
+		//PUB <subject> [reply-to] <#bytes>，HPUB <subject> [reply-to] <#header bytes> <#total bytes>
+		subject, reply := fields[1], ""
+		if n := len(fields); (op == "PUB" && n == 4) || (op == "HPUB" && n == 5) {
+			reply = fields[2]
+		}
+		d.publish(s, c, "PUB", subject, reply, fields[len(fields)-1])
+		//订阅方回复请求
+		if strings.HasPrefix(subject, natsInbox) {
+			if call := c.reply(natsKeyRespond | natsHash(subject)); call != nil {
+				d.finish(s, c, call)
+			}
+		}
+	case "MSG", "HMSG":
+		//MSG <subject> <sid> [reply-to] <#bytes>，HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+		subject, reply := fields[1], ""
+		if n := len(fields); (op == "MSG" && n == 5) || (op == "HMSG" && n == 6) {
+			reply = fields[3]
+		}
+		d.publish(s, c, "MSG", subject, reply, fields[len(fields)-1])
+		//请求方收到响应
+		if strings.HasPrefix(subject, natsInbox) {
+			if call := c.reply(natsKeyRequest | natsHash(subject)); call != nil {
+				d.finish(s, c, call)
+			}
+		}
+	case "SUB":
+		if len(fields) >= 3 {
+			s.store.Input(d.message(c, "SUB", d.subject(fields[1]), 0))
+		}
+	case "UNSUB":
+		s.store.Input(d.message(c, "UNSUB", "", 0))
+	case "PING":
+		//只统计客户端发起的PING，服务端的PING不需要统计
+		if request {
+			c.push(d.message(c, "PING", "", 0))
+		}
+	case "PONG":
+		if !request {
+			if call := c.pop(); call != nil {
+				d.finish(s, c, call)
+			}
+		}
+	case "-ERR":
+		d.serverError(s, c, nc, strings.TrimSpace(line[len(fields[0]):]))
+	}
+}
+
+//publish 统计发布与投递的消息，响应subject为_INBOX时等待响应
+func (d *NATSDecode) publish(s *tcpStream, c *streamConn, command, subject, reply, size string) {
+	n, _ := strconv.Atoi(size)
+	msg := d.message(c, command, d.subject(subject), uint64(n))
+	msg.Counters = map[string]uint64{strings.ToLower(command) + ".bytes": uint64(n)}
+	s.store.Input(msg)
+	if !strings.HasPrefix(reply, natsInbox) {
+		return
+	}
+	if command == "PUB" {
+		c.call(natsKeyRequest|natsHash(reply), d.message(c, "REQUEST", msg.Resource, 0))
+	} else {
+		c.call(natsKeyRespond|natsHash(reply), d.message(c, "RESPOND", msg.Resource, 0))
+	}
+}
+
+//serverError 服务端返回的错误按客户端统计，连接建立过程中的错误(如认证失败)作为CONNECT的结果
+func (d *NATSDecode) serverError(s *tcpStream, c *streamConn, nc *natsConn, text string) {
+	code := natsErrorCode(text)
+	client := metric.StatsdName(nc.client)
+	counters := map[string]uint64{"client." + client + ".errors": 1}
+	if code == "SLOW_CONSUMER" {
+		counters["slowconsumers"] = 1
+		counters["client."+client+".slowconsumers"] = 1
+	}
+	if call := c.reply(natsKeyConnect); call != nil {
+		msg := call.value.(*metric.ProtocolMessage)
+		msg.Code = code
+		msg.Counters = counters
+		d.finish(s, c, call)
+		return
+	}
+	msg := d.message(c, "ERR", "", 0)
+	msg.Code = code
+	msg.Counters = counters
+	s.store.Input(msg)
+}
+
+func (d *NATSDecode) finish(s *tcpStream, c *streamConn, call *streamCall) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.ReqTime = c.elapsed(call)
+	s.store.Input(msg)
+}
+
+func (d *NATSDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+func (d *NATSDecode) message(c *streamConn, command, resource string, length uint64) *metric.ProtocolMessage {
+	return &metric.ProtocolMessage{Command: command, Resource: resource, RemoteAddr: c.client, RequestLength: length}
+}
+
+//subject 规范化subject，ID类的层级替换为 *，响应subject统一为 _INBOX.>
+func (d *NATSDecode) subject(subject string) string {
+	if strings.HasPrefix(subject, natsInbox) {
+		return natsInbox + ">"
+	}
+	return d.subjects.fold(d.normalizer.NormalizeTopic(subject, ".", "*"))
+}
+
+//natsHash 响应subject在请求表中的key
+func natsHash(subject string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(subject))
+	return h.Sum64() & natsKeyMask
+}
+
+//natsErrorCode 错误信息转换为错误码，如 'Permissions Violation for Publish to "foo"' 为 PERMISSIONS_VIOLATION
+func natsErrorCode(text string) string {
+	text = strings.Trim(text, "'")
+	for _, sep := range []string{" for ", " to ", ":"} {
+		if i := strings.Index(text, sep); i > 0 {
+			text = text[:i]
+		}
+	}
+	return strings.ToUpper(strings.Join(strings.Fields(text), "_"))
+}
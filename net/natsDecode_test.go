@@ -0,0 +1,103 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"tcm/metric"
+	"testing"
+)
+
+func TestNATSDecode(t *testing.T) {
+	req := func(s string) streamSegment { return streamSegment{true, []byte(s)} }
+	res := func(s string) streamSegment { return streamSegment{false, []byte(s)} }
+	info := res("INFO {\"server_id\":\"N1\",\"max_payload\":1048576}\r\n")
+	connect := req("CONNECT {\"verbose\":false,\"name\":\"billing\"}\r\n")
+	runStreamTests(t, func() streamParser {
+		return &NATSDecode{normalizer: NewPathNormalizer(nil), subjects: newLabelFolder(maxNATSSubjects), clients: newLabelFolder(maxNATSClients)}
+	}, []streamTest{
+		{
+			name:     "connect",
+			segments: []streamSegment{info, connect, req("PING\r\n"), res("PONG\r\n")},
+			want:     []metric.ProtocolMessage{{Command: "CONNECT", RequestLength: 44}, {Command: "PING"}},
+		},
+		{
+			name:     "authorization violation",
+			segments: []streamSegment{info, connect, res("-ERR 'Authorization Violation'\r\n")},
+			want: []metric.ProtocolMessage{{Command: "CONNECT", Code: "AUTHORIZATION_VIOLATION",
+				Counters: map[string]uint64{"client.billing.errors": 1}}},
+		},
+		{
+			name: "publish and deliver",
+			segments: []streamSegment{
+				req("SUB orders.> 1\r\n"), req("PUB orders.1234.created 5\r\nhello\r\n"),
+				res("MSG orders.1234.created 1 5\r\nhello\r\n"), req("UNSUB 1\r\n"),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "SUB", Resource: "orders.>"},
+				{Command: "PUB", Resource: "orders.*.created", RequestLength: 5, Counters: map[string]uint64{"pub.bytes": 5}},
+				{Command: "MSG", Resource: "orders.*.created", RequestLength: 5, Counters: map[string]uint64{"msg.bytes": 5}},
+				{Command: "UNSUB"},
+			},
+		},
+		{
+			name: "request",
+			segments: []streamSegment{
+				req("HPUB time.now _INBOX.k2.1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"), res("MSG _INBOX.k2.1 9 3\r\nnow\r\n"),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "PUB", Resource: "time.now", Counters: map[string]uint64{"pub.bytes": 14}},
+				{Command: "MSG", Resource: "_INBOX.>", Counters: map[string]uint64{"msg.bytes": 3}},
+				{Command: "REQUEST", Resource: "time.now"},
+			},
+		},
+		{
+			name:     "respond",
+			segments: []streamSegment{res("MSG time.now 9 _INBOX.k2.2 0\r\n\r\n"), req("PUB _INBOX.k2.2 3\r\nnow\r\n")},
+			want: []metric.ProtocolMessage{
+				{Command: "MSG", Resource: "time.now"},
+				{Command: "PUB", Resource: "_INBOX.>"},
+				{Command: "RESPOND", Resource: "time.now"},
+			},
+		},
+		{
+			name:     "request timeout",
+			segments: []streamSegment{req("PUB time.now _INBOX.k2.3 0\r\n\r\n")},
+			sweep:    true,
+			want: []metric.ProtocolMessage{
+				{Command: "PUB", Resource: "time.now"},
+				{Command: "REQUEST", Resource: "time.now", Result: metric.ResultTimeout},
+			},
+		},
+		{
+			name:     "slow consumer",
+			segments: []streamSegment{res("-ERR 'Slow Consumer'\r\n")},
+			want: []metric.ProtocolMessage{{Command: "ERR", Code: "SLOW_CONSUMER",
+				Counters: map[string]uint64{"slowconsumers": 1, "client.10_0_0_2.errors": 1}}},
+		},
+		{
+			name:     "permissions violation",
+			segments: []streamSegment{res("-ERR 'Permissions Violation for Publish to \"secret\"'\r\n")},
+			want:     []metric.ProtocolMessage{{Command: "ERR", Code: "PERMISSIONS_VIOLATION"}},
+		},
+		{
+			name:     "not nats",
+			segments: []streamSegment{req("GET / HTTP/1.1\r\n\r\n")},
+		},
+	})
+}
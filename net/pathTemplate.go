@@ -0,0 +1,227 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"tcm/config"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	//同一位置出现超过该数量的不同路径段时，该位置合并为变量
+	learnLimit = 50
+	//模版树的最大节点数量
+	maxTemplateNodes = 10000
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+//PathNormalizer 将请求地址归并为地址模版，控制统计的地址数量
+type PathNormalizer struct {
+	routes []*route
+	root   *pathNode
+	nodes  int
+	lock   sync.Mutex
+}
+
+type route struct {
+	name     string
+	regex    *regexp.Regexp
+	segments []string
+}
+
+type pathNode struct {
+	children map[string]*pathNode
+	//合并后所有的路径段都进入该节点
+	wildcard *pathNode
+}
+
+//NewPathNormalizer 创建地址模版识别器，routes为用户定义的模版
+func NewPathNormalizer(routes []config.Route) *PathNormalizer {
+	p := &PathNormalizer{root: &pathNode{}}
+	for _, r := range routes {
+		rt := &route{name: r.Name}
+		if strings.HasPrefix(r.Pattern, "~") {
+			reg, err := regexp.Compile(strings.TrimPrefix(r.Pattern, "~"))
+			if err != nil {
+				log.Errorf("route pattern %s is invalid,%s", r.Pattern, err.Error())
+				continue
+			}
+			rt.regex = reg
+		} else {
+			rt.segments = splitPath(r.Pattern)
+		}
+		if rt.name == "" {
+			rt.name = r.Pattern
+		}
+		p.routes = append(p.routes, rt)
+	}
+	return p
+}
+
+//Normalize 返回地址对应的模版
+func (p *PathNormalizer) Normalize(path string) string {
+	for _, r := range p.routes {
+		if r.match(path) {
+			return r.name
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	segments := splitPath(path)
+	node := p.root
+	for i, seg := range segments {
+		if v := classifySegment(seg); v != "" {
+			seg = v
+		}
+		switch {
+		case node.wildcard != nil:
+			seg = "{var}"
+			node = node.wildcard
+		case node.children[seg] != nil:
+			node = node.children[seg]
+		case len(node.children) >= learnLimit || p.nodes >= maxTemplateNodes:
+			//该位置的取值过多，合并为变量
+			for _, c := range node.children {
+				p.nodes -= c.size()
+			}
+			node.children = nil
+			node.wildcard = &pathNode{}
+			p.nodes++
+			seg = "{var}"
+			node = node.wildcard
+		default:
+			if node.children == nil {
+				node.children = make(map[string]*pathNode)
+			}
+			c := &pathNode{}
+			node.children[seg] = c
+			p.nodes++
+			node = c
+		}
+		segments[i] = seg
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+//NormalizeTopic 按同样的规则归并消息主题，sep为主题的层级分隔符，ID类的层级替换为wildcard；
+//匹配routes时主题的层级按 / 分隔
+func (p *PathNormalizer) NormalizeTopic(topic, sep, wildcard string) string {
+	n := p.Normalize("/" + strings.Join(strings.Split(strings.TrimPrefix(topic, sep), sep), "/"))
+	if !strings.HasPrefix(n, "/") {
+		//routes的名称
+		return n
+	}
+	levels := strings.Split(n[1:], "/")
+	for i, l := range levels {
+		if strings.HasPrefix(l, "{") && strings.HasSuffix(l, "}") {
+			levels[i] = wildcard
+		}
+	}
+	n = strings.Join(levels, sep)
+	if strings.HasPrefix(topic, sep) {
+		n = sep + n
+	}
+	return n
+}
+
+func (n *pathNode) size() int {
+	s := 1
+	for _, c := range n.children {
+		s += c.size()
+	}
+	if n.wildcard != nil {
+		s += n.wildcard.size()
+	}
+	return s
+}
+
+func (r *route) match(path string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(path)
+	}
+	segments := splitPath(path)
+	for i, s := range r.segments {
+		if s == "*" && i == len(r.segments)-1 {
+			return len(segments) >= i
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			continue
+		}
+		if s != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(r.segments)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+//classifySegment 识别数字、UUID、哈希值与ID类的路径段
+func classifySegment(seg string) string {
+	if seg == "" {
+		return ""
+	}
+	var digits, letters, hex, dots int
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			hex++
+		case (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F'):
+			letters++
+			hex++
+		case (c >= 'g' && c <= 'z') || (c >= 'G' && c <= 'Z'):
+			letters++
+		case c == '.':
+			dots++
+		case c == '-' || c == '_' || c == '~':
+		default:
+			return ""
+		}
+	}
+	switch {
+	case digits == len(seg):
+		return "{num}"
+	case len(seg) == 36 && uuidRegexp.MatchString(seg):
+		return "{uuid}"
+	case dots > 0:
+		//文件名保持原样
+		return ""
+	case hex == len(seg) && len(seg) >= 16:
+		return "{hash}"
+	case len(seg) >= 10 && digits > 0 && letters > 0:
+		return "{id}"
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"strconv"
+	"tcm/config"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	p := NewPathNormalizer([]config.Route{
+		{Name: "orders", Pattern: "/api/{version}/orders/*"},
+		{Pattern: "~^/static/.*\\.js$"},
+		{Pattern: "/health"},
+	})
+	tests := []struct {
+		path, want string
+	}{
+		{"/api/v1/orders", "orders"},
+		{"/api/v2/orders/12/items", "orders"},
+		{"/static/js/app.3f2a1c.js", "~^/static/.*\\.js$"},
+		{"/health", "/health"},
+		{"/health/deep", "/health/deep"},
+		{"/", "/"},
+		{"/users/12345", "/users/{num}"},
+		{"/users/12345/", "/users/{num}"},
+		{"/users/0b9e6c2a-4f8d-4b71-9b0e-6c1d2f3a4b5c/avatar", "/users/{uuid}/avatar"},
+		{"/blobs/9f86d081884c7d659a2feaa0c55ad015", "/blobs/{hash}"},
+		{"/orders/ORD20261018X7", "/orders/{id}"},
+		{"/download/report-2026.pdf", "/download/report-2026.pdf"},
+		{"/users/profile", "/users/profile"},
+		{"/search/%E4%B8%AD", "/search/%E4%B8%AD"},
+	}
+	for _, test := range tests {
+		if got := p.Normalize(test.path); got != test.want {
+			t.Errorf("normalize %s got %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestNormalizePathLearnLimit(t *testing.T) {
+	p := NewPathNormalizer(nil)
+	for i := 0; i < learnLimit; i++ {
+		name := "user" + strconv.Itoa(i)
+		if got := p.Normalize("/profiles/" + name + "/posts"); got != "/profiles/"+name+"/posts" {
+			t.Fatalf("path %d got %s", i, got)
+		}
+	}
+	//超过learnLimit个不同的路径段后该位置合并为变量，之前学习的路径段也合并
+	for _, path := range []string{"/profiles/another/posts", "/profiles/user1/posts"} {
+		if got := p.Normalize(path); got != "/profiles/{var}/posts" {
+			t.Errorf("normalize %s got %s", path, got)
+		}
+	}
+	if got := p.Normalize("/profiles"); got != "/profiles" {
+		t.Errorf("normalize parent got %s", got)
+	}
+	if p.nodes != 3 {
+		t.Errorf("template tree has %d nodes", p.nodes)
+	}
+}
@@ -34,6 +34,7 @@ type Util struct {
 	Option *config.Option
 	Port   config.Port
 	Decode Decode
+	proxy  *proxyTracker
 }
 
 //CreateUtil 创建抓包器
@@ -42,6 +43,7 @@ func CreateUtil(Port config.Port, Decode Decode, Option *config.Option) *Util {
 		Option: Option,
 		Port:   Port,
 		Decode: Decode,
+		proxy:  newProxyTracker(),
 	}
 }
 
@@ -81,14 +83,17 @@ func (n *Util) Pcap() int {
 
 func (n *Util) handlePacket(packet gopacket.Packet) {
 	app := packet.ApplicationLayer()
-	if app != nil {
+	//没有负载的FIN、RST包也交给解码器，用于判断连接结束
+	if app != nil || isTCPClose(packet.TransportLayer()) {
 		//log.With("type", app.LayerType().String()).Infoln("Receive a application layer packet")
 		//log.Infoln(packet.String())
 		//fmt.Println(app.Payload())
 		sd := &SourceData{
-			Source:      app.Payload(),
 			ReceiveDate: packet.Metadata().Timestamp,
 		}
+		if app != nil {
+			sd.Source = app.Payload()
+		}
 		tran := packet.TransportLayer()
 		if tran != nil {
 			src, dst := tran.TransportFlow().Endpoints()
@@ -110,6 +115,24 @@ func (n *Util) handlePacket(packet gopacket.Packet) {
 			sd.SourceHost = &src
 			sd.TargetHost = &dst
 		}
+		if sd.TCP != nil && sd.SourceHost != nil && sd.TargetHost != nil {
+			//去除PROXY协议头，按客户端一侧的地址记录连接
+			if int(sd.TCP.SrcPort) == n.Port.Port {
+				n.proxy.handle(sd, false, sd.TargetHost.String()+":"+sd.TargetPoint.String())
+			} else {
+				n.proxy.handle(sd, true, sd.SourceHost.String()+":"+sd.SourcePoint.String())
+			}
+			if len(sd.Source) == 0 && !sd.TCP.FIN && !sd.TCP.RST {
+				return
+			}
+		}
 		n.Decode.Decode(sd)
 	}
 }
+
+func isTCPClose(tran gopacket.TransportLayer) bool {
+	if tcp, ok := tran.(*layers.TCP); ok {
+		return tcp.FIN || tcp.RST
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sign    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyIdleLimit = 10 * time.Minute
+)
+
+//ProxyAddr PROXY协议头中记录的真实客户端地址
+type ProxyAddr struct {
+	Host string
+	Port string
+}
+
+//String host:port
+func (p *ProxyAddr) String() string {
+	return net.JoinHostPort(p.Host, p.Port)
+}
+
+//proxyTracker 识别并去除连接开始的PROXY协议头，记录每个连接的真实客户端地址
+type proxyTracker struct {
+	lock  sync.Mutex
+	conns map[string]*proxyConn
+	last  time.Time
+}
+
+type proxyConn struct {
+	addr     *ProxyAddr
+	lastSeen time.Time
+}
+
+func newProxyTracker() *proxyTracker {
+	return &proxyTracker{conns: make(map[string]*proxyConn)}
+}
+
+//handle 处理一个报文，request表示由客户端发往服务端，conn为客户端的网络地址
+func (p *proxyTracker) handle(data *SourceData, request bool, conn string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := data.ReceiveDate
+	c, ok := p.conns[conn]
+	if !ok && request {
+		if addr, n := parseProxyHeader(data.Source); n > 0 {
+			data.Source = data.Source[n:]
+			if addr != nil {
+				c = &proxyConn{addr: addr}
+				p.conns[conn] = c
+				ok = true
+			}
+		}
+	}
+	if ok {
+		c.lastSeen = now
+		data.ProxyClient = c.addr
+		if data.TCP != nil && (data.TCP.FIN || data.TCP.RST) {
+			delete(p.conns, conn)
+		}
+	}
+	if now.Sub(p.last) > time.Minute {
+		p.last = now
+		for k, v := range p.conns {
+			if now.Sub(v.lastSeen) > proxyIdleLimit {
+				delete(p.conns, k)
+			}
+		}
+	}
+}
+
+//parseProxyHeader 解析PROXY协议头，返回客户端地址与协议头长度
+//不是PROXY协议头时长度为0，LOCAL、UNKNOWN类型时地址为空
+func parseProxyHeader(data []byte) (*ProxyAddr, int) {
+	switch {
+	case bytes.HasPrefix(data, proxyV1Prefix):
+		return parseProxyV1(data)
+	case bytes.HasPrefix(data, proxyV2Sign):
+		return parseProxyV2(data)
+	}
+	return nil, 0
+}
+
+//parseProxyV1 PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1(data []byte) (*ProxyAddr, int) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 || end > 107 {
+		return nil, 0
+	}
+	fields := strings.Fields(string(data[:end]))
+	if len(fields) < 2 {
+		return nil, 0
+	}
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, end + 2
+	}
+	if len(fields) != 6 || net.ParseIP(fields[2]) == nil {
+		return nil, 0
+	}
+	if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+		return nil, 0
+	}
+	return &ProxyAddr{Host: fields[2], Port: fields[4]}, end + 2
+}
+
+func parseProxyV2(data []byte) (*ProxyAddr, int) {
+	if len(data) < 16 {
+		return nil, 0
+	}
+	verCmd, family := data[12], data[13]
+	if verCmd>>4 != 2 {
+		return nil, 0
+	}
+	n := 16 + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < n {
+		return nil, 0
+	}
+	//LOCAL命令为代理自身的健康检查等连接
+	if verCmd&0x0F != 1 {
+		return nil, n
+	}
+	addr := data[16:n]
+	switch family >> 4 {
+	case 1: //AF_INET
+		if len(addr) < 12 {
+			return nil, n
+		}
+		return &ProxyAddr{
+			Host: net.IP(addr[0:4]).String(),
+			Port: strconv.Itoa(int(binary.BigEndian.Uint16(addr[8:10]))),
+		}, n
+	case 2: //AF_INET6
+		if len(addr) < 36 {
+			return nil, n
+		}
+		return &ProxyAddr{
+			Host: net.IP(addr[0:16]).String(),
+			Port: strconv.Itoa(int(binary.BigEndian.Uint16(addr[32:34]))),
+		}, n
+	}
+	return nil, n
+}
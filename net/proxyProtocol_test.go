@@ -0,0 +1,105 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+//proxyV2Header 生成PROXY协议v2头，addr为地址部分
+func proxyV2Header(cmd, family byte, addr []byte) []byte {
+	h := append([]byte(nil), proxyV2Sign...)
+	h = append(h, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addr)))
+	return append(h, addr...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, []byte{0x20, 0x01, 0x0d, 0xb8})
+	v6[15], v6[32], v6[33] = 1, 0x1f, 0x90
+	tests := []struct {
+		name   string
+		data   []byte
+		host   string
+		port   string
+		length int
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"), "192.168.0.1", "56324", 47},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 443\r\n"), "2001:db8::1", "8080", 45},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET /"), "", "", 15},
+		{"v1 bad address", []byte("PROXY TCP4 host 192.168.0.11 56324 443\r\n"), "", "", 0},
+		{"v1 bad port", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 70000 443\r\n"), "", "", 0},
+		{"v1 incomplete", []byte("PROXY TCP4 192.168.0.1"), "", "", 0},
+		{"v2 inet", proxyV2Header(1, 0x11, v4), "203.0.113.7", "56324", 28},
+		{"v2 inet6", proxyV2Header(1, 0x21, v6), "2001:db8::1", "8080", 52},
+		{"v2 local", proxyV2Header(0, 0x00, nil), "", "", 16},
+		{"v2 short address", proxyV2Header(1, 0x11, v4[:8]), "", "", 24},
+		{"v2 truncated", proxyV2Header(1, 0x11, v4)[:20], "", "", 0},
+		{"not proxy", []byte("GET / HTTP/1.1\r\n"), "", "", 0},
+	}
+	for _, test := range tests {
+		addr, n := parseProxyHeader(test.data)
+		if n != test.length {
+			t.Errorf("%s: header length is %d, want %d", test.name, n, test.length)
+		}
+		if test.host == "" {
+			if addr != nil {
+				t.Errorf("%s: got address %s", test.name, addr)
+			}
+			continue
+		}
+		if addr == nil || addr.Host != test.host || addr.Port != test.port {
+			t.Errorf("%s: got address %v", test.name, addr)
+		}
+	}
+}
+
+func TestProxyTracker(t *testing.T) {
+	p := newProxyTracker()
+	now := time.Now()
+	data := &SourceData{Source: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"), ReceiveDate: now, TCP: &layers.TCP{}}
+	p.handle(data, true, "10.0.0.2:40000")
+	if string(data.Source) != "GET / HTTP/1.1\r\n" || data.ProxyClient == nil || data.ProxyClient.String() != "192.168.0.1:56324" {
+		t.Fatalf("first segment is %q from %v", data.Source, data.ProxyClient)
+	}
+	//同一连接之后的报文使用记录的地址，不再解析协议头
+	for _, request := range []bool{false, true} {
+		data = &SourceData{Source: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1 2\r\n"), ReceiveDate: now, TCP: &layers.TCP{}}
+		p.handle(data, request, "10.0.0.2:40000")
+		if len(data.Source) != 32 || data.ProxyClient == nil || data.ProxyClient.Host != "192.168.0.1" {
+			t.Errorf("request %v segment is %q from %v", request, data.Source, data.ProxyClient)
+		}
+	}
+	data = &SourceData{ReceiveDate: now, TCP: &layers.TCP{FIN: true}}
+	p.handle(data, true, "10.0.0.2:40000")
+	if data.ProxyClient == nil || len(p.conns) != 0 {
+		t.Errorf("connection is kept after FIN")
+	}
+	data = &SourceData{Source: []byte("GET / HTTP/1.1\r\n"), ReceiveDate: now, TCP: &layers.TCP{}}
+	p.handle(data, true, "10.0.0.3:40000")
+	if data.ProxyClient != nil || len(p.conns) != 0 {
+		t.Errorf("connection without header got %v", data.ProxyClient)
+	}
+}
@@ -0,0 +1,277 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"sync"
+	"tcm/config"
+	"tcm/metric"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	//maxFrameBuffer 每个方向缓存的最大字节数，解析需要的长度超过该值时只解析已缓存的部分
+	maxFrameBuffer = 256 << 10
+	//streamIdleTimeout 连接超过该时间没有数据时清理
+	streamIdleTimeout = 10 * time.Minute
+)
+
+//streamParser 二进制或文本协议的解析器，由tcpStream负责按连接与方向重组报文
+type streamParser interface {
+	//frame 返回缓冲区开头的帧的总长度与解析需要的长度
+	//数据不足以判断长度时返回0，无法解析时返回-1，此时丢弃该方向已缓存的数据
+	frame(c *streamConn, request bool, buf []byte) (total, need int)
+	//handle 处理一个帧，frame至少包含need字节(或maxFrameBuffer字节)，total为帧的总长度
+	handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int)
+	//unanswered 请求超时或连接关闭时仍然没有响应，result为timeout或aborted
+	unanswered(s *tcpStream, c *streamConn, call *streamCall, result string)
+}
+
+//streamCloser 需要在连接结束时处理的解析器实现该接口
+type streamCloser interface {
+	closed(s *tcpStream, c *streamConn)
+}
+
+//streamCall 等待响应的请求
+type streamCall struct {
+	start time.Time
+	value interface{}
+}
+
+//streamConn 一个客户端连接
+type streamConn struct {
+	//客户端地址，经过PROXY协议时为真实客户端
+	client string
+	//两个方向缓存的数据与当前帧还需要跳过的字节数
+	buf  [2][]byte
+	skip [2]int
+	//按ID匹配的请求与按顺序匹配的请求
+	pending map[uint64]*streamCall
+	queue   []*streamCall
+	//解析器保存的连接状态
+	state    interface{}
+	now      time.Time
+	lastSeen time.Time
+}
+
+//tcpStream 按连接重组报文并匹配请求与响应的解码器
+type tcpStream struct {
+	lock   sync.Mutex
+	port   int
+	parser streamParser
+	store  metric.Store
+	conns  map[string]*streamConn
+	//请求超过该时间没有响应时统计为超时
+	timeout time.Duration
+}
+
+func newTCPStream(protocol string, option *config.Option, port config.Port, parser streamParser) *tcpStream {
+	ms := metric.NewMetric(protocol, option.UDPIP, option.StatsdServer, option.UDPPort, port.Port)
+	if ms == nil {
+		log.Errorf("create %s metric store error", protocol)
+		return nil
+	}
+	go ms.Start()
+	s := &tcpStream{
+		port:    port.Port,
+		parser:  parser,
+		store:   ms,
+		conns:   make(map[string]*streamConn),
+		timeout: option.RequestTimeout,
+	}
+	if port.RequestTimeout > 0 {
+		s.timeout = time.Duration(port.RequestTimeout) * time.Second
+	}
+	if s.timeout <= 0 {
+		s.timeout = 10 * time.Second
+	}
+	go s.run(option.Close)
+	return s
+}
+
+//run 定时检查超时的请求，没有新的报文时也能统计超时
+func (s *tcpStream) run(close chan struct{}) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-close:
+			return
+		case now := <-tick.C:
+			s.lock.Lock()
+			s.sweep(now)
+			s.lock.Unlock()
+		}
+	}
+}
+
+//Decode 解码
+func (s *tcpStream) Decode(data *SourceData) {
+	if data.TCP == nil {
+		return
+	}
+	request := int(data.TCP.SrcPort) != s.port
+	var key string
+	if request {
+		key = data.SourceHost.String() + ":" + data.SourcePoint.String()
+	} else {
+		key = data.TargetHost.String() + ":" + data.TargetPoint.String()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.conns[key]
+	if !ok {
+		if len(data.Source) == 0 {
+			return
+		}
+		c = &streamConn{client: data.SourceHost.String(), pending: make(map[uint64]*streamCall)}
+		if !request {
+			c.client = data.TargetHost.String()
+		}
+		s.conns[key] = c
+	}
+	if data.ProxyClient != nil {
+		c.client = data.ProxyClient.Host
+	}
+	c.now, c.lastSeen = data.ReceiveDate, data.ReceiveDate
+	s.feed(c, request, data.Source)
+	if data.TCP.FIN || data.TCP.RST {
+		s.close(c)
+		delete(s.conns, key)
+	}
+}
+
+//feed 缓存数据并处理其中完整的帧
+func (s *tcpStream) feed(c *streamConn, request bool, p []byte) {
+	d := 0
+	if !request {
+		d = 1
+	}
+	if c.skip[d] > 0 {
+		n := c.skip[d]
+		if n > len(p) {
+			n = len(p)
+		}
+		c.skip[d] -= n
+		p = p[n:]
+	}
+	if len(p) == 0 {
+		return
+	}
+	buf := append(c.buf[d], p...)
+	for len(buf) > 0 {
+		total, need := s.parser.frame(c, request, buf)
+		if total < 0 {
+			buf = nil
+			break
+		}
+		if need > maxFrameBuffer {
+			need = maxFrameBuffer
+		}
+		if total == 0 || len(buf) < need {
+			break
+		}
+		if total > len(buf) {
+			s.parser.handle(s, c, request, buf, total)
+			c.skip[d] = total - len(buf)
+			buf = nil
+			break
+		}
+		s.parser.handle(s, c, request, buf[:total], total)
+		buf = buf[total:]
+	}
+	if len(buf) > maxFrameBuffer {
+		//无法识别帧的边界，丢弃等待重新同步
+		buf = nil
+	}
+	//复制剩余的数据，不引用报文
+	c.buf[d] = append([]byte(nil), buf...)
+}
+
+//call 记录按ID匹配的请求
+func (c *streamConn) call(id uint64, value interface{}) {
+	c.pending[id] = &streamCall{start: c.now, value: value}
+}
+
+//reply 返回ID对应的请求
+func (c *streamConn) reply(id uint64) *streamCall {
+	call, ok := c.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, id)
+	return call
+}
+
+//push 记录按顺序匹配的请求
+func (c *streamConn) push(value interface{}) {
+	c.queue = append(c.queue, &streamCall{start: c.now, value: value})
+}
+
+//pop 返回最早的请求
+func (c *streamConn) pop() *streamCall {
+	if len(c.queue) == 0 {
+		return nil
+	}
+	call := c.queue[0]
+	c.queue = c.queue[1:]
+	return call
+}
+
+//elapsed 请求到当前报文的时间
+func (c *streamConn) elapsed(call *streamCall) uint64 {
+	return uint64(c.now.Sub(call.start).Nanoseconds())
+}
+
+//close 连接关闭，没有响应的请求统计为aborted
+func (s *tcpStream) close(c *streamConn) {
+	for id, call := range c.pending {
+		s.parser.unanswered(s, c, call, metric.ResultAborted)
+		delete(c.pending, id)
+	}
+	for _, call := range c.queue {
+		s.parser.unanswered(s, c, call, metric.ResultAborted)
+	}
+	c.queue = nil
+	if closer, ok := s.parser.(streamCloser); ok {
+		closer.closed(s, c)
+	}
+}
+
+//sweep 统计超时的请求，清理不再活动的连接
+func (s *tcpStream) sweep(now time.Time) {
+	for key, c := range s.conns {
+		c.now = now
+		for id, call := range c.pending {
+			if now.Sub(call.start) > s.timeout {
+				s.parser.unanswered(s, c, call, metric.ResultTimeout)
+				delete(c.pending, id)
+			}
+		}
+		for len(c.queue) > 0 && now.Sub(c.queue[0].start) > s.timeout {
+			s.parser.unanswered(s, c, c.pop(), metric.ResultTimeout)
+		}
+		if now.Sub(c.lastSeen) > streamIdleTimeout {
+			s.close(c)
+			delete(s.conns, key)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"tcm/metric"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+//testStore 保存解码器输出的监控数据
+type testStore struct {
+	msgs []interface{}
+}
+
+func (t *testStore) Start()              {}
+func (t *testStore) Stop()               {}
+func (t *testStore) Input(m interface{}) { t.msgs = append(t.msgs, m) }
+
+//protocol 返回输出的协议监控数据并清空
+func (t *testStore) protocol() []*metric.ProtocolMessage {
+	var out []*metric.ProtocolMessage
+	for _, m := range t.msgs {
+		if pm, ok := m.(*metric.ProtocolMessage); ok {
+			out = append(out, pm)
+		}
+	}
+	t.msgs = nil
+	return out
+}
+
+//newTestStream 创建使用testStore的tcpStream，不启动超时检查
+func newTestStream(parser streamParser) (*tcpStream, *testStore) {
+	st := &testStore{}
+	return &tcpStream{port: 9000, parser: parser, store: st, conns: make(map[string]*streamConn), timeout: time.Second}, st
+}
+
+func newTestConn(now time.Time) *streamConn {
+	return &streamConn{client: "10.0.0.2", pending: make(map[uint64]*streamCall), now: now, lastSeen: now}
+}
+
+//testSegment 客户端10.0.0.2:40000与服务端9000端口之间的报文
+func testSegment(request bool, payload []byte, now time.Time, fin bool) *SourceData {
+	client, server := layers.NewIPEndpoint(net.ParseIP("10.0.0.2")), layers.NewIPEndpoint(net.ParseIP("10.0.0.1"))
+	cport, sport := layers.NewTCPPortEndpoint(40000), layers.NewTCPPortEndpoint(9000)
+	data := &SourceData{Source: payload, ReceiveDate: now, TCP: &layers.TCP{SrcPort: 40000, DstPort: 9000, FIN: fin}}
+	data.SourceHost, data.SourcePoint, data.TargetHost, data.TargetPoint = &client, &cport, &server, &sport
+	if !request {
+		data.SourceHost, data.SourcePoint, data.TargetHost, data.TargetPoint = &server, &sport, &client, &cport
+		data.TCP.SrcPort, data.TCP.DstPort = 9000, 40000
+	}
+	return data
+}
+
+//lineParser 测试用的文本协议，每行一帧，#开头的请求按ID匹配，其余按顺序匹配
+type lineParser struct{}
+
+func (lineParser) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		return i + 1, i + 1
+	}
+	return 0, 0
+}
+
+func (lineParser) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	line := string(bytes.TrimSpace(frame))
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.Fields(line)[0], "#"))
+	byID := err == nil && line[0] == '#'
+	if request {
+		msg := &metric.ProtocolMessage{Command: line, RemoteAddr: c.client}
+		if byID {
+			c.call(uint64(id), msg)
+		} else {
+			c.push(msg)
+		}
+		return
+	}
+	var call *streamCall
+	if byID {
+		call = c.reply(uint64(id))
+	} else {
+		call = c.pop()
+	}
+	if call != nil {
+		msg := call.value.(*metric.ProtocolMessage)
+		msg.ReqTime = c.elapsed(call)
+		s.store.Input(msg)
+	}
+}
+
+func (lineParser) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+func TestTCPStream(t *testing.T) {
+	start := time.Now()
+	type segment struct {
+		request bool
+		data    string
+		after   time.Duration
+		fin     bool
+	}
+	tests := []struct {
+		name     string
+		segments []segment
+		//sweep 在最后一个报文之后检查超时的时间，0时不检查
+		sweep   time.Duration
+		want    []string
+		results []string
+	}{
+		{
+			name:     "split frames",
+			segments: []segment{{true, "#1 ge", 0, false}, {true, "t\n#2 set\nping", 0, false}, {true, "\n", 0, false}, {false, "#2\n#1\npo", 20 * time.Millisecond, false}, {false, "ng\n", 0, false}},
+			want:     []string{"#2 set", "#1 get", "ping"},
+			results:  []string{"", "", ""},
+		},
+		{
+			name:     "timeout",
+			segments: []segment{{true, "#1 get\nping\n", 0, false}},
+			sweep:    2 * time.Second,
+			want:     []string{"#1 get", "ping"},
+			results:  []string{metric.ResultTimeout, metric.ResultTimeout},
+		},
+		{
+			name:     "not yet timed out",
+			segments: []segment{{true, "#1 get\n", 0, false}},
+			sweep:    500 * time.Millisecond,
+		},
+		{
+			name:     "aborted",
+			segments: []segment{{true, "#1 get\nping\nping\n", 0, false}, {false, "pong\n", 0, false}, {false, "", 0, true}},
+			want:     []string{"ping", "#1 get", "ping"},
+			results:  []string{"", metric.ResultAborted, metric.ResultAborted},
+		},
+		{
+			name:     "idle connection",
+			segments: []segment{{true, "#7 get\n", 0, false}},
+			sweep:    streamIdleTimeout + time.Second,
+			want:     []string{"#7 get"},
+			results:  []string{metric.ResultTimeout},
+		},
+	}
+	for _, test := range tests {
+		s, st := newTestStream(lineParser{})
+		now := start
+		for _, seg := range test.segments {
+			now = now.Add(seg.after)
+			s.Decode(testSegment(seg.request, []byte(seg.data), now, seg.fin))
+		}
+		if test.sweep > 0 {
+			s.sweep(now.Add(test.sweep))
+		}
+		msgs := st.protocol()
+		if len(msgs) != len(test.want) {
+			t.Errorf("%s: got %d messages", test.name, len(msgs))
+			continue
+		}
+		for i, m := range msgs {
+			if m.Command != test.want[i] || m.Result != test.results[i] || m.RemoteAddr != "10.0.0.2" {
+				t.Errorf("%s: message %d is %s %q from %s", test.name, i, m.Command, m.Result, m.RemoteAddr)
+			}
+		}
+		if test.name == "idle connection" && len(s.conns) != 0 {
+			t.Errorf("%s: idle connection is kept", test.name)
+		}
+	}
+}
+
+func TestTCPStreamSkip(t *testing.T) {
+	//超过maxFrameBuffer的帧只缓存开头，之后的数据跳过
+	s, st := newTestStream(skipParser{})
+	c := newTestConn(time.Now())
+	frame := make([]byte, maxFrameBuffer+100)
+	frame[0] = byte(len(frame) >> 16)
+	frame[1] = byte(len(frame) >> 8)
+	frame[2] = byte(len(frame))
+	s.feed(c, true, frame[:maxFrameBuffer+10])
+	s.feed(c, true, append(frame[maxFrameBuffer+10:], 0, 0, 4, 9))
+	if len(st.msgs) != 2 || st.msgs[0].(int) != len(frame) || st.msgs[1].(int) != 4 || c.skip[0] != 0 {
+		t.Errorf("handled frames %v skip %d", st.msgs, c.skip[0])
+	}
+}
+
+//skipParser 测试用的协议，帧的前3字节为帧的总长度
+type skipParser struct{}
+
+func (skipParser) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 3 {
+		return 0, 0
+	}
+	total = int(buf[0])<<16 | int(buf[1])<<8 | int(buf[2])
+	return total, total
+}
+
+func (skipParser) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	s.store.Input(total)
+}
+
+func (skipParser) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {}
+
+//streamSegment 测试中的一个报文
+type streamSegment struct {
+	request bool
+	data    []byte
+}
+
+//streamTest 一个连接上的报文与期望输出的监控数据
+type streamTest struct {
+	name     string
+	segments []streamSegment
+	//sweep 最后检查超时，close 最后关闭连接
+	sweep, close bool
+	want         []metric.ProtocolMessage
+}
+
+//runStreamTests 每个报文分成两段输入解析器，按顺序比较输出的监控数据
+//want中的计数、瞬时值与长度只比较设置了的项，只有计数或瞬时值的监控数据没有客户端地址
+func runStreamTests(t *testing.T, create func() streamParser, tests []streamTest) {
+	for _, test := range tests {
+		s, st := newTestStream(create())
+		start := time.Now()
+		c := newTestConn(start)
+		s.conns["10.0.0.2:40000"] = c
+		for i, seg := range test.segments {
+			c.now = start.Add(time.Duration(i) * time.Millisecond)
+			half := len(seg.data) / 2
+			s.feed(c, seg.request, seg.data[:half])
+			s.feed(c, seg.request, seg.data[half:])
+		}
+		if test.sweep {
+			s.sweep(start.Add(time.Minute))
+		}
+		if test.close {
+			s.close(c)
+		}
+		msgs := st.protocol()
+		if len(msgs) != len(test.want) {
+			t.Errorf("%s: got %d messages, want %d", test.name, len(msgs), len(test.want))
+			for _, m := range msgs {
+				t.Logf("%s: %+v", test.name, m)
+			}
+			continue
+		}
+		for i, m := range msgs {
+			want := test.want[i]
+			if m.Command != want.Command || m.Resource != want.Resource || m.Key != want.Key || m.Code != want.Code ||
+				m.Result != want.Result || m.Batched != want.Batched || (want.Command != "" && m.RemoteAddr != c.client) {
+				t.Errorf("%s: message %d is %q %q %q code %q result %q batched %v", test.name, i, m.Command, m.Resource, m.Key, m.Code, m.Result, m.Batched)
+			}
+			if (want.RequestLength > 0 && m.RequestLength != want.RequestLength) || (want.ResponseLength > 0 && m.ResponseLength != want.ResponseLength) {
+				t.Errorf("%s: message %d length is %d %d", test.name, i, m.RequestLength, m.ResponseLength)
+			}
+			for k, v := range want.Counters {
+				if m.Counters[k] != v {
+					t.Errorf("%s: message %d counters are %v", test.name, i, m.Counters)
+				}
+			}
+			for k, v := range want.Gauges {
+				if g, ok := m.Gauges[k]; !ok || g != v {
+					t.Errorf("%s: message %d gauges are %v", test.name, i, m.Gauges)
+				}
+			}
+		}
+	}
+}
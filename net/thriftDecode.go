@@ -0,0 +1,443 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	//maxThriftFrame framed传输的最大帧长度，超出时认为不是Thrift协议
+	maxThriftFrame = 16 * 1024 * 1024
+	//thriftHeadLimit framed传输读取的最大长度，参数与返回值只统计长度
+	thriftHeadLimit = 4096
+	//maxThriftMethods 统计的最大方法数量，超出后归入other
+	maxThriftMethods = 1000
+	//maxThriftName 方法名的最大长度
+	maxThriftName = 1024
+	//maxThriftDepth 跳过嵌套结构的最大深度
+	maxThriftDepth = 64
+)
+
+//消息类型
+const (
+	thriftCall      = 1
+	thriftReply     = 2
+	thriftException = 3
+	thriftOneway    = 4
+)
+
+//thriftTypeStruct 结构类型在两种协议中的编号相同
+const thriftTypeStruct = 12
+
+//thriftAppExceptions TApplicationException的类型
+var thriftAppExceptions = map[int32]string{
+	0: "UNKNOWN", 1: "UNKNOWN_METHOD", 2: "INVALID_MESSAGE_TYPE", 3: "WRONG_METHOD_NAME",
+	4: "BAD_SEQUENCE_ID", 5: "MISSING_RESULT", 6: "INTERNAL_ERROR", 7: "PROTOCOL_ERROR",
+	8: "INVALID_TRANSFORM", 9: "INVALID_PROTOCOL", 10: "UNSUPPORTED_CLIENT_TYPE",
+}
+
+//thriftConn 连接使用的传输方式与协议，由第一个报文识别
+type thriftConn struct {
+	framed  bool
+	compact bool
+}
+
+//ThriftDecode Thrift协议解码，支持framed与unframed传输，binary与compact协议
+type ThriftDecode struct {
+	*tcpStream
+	methods *labelFolder
+}
+
+//CreateThriftDecode CreateThriftDecode
+func CreateThriftDecode(option *config.Option, port config.Port) *ThriftDecode {
+	d := &ThriftDecode{methods: newLabelFolder(maxThriftMethods)}
+	d.tcpStream = newTCPStream("thrift", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+//thriftDetect 识别传输方式与协议，无法识别时返回nil
+func thriftDetect(buf []byte) *thriftConn {
+	switch {
+	case buf[0] == 0x80 && buf[1] == 0x01:
+		return &thriftConn{}
+	case buf[0] == 0x82 && buf[1]&0x1f == 1:
+		return &thriftConn{compact: true}
+	case len(buf) >= 6 && buf[4] == 0x80 && buf[5] == 0x01:
+		return &thriftConn{framed: true}
+	case len(buf) >= 6 && buf[4] == 0x82 && buf[5]&0x1f == 1:
+		return &thriftConn{framed: true, compact: true}
+	}
+	return nil
+}
+
+func (d *ThriftDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 6 {
+		return 0, 0
+	}
+	if c.state == nil {
+		tc := thriftDetect(buf)
+		if tc == nil {
+			return -1, 0
+		}
+		c.state = tc
+	}
+	tc := c.state.(*thriftConn)
+	if tc.framed {
+		length := binary.BigEndian.Uint32(buf)
+		if length > maxThriftFrame {
+			return -1, 0
+		}
+		total = 4 + int(length)
+		if total > 4+thriftHeadLimit {
+			return total, 4 + thriftHeadLimit
+		}
+		return total, total
+	}
+	//unframed传输需要解析整个消息才能确定长度
+	r := &thriftReader{p: buf, compact: tc.compact}
+	r.message()
+	r.skip(thriftTypeStruct, 0)
+	if r.bad {
+		return -1, 0
+	}
+	if r.short {
+		return 0, 0
+	}
+	total = len(buf) - len(r.p)
+	return total, total
+}
+
+func (d *ThriftDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	tc := c.state.(*thriftConn)
+	r := &thriftReader{p: frame, compact: tc.compact}
+	if tc.framed {
+		r.p = frame[4:]
+	}
+	name, kind, seqid := r.message()
+	if r.bad || r.short {
+		return
+	}
+	switch kind {
+	case thriftCall, thriftOneway:
+		//命令只区分调用与单向调用，方法在resource中统计
+		command := "call"
+		if kind == thriftOneway {
+			command = "oneway"
+		}
+		resource := d.methods.fold(name)
+		msg := &metric.ProtocolMessage{Command: command, Resource: resource, Key: resource, RemoteAddr: c.client, RequestLength: uint64(total)}
+		if kind == thriftOneway {
+			s.store.Input(msg)
+			return
+		}
+		c.call(uint64(uint32(seqid)), msg)
+	case thriftReply, thriftException:
+		call := c.reply(uint64(uint32(seqid)))
+		if call == nil {
+			return
+		}
+		msg := call.value.(*metric.ProtocolMessage)
+		msg.ReqTime = c.elapsed(call)
+		msg.ResponseLength = uint64(total)
+		if kind == thriftException {
+			msg.Code = thriftAppException(r)
+		} else if _, id := r.field(); id > 0 {
+			//结果结构中字段0为返回值，其余字段为IDL中声明的异常
+			msg.Code = "USER_EXCEPTION"
+		}
+		s.store.Input(msg)
+	}
+}
+
+func (d *ThriftDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+//thriftAppException 读取TApplicationException的类型(字段2)
+func thriftAppException(r *thriftReader) string {
+	for {
+		kind, id := r.field()
+		if r.bad || r.short || kind == 0 {
+			return thriftAppExceptions[0]
+		}
+		if id == 2 && kind == thriftI32(r.compact) {
+			code := r.i32()
+			if name, ok := thriftAppExceptions[code]; ok && !r.short {
+				return name
+			}
+			return strconv.Itoa(int(code))
+		}
+		r.skip(kind, 0)
+	}
+}
+
+//thriftI32 i32类型在两种协议中的编号
+func thriftI32(compact bool) byte {
+	if compact {
+		return 5
+	}
+	return 8
+}
+
+//thriftReader 读取binary与compact协议，数据不足时short为true，格式错误时bad为true
+type thriftReader struct {
+	p       []byte
+	compact bool
+	short   bool
+	bad     bool
+	//compact协议中字段ID为与上一个字段的差值
+	lastID int16
+}
+
+func (t *thriftReader) take(n int) []byte {
+	if t.short || t.bad {
+		return nil
+	}
+	if n < 0 {
+		t.bad = true
+		return nil
+	}
+	if n > len(t.p) {
+		t.short = true
+		return nil
+	}
+	b := t.p[:n]
+	t.p = t.p[n:]
+	return b
+}
+
+func (t *thriftReader) byte() byte {
+	if b := t.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (t *thriftReader) varint() uint64 {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := t.byte()
+		if t.short || t.bad {
+			return 0
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	t.bad = true
+	return 0
+}
+
+func (t *thriftReader) i32() int32 {
+	if t.compact {
+		v := uint32(t.varint())
+		return int32(v>>1) ^ -int32(v&1)
+	}
+	if b := t.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+//length 字符串与容器的长度
+func (t *thriftReader) length() int {
+	if t.compact {
+		return int(t.varint())
+	}
+	return int(t.i32())
+}
+
+//message 读取消息头，返回方法名、消息类型与seqid
+func (t *thriftReader) message() (string, byte, int32) {
+	var name []byte
+	var kind byte
+	var seqid int32
+	if t.compact {
+		if t.byte() != 0x82 && !t.short {
+			t.bad = true
+			return "", 0, 0
+		}
+		kind = t.byte() >> 5
+		seqid = int32(t.varint())
+		if n := t.length(); n > maxThriftName {
+			t.bad = true
+		} else {
+			name = t.take(n)
+		}
+	} else {
+		version := t.i32()
+		if t.short {
+			return "", 0, 0
+		}
+		if version>>16 != -0x7fff {
+			t.bad = true
+			return "", 0, 0
+		}
+		kind = byte(version)
+		if n := t.length(); n > maxThriftName {
+			t.bad = true
+		} else {
+			name = t.take(n)
+		}
+		seqid = t.i32()
+	}
+	if kind < thriftCall || kind > thriftOneway {
+		t.bad = true
+	}
+	return string(name), kind, seqid
+}
+
+//field 读取字段头，结构结束时类型为0
+func (t *thriftReader) field() (byte, int16) {
+	if t.compact {
+		b := t.byte()
+		kind := b & 0x0f
+		if kind == 0 {
+			return 0, 0
+		}
+		if delta := int16(b >> 4); delta != 0 {
+			t.lastID += delta
+		} else {
+			v := uint16(t.varint())
+			t.lastID = int16(v>>1) ^ -int16(v&1)
+		}
+		return kind, t.lastID
+	}
+	kind := t.byte()
+	if kind == 0 {
+		return 0, 0
+	}
+	var id int16
+	if b := t.take(2); b != nil {
+		id = int16(binary.BigEndian.Uint16(b))
+	}
+	return kind, id
+}
+
+//skip 跳过一个值
+func (t *thriftReader) skip(kind byte, depth int) {
+	if depth > maxThriftDepth {
+		t.bad = true
+		return
+	}
+	if t.compact {
+		t.skipCompact(kind, depth, false)
+		return
+	}
+	switch kind {
+	case 2, 3:
+		t.take(1)
+	case 6:
+		t.take(2)
+	case 8:
+		t.take(4)
+	case 4, 10:
+		t.take(8)
+	case 16:
+		t.take(16)
+	case 11:
+		t.take(t.length())
+	case 12:
+		t.skipStruct(depth)
+	case 13:
+		k, v := t.byte(), t.byte()
+		for n := t.length(); n > 0 && !t.short && !t.bad; n-- {
+			t.skip(k, depth+1)
+			t.skip(v, depth+1)
+		}
+	case 14, 15:
+		e := t.byte()
+		for n := t.length(); n > 0 && !t.short && !t.bad; n-- {
+			t.skip(e, depth+1)
+		}
+	default:
+		t.bad = true
+	}
+}
+
+//skipCompact 跳过compact协议的值，element为容器中的元素
+func (t *thriftReader) skipCompact(kind byte, depth int, element bool) {
+	if depth > maxThriftDepth {
+		t.bad = true
+		return
+	}
+	switch kind {
+	case 1, 2:
+		//字段的bool值在类型中，容器中的bool占一个字节
+		if element {
+			t.take(1)
+		}
+	case 3:
+		t.take(1)
+	case 4, 5, 6:
+		t.varint()
+	case 7:
+		t.take(8)
+	case 13:
+		t.take(16)
+	case 8:
+		t.take(t.length())
+	case 12:
+		t.skipStruct(depth)
+	case 9, 10:
+		b := t.byte()
+		n := int(b >> 4)
+		if n == 15 {
+			n = t.length()
+		}
+		for ; n > 0 && !t.short && !t.bad; n-- {
+			t.skipCompact(b&0x0f, depth+1, true)
+		}
+	case 11:
+		n := t.length()
+		if n == 0 {
+			return
+		}
+		b := t.byte()
+		for ; n > 0 && !t.short && !t.bad; n-- {
+			t.skipCompact(b>>4, depth+1, true)
+			t.skipCompact(b&0x0f, depth+1, true)
+		}
+	default:
+		t.bad = true
+	}
+}
+
+func (t *thriftReader) skipStruct(depth int) {
+	last := t.lastID
+	t.lastID = 0
+	for !t.short && !t.bad {
+		kind, _ := t.field()
+		if kind == 0 {
+			break
+		}
+		t.skip(kind, depth+1)
+	}
+	t.lastID = last
+}
@@ -0,0 +1,128 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//thriftI32Bytes binary协议的i32
+func thriftI32Bytes(v int32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return string(b)
+}
+
+//thriftBinary binary协议的消息
+func thriftBinary(kind byte, name string, seqid int32, body string) []byte {
+	return []byte(thriftI32Bytes(-0x7fff0000|int32(kind)) + thriftI32Bytes(int32(len(name))) + name + thriftI32Bytes(seqid) + body)
+}
+
+//thriftCompact compact协议的消息，seqid与名称长度小于128
+func thriftCompact(kind byte, name string, seqid byte, body string) []byte {
+	return []byte(string([]byte{0x82, kind<<5 | 1, seqid, byte(len(name))}) + name + body)
+}
+
+//thriftFramed framed传输的帧
+func thriftFramed(msg []byte) []byte {
+	return append([]byte(thriftI32Bytes(int32(len(msg)))), msg...)
+}
+
+func TestThriftDecode(t *testing.T) {
+	//binary协议的结构
+	args := "\x0b\x00\x01" + thriftI32Bytes(4) + "u-42\x00"
+	result := "\x0b\x00\x00" + thriftI32Bytes(3) + "bob\x00"
+	userException := "\x0c\x00\x01\x0b\x00\x01" + thriftI32Bytes(9) + "not found\x00\x00"
+	appException := func(kind int32) string {
+		return "\x0b\x00\x01" + thriftI32Bytes(4) + "oops" + "\x08\x00\x02" + thriftI32Bytes(kind) + "\x00"
+	}
+	//compact协议的结构
+	compactArgs := "\x18\x04u-42\x00"
+	compactUserException := "\x1c\x18\x09not found\x00\x00"
+	compactAppException := "\x18\x04oops\x15\x02\x00"
+	req := func(p []byte) streamSegment { return streamSegment{true, p} }
+	res := func(p []byte) streamSegment { return streamSegment{false, p} }
+	runStreamTests(t, func() streamParser { return &ThriftDecode{methods: newLabelFolder(maxThriftMethods)} }, []streamTest{
+		{
+			name: "binary framed",
+			segments: []streamSegment{
+				req(thriftFramed(thriftBinary(thriftCall, "getUser", 1, args))),
+				res(thriftFramed(thriftBinary(thriftReply, "getUser", 1, result))),
+			},
+			want: []metric.ProtocolMessage{{Command: "call", Resource: "getUser", Key: "getUser", RequestLength: 35, ResponseLength: 34}},
+		},
+		{
+			name: "binary unframed",
+			segments: []streamSegment{
+				req(thriftBinary(thriftCall, "getUser", 1, args)), req(thriftBinary(thriftCall, "getUser", 2, args)),
+				res(thriftBinary(thriftReply, "getUser", 2, userException)),
+				res(thriftBinary(thriftException, "getUser", 1, appException(1))),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "call", Resource: "getUser", Key: "getUser", Code: "USER_EXCEPTION", RequestLength: 31},
+				{Command: "call", Resource: "getUser", Key: "getUser", Code: "UNKNOWN_METHOD"},
+			},
+		},
+		{
+			name: "compact framed",
+			segments: []streamSegment{
+				req(thriftFramed(thriftCompact(thriftCall, "getUser", 3, compactArgs))),
+				res(thriftFramed(thriftCompact(thriftReply, "getUser", 3, compactUserException))),
+			},
+			want: []metric.ProtocolMessage{{Command: "call", Resource: "getUser", Key: "getUser", Code: "USER_EXCEPTION"}},
+		},
+		{
+			name: "compact unframed",
+			segments: []streamSegment{
+				req(thriftCompact(thriftCall, "getUser", 4, compactArgs)),
+				res(thriftCompact(thriftReply, "getUser", 4, "\x08\x00\x03bob\x00")),
+				req(thriftCompact(thriftCall, "delUser", 5, compactArgs)),
+				res(thriftCompact(thriftException, "delUser", 5, compactAppException)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "call", Resource: "getUser", Key: "getUser", RequestLength: 18, ResponseLength: 18},
+				{Command: "call", Resource: "delUser", Key: "delUser", Code: "UNKNOWN_METHOD"},
+			},
+		},
+		{
+			name: "oneway",
+			segments: []streamSegment{
+				req(thriftFramed(thriftBinary(thriftOneway, "audit", 6, args))),
+				req(thriftFramed(thriftBinary(thriftCall, "ping", 7, "\x00"))),
+				res(thriftFramed(thriftBinary(thriftException, "ping", 7, appException(42)))),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "oneway", Resource: "audit", Key: "audit"},
+				{Command: "call", Resource: "ping", Key: "ping", Code: "42"},
+			},
+		},
+		{
+			name:     "timeout",
+			segments: []streamSegment{req(thriftBinary(thriftCall, "getUser", 8, args))},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "call", Resource: "getUser", Key: "getUser", Result: metric.ResultTimeout}},
+		},
+		{
+			name:     "not thrift",
+			segments: []streamSegment{req([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))},
+		},
+	})
+}
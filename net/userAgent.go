@@ -0,0 +1,222 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+//UARules User-Agent分类规则，每一类按顺序匹配，第一个包含任一模式(不区分大小写)的规则生效
+type UARules struct {
+	Categories []UARule `json:"categories"`
+	Browsers   []UARule `json:"browsers"`
+	OS         []UARule `json:"os"`
+	Devices    []UARule `json:"devices"`
+}
+
+//UARule 分类规则
+type UARule struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns"`
+}
+
+//UAClass User-Agent分类结果
+type UAClass struct {
+	//user、crawler、probe、client或other
+	Category string
+	Browser  string
+	OS       string
+	Device   string
+}
+
+//defaultUARules 内置规则，可以通过 -ua-rules 指定的文件替换
+var defaultUARules = UARules{
+	Categories: []UARule{
+		{Name: "probe", Patterns: []string{"kube-probe", "ELB-HealthChecker", "GoogleHC", "Consul Health Check", "Pingdom", "UptimeRobot", "StatusCake", "Site24x7", "Zabbix", "Nagios", "check_http", "Prometheus", "Blackbox Exporter", "NewRelicPinger", "Datadog", "Uptime-Kuma", "HealthCheck", "health-check"}},
+		{Name: "crawler", Patterns: []string{"Googlebot", "bingbot", "Baiduspider", "YandexBot", "Sogou", "360Spider", "Bytespider", "DuckDuckBot", "Slurp", "facebookexternalhit", "Twitterbot", "AhrefsBot", "SemrushBot", "MJ12bot", "PetalBot", "Applebot", "GPTBot", "spider", "crawler", "bot/", "bot;"}},
+		{Name: "client", Patterns: []string{"curl/", "Wget/", "okhttp", "Go-http-client", "python-requests", "python-urllib", "aiohttp", "Java/", "Apache-HttpClient", "axios/", "node-fetch", "PostmanRuntime", "Dart/", "libwww-perl", "HTTPie"}},
+		{Name: "user", Patterns: []string{"Mozilla/", "Opera/"}},
+	},
+	Browsers: []UARule{
+		{Name: "Edge", Patterns: []string{"Edg/", "Edge/", "EdgA/", "EdgiOS/"}},
+		{Name: "Opera", Patterns: []string{"OPR/", "Opera"}},
+		{Name: "WeChat", Patterns: []string{"MicroMessenger"}},
+		{Name: "QQBrowser", Patterns: []string{"QQBrowser"}},
+		{Name: "UCBrowser", Patterns: []string{"UCBrowser"}},
+		{Name: "SamsungBrowser", Patterns: []string{"SamsungBrowser"}},
+		{Name: "Firefox", Patterns: []string{"Firefox/", "FxiOS/"}},
+		{Name: "Chrome", Patterns: []string{"Chrome/", "CriOS/"}},
+		{Name: "Safari", Patterns: []string{"Safari/"}},
+		{Name: "IE", Patterns: []string{"MSIE ", "Trident/"}},
+	},
+	OS: []UARule{
+		{Name: "iOS", Patterns: []string{"iPhone", "iPad", "iPod"}},
+		{Name: "HarmonyOS", Patterns: []string{"HarmonyOS", "OpenHarmony"}},
+		{Name: "Android", Patterns: []string{"Android"}},
+		{Name: "Windows", Patterns: []string{"Windows"}},
+		{Name: "macOS", Patterns: []string{"Mac OS X", "Macintosh"}},
+		{Name: "ChromeOS", Patterns: []string{"CrOS"}},
+		{Name: "Linux", Patterns: []string{"Linux", "X11"}},
+	},
+	Devices: []UARule{
+		{Name: "tablet", Patterns: []string{"iPad", "Tablet"}},
+		{Name: "mobile", Patterns: []string{"Mobi", "iPhone", "iPod"}},
+		{Name: "tablet", Patterns: []string{"Android"}},
+		{Name: "desktop", Patterns: []string{"Windows", "Macintosh", "X11", "CrOS"}},
+	},
+}
+
+const (
+	uaOther = "other"
+	//分类结果缓存的最大数量，超出后清空
+	uaCacheSize = 10000
+)
+
+//uaClassifier User-Agent分类器，规则文件修改后自动重新加载
+type uaClassifier struct {
+	lock    sync.RWMutex
+	rules   UARules
+	cache   map[string]UAClass
+	file    string
+	modTime time.Time
+}
+
+var (
+	uaOnce   sync.Once
+	uaShared *uaClassifier
+)
+
+//getUAClassifier 所有端口共用一个分类器
+func getUAClassifier(file string, close chan struct{}) *uaClassifier {
+	uaOnce.Do(func() {
+		uaShared = &uaClassifier{file: file}
+		uaShared.setRules(defaultUARules)
+		if file != "" {
+			uaShared.reload()
+			go uaShared.watch(close)
+		}
+	})
+	return uaShared
+}
+
+func (u *uaClassifier) setRules(rules UARules) {
+	lower := func(rs []UARule) []UARule {
+		var out []UARule
+		for _, r := range rs {
+			lr := UARule{Name: r.Name}
+			for _, p := range r.Patterns {
+				lr.Patterns = append(lr.Patterns, strings.ToLower(p))
+			}
+			out = append(out, lr)
+		}
+		return out
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.rules = UARules{
+		Categories: lower(rules.Categories),
+		Browsers:   lower(rules.Browsers),
+		OS:         lower(rules.OS),
+		Devices:    lower(rules.Devices),
+	}
+	u.cache = make(map[string]UAClass)
+}
+
+//reload 规则文件有修改时重新加载
+func (u *uaClassifier) reload() {
+	info, err := os.Stat(u.file)
+	if err != nil {
+		log.Errorf("stat user agent rule file error,%s", err.Error())
+		return
+	}
+	if !info.ModTime().After(u.modTime) {
+		return
+	}
+	u.modTime = info.ModTime()
+	body, err := ioutil.ReadFile(u.file)
+	if err != nil {
+		log.Errorf("read user agent rule file error,%s", err.Error())
+		return
+	}
+	var rules UARules
+	if err := json.Unmarshal(body, &rules); err != nil {
+		log.Errorf("parse user agent rule file error,%s", err.Error())
+		return
+	}
+	u.setRules(rules)
+	log.Infof("load user agent rules from %s", u.file)
+}
+
+func (u *uaClassifier) watch(close chan struct{}) {
+	tick := time.NewTicker(30 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-close:
+			return
+		case <-tick.C:
+			u.reload()
+		}
+	}
+}
+
+//classify 对User-Agent分类
+func (u *uaClassifier) classify(ua string) UAClass {
+	u.lock.RLock()
+	c, ok := u.cache[ua]
+	u.lock.RUnlock()
+	if ok {
+		return c
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	lua := strings.ToLower(ua)
+	c = UAClass{
+		Category: matchUARule(u.rules.Categories, lua),
+		Browser:  matchUARule(u.rules.Browsers, lua),
+		OS:       matchUARule(u.rules.OS, lua),
+		Device:   matchUARule(u.rules.Devices, lua),
+	}
+	if len(u.cache) >= uaCacheSize {
+		u.cache = make(map[string]UAClass)
+	}
+	u.cache[ua] = c
+	return c
+}
+
+func matchUARule(rules []UARule, ua string) string {
+	if ua == "" {
+		return uaOther
+	}
+	for _, r := range rules {
+		for _, p := range r.Patterns {
+			if strings.Contains(ua, p) {
+				return r.Name
+			}
+		}
+	}
+	return uaOther
+}
@@ -0,0 +1,141 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+const (
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPong   = 0xA
+)
+
+//wsReader 统计一个方向上的WebSocket帧，不保存报文内容
+type wsReader struct {
+	//当前帧头，最长14字节
+	head    [14]byte
+	headLen int
+	need    int
+	//当前帧剩余的载荷长度
+	remain int64
+	opcode byte
+	fin    bool
+	//关闭帧载荷的已读字节数
+	closeRead int
+	closeCode int
+	frames    uint64
+	messages  uint64
+	bytes     uint64
+	//帧头不合法时(如丢包)不再解析，只统计字节数
+	broken bool
+}
+
+//feed 读取一段报文
+func (w *wsReader) feed(p []byte) {
+	w.bytes += uint64(len(p))
+	for len(p) > 0 && !w.broken {
+		if w.remain > 0 {
+			n := int64(len(p))
+			if n > w.remain {
+				n = w.remain
+			}
+			if w.opcode == wsOpClose {
+				w.readClose(p[:n])
+			}
+			w.remain -= n
+			p = p[n:]
+			continue
+		}
+		w.head[w.headLen] = p[0]
+		w.headLen++
+		p = p[1:]
+		if w.headLen == 2 {
+			w.need = 2
+			switch w.head[1] & 0x7f {
+			case 126:
+				w.need += 2
+			case 127:
+				w.need += 8
+			}
+			if w.head[1]&0x80 != 0 {
+				w.need += 4
+			}
+		}
+		if w.headLen >= 2 && w.headLen == w.need {
+			w.frame()
+		}
+	}
+}
+
+//frame 帧头读取完成
+func (w *wsReader) frame() {
+	w.fin = w.head[0]&0x80 != 0
+	w.opcode = w.head[0] & 0x0f
+	if w.opcode > wsOpBinary && w.opcode < wsOpClose || w.opcode > wsOpPong {
+		w.broken = true
+		return
+	}
+	switch n := w.head[1] & 0x7f; n {
+	case 126:
+		w.remain = int64(w.head[2])<<8 | int64(w.head[3])
+	case 127:
+		w.remain = 0
+		for _, b := range w.head[2:10] {
+			w.remain = w.remain<<8 | int64(b)
+		}
+		if w.remain < 0 {
+			w.broken = true
+			return
+		}
+	default:
+		w.remain = int64(n)
+	}
+	w.frames++
+	if w.fin && w.opcode <= wsOpBinary {
+		w.messages++
+	}
+	w.headLen, w.need, w.closeRead = 0, 0, 0
+}
+
+//readClose 从关闭帧载荷的前两个字节获取状态码，客户端发出的帧需要先去掉掩码
+func (w *wsReader) readClose(p []byte) {
+	for _, b := range p {
+		if w.closeRead >= 2 {
+			return
+		}
+		if w.head[1]&0x80 != 0 {
+			b ^= w.head[w.maskOffset()+w.closeRead]
+		}
+		if w.closeRead == 0 {
+			w.closeCode = int(b) << 8
+		} else {
+			w.closeCode |= int(b)
+		}
+		w.closeRead++
+	}
+}
+
+//maskOffset 掩码在帧头中的位置
+func (w *wsReader) maskOffset() int {
+	switch w.head[1] & 0x7f {
+	case 126:
+		return 4
+	case 127:
+		return 10
+	}
+	return 2
+}
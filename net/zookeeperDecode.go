@@ -0,0 +1,333 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"strconv"
+	"tcm/config"
+	"tcm/metric"
+)
+
+const (
+	//maxZKPacket 报文的最大长度，超出时认为不是ZooKeeper协议
+	maxZKPacket = 16 * 1024 * 1024
+	//zkHeadLimit 读取的最大长度，节点数据只统计长度
+	zkHeadLimit = 4096
+	//maxZKPaths 统计的最大路径数量，超出后归入other
+	maxZKPaths = 500
+	//maxZKClients 按客户端统计会话过期的最大客户端数量
+	maxZKClients = 200
+)
+
+//zkXidWatch watch事件的xid
+const zkXidWatch = -1
+
+//zkConnectKey 建立会话的请求在请求表中的key，普通请求的key为xid
+const zkConnectKey = 1 << 40
+
+//zkOpcodes 请求类型
+var zkOpcodes = map[int32]string{
+	0: "notification", 1: "create", 2: "delete", 3: "exists", 4: "getData", 5: "setData",
+	6: "getACL", 7: "setACL", 8: "getChildren", 9: "sync", 11: "ping", 12: "getChildren2",
+	13: "check", 14: "multi", 15: "create2", 16: "reconfig", 17: "checkWatches",
+	18: "removeWatches", 19: "createContainer", 20: "deleteContainer", 21: "createTTL",
+	22: "multiRead", 100: "auth", 101: "setWatches", 102: "sasl", 103: "getEphemerals",
+	104: "getAllChildrenNumber", 105: "setWatches2", 106: "addWatch", 107: "whoAmI",
+	-10: "createSession", -11: "closeSession", -1: "error",
+}
+
+//zkPathOpcodes 请求体以节点路径开始的请求类型
+var zkPathOpcodes = map[int32]bool{
+	1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 9: true, 12: true,
+	13: true, 15: true, 17: true, 18: true, 19: true, 20: true, 21: true, 103: true, 104: true, 106: true,
+}
+
+//zkErrors 错误码
+var zkErrors = map[int32]string{
+	-1: "SYSTEMERROR", -2: "RUNTIMEINCONSISTENCY", -3: "DATAINCONSISTENCY", -4: "CONNECTIONLOSS",
+	-5: "MARSHALLINGERROR", -6: "UNIMPLEMENTED", -7: "OPERATIONTIMEOUT", -8: "BADARGUMENTS",
+	-9: "UNKNOWNSESSION", -13: "NEWCONFIGNOQUORUM", -14: "RECONFIGINPROGRESS",
+	-15: "EPHEMERALONLOCALSESSION", -101: "NONODE", -102: "NOAUTH", -103: "BADVERSION",
+	-108: "NOCHILDRENFOREPHEMERALS", -110: "NODEEXISTS", -111: "NOTEMPTY", -112: "SESSIONEXPIRED",
+	-113: "INVALIDCALLBACK", -114: "INVALIDACL", -115: "AUTHFAILED", -118: "SESSIONMOVED",
+	-119: "NOTREADONLY", -120: "EPHEMERALONLOCALSESSION", -121: "NOWATCHER", -122: "REQUESTTIMEOUT",
+	-123: "RECONFIGDISABLED", -124: "SESSIONCLOSEDREQUIRESASLAUTH", -125: "QUOTAEXCEEDED",
+	-127: "THROTTLEDOP",
+}
+
+//zkEvents watch事件类型
+var zkEvents = map[int32]string{
+	-1: "none", 1: "nodeCreated", 2: "nodeDeleted", 3: "nodeDataChanged", 4: "nodeChildrenChanged",
+	5: "dataWatchRemoved", 6: "childWatchRemoved", 7: "persistentWatchRemoved",
+}
+
+//zkSessionExpired 会话过期的错误码，也是watch事件中的会话状态
+const zkSessionExpired = -112
+
+//ZooKeeperDecode ZooKeeper客户端协议解码
+type ZooKeeperDecode struct {
+	*tcpStream
+	normalizer *PathNormalizer
+	paths      *labelFolder
+	clients    *labelFolder
+}
+
+//CreateZooKeeperDecode CreateZooKeeperDecode
+func CreateZooKeeperDecode(option *config.Option, port config.Port) *ZooKeeperDecode {
+	d := &ZooKeeperDecode{
+		normalizer: NewPathNormalizer(port.Routes),
+		paths:      newLabelFolder(maxZKPaths),
+		clients:    newLabelFolder(maxZKClients),
+	}
+	d.tcpStream = newTCPStream("zookeeper", option, port, d)
+	if d.tcpStream == nil {
+		return nil
+	}
+	return d
+}
+
+//zkConn 连接是否已经过了建立会话的阶段
+type zkConn struct {
+	established bool
+}
+
+func (d *ZooKeeperDecode) frame(c *streamConn, request bool, buf []byte) (total, need int) {
+	if len(buf) < 4 {
+		return 0, 0
+	}
+	length := int32(binary.BigEndian.Uint32(buf))
+	if length < 0 || length > maxZKPacket {
+		return -1, 0
+	}
+	total = 4 + int(length)
+	if total > zkHeadLimit {
+		return total, zkHeadLimit
+	}
+	return total, total
+}
+
+func (d *ZooKeeperDecode) handle(s *tcpStream, c *streamConn, request bool, frame []byte, total int) {
+	if c.state == nil {
+		c.state = &zkConn{}
+	}
+	zc := c.state.(*zkConn)
+	r := &zkReader{p: frame[4:]}
+	if request {
+		//连接的第一个请求为ConnectRequest，协议版本为0
+		if !zc.established && len(r.p) >= 28 && binary.BigEndian.Uint32(r.p) == 0 {
+			r.int32()
+			r.int64()
+			r.int32()
+			msg := d.message(c, "connect", "", total)
+			if r.int64() == 0 {
+				msg.Counters = map[string]uint64{"sessions.created": 1}
+			} else {
+				msg.Counters = map[string]uint64{"sessions.resumed": 1}
+			}
+			c.call(zkConnectKey, msg)
+			return
+		}
+		zc.established = true
+		d.request(c, r, total)
+		return
+	}
+	if call := c.reply(zkConnectKey); call != nil {
+		//ConnectResponse，会话已过期时超时时间为0
+		zc.established = true
+		msg := call.value.(*metric.ProtocolMessage)
+		r.int32()
+		if r.int32() <= 0 && !r.err {
+			msg.Code = "SESSIONEXPIRED"
+			d.expired(msg, c)
+		}
+		d.finish(s, c, call, msg, total)
+		return
+	}
+	zc.established = true
+	xid := r.int32()
+	r.int64()
+	code := r.int32()
+	if r.err {
+		return
+	}
+	if xid == zkXidWatch {
+		d.watch(s, c, r)
+		return
+	}
+	call := c.reply(uint64(uint32(xid)))
+	if call == nil {
+		return
+	}
+	msg := call.value.(*metric.ProtocolMessage)
+	if msg.Command == "multi" && code == 0 {
+		code = zkMultiError(r)
+	}
+	//exists查询不存在的节点是正常结果
+	if code != 0 && !(code == -101 && msg.Command == "exists") {
+		msg.Code = zkError(code)
+	}
+	if code == zkSessionExpired {
+		d.expired(msg, c)
+	}
+	d.finish(s, c, call, msg, total)
+}
+
+//request 按xid记录请求，请求的路径作为resource
+func (d *ZooKeeperDecode) request(c *streamConn, r *zkReader, total int) {
+	xid := r.int32()
+	opcode := r.int32()
+	if r.err {
+		return
+	}
+	command, ok := zkOpcodes[opcode]
+	if !ok {
+		command = strconv.Itoa(int(opcode))
+	}
+	resource := ""
+	if zkPathOpcodes[opcode] {
+		resource = d.path(r.string())
+	} else if opcode == 14 {
+		//multi按第一个操作的路径统计
+		if op := r.int32(); zkPathOpcodes[op] {
+			r.take(5)
+			resource = d.path(r.string())
+		}
+	}
+	c.call(uint64(uint32(xid)), d.message(c, command, resource, total))
+}
+
+//watch 统计watch事件与会话过期，watch事件的路径记录在排行中
+func (d *ZooKeeperDecode) watch(s *tcpStream, c *streamConn, r *zkReader) {
+	kind := r.int32()
+	state := r.int32()
+	path := r.string()
+	if r.err {
+		return
+	}
+	msg := &metric.ProtocolMessage{RemoteAddr: c.client}
+	if kind == -1 {
+		if state == zkSessionExpired {
+			d.expired(msg, c)
+			s.store.Input(msg)
+		}
+		return
+	}
+	event, ok := zkEvents[kind]
+	if !ok {
+		event = strconv.Itoa(int(kind))
+	}
+	msg.Counters = map[string]uint64{"watch.total": 1, "watch." + event: 1}
+	msg.Tops = []metric.TopEntry{{List: "watches", Key: event + " " + d.path(path)}}
+	s.store.Input(msg)
+}
+
+//expired 会话过期按客户端统计
+func (d *ZooKeeperDecode) expired(msg *metric.ProtocolMessage, c *streamConn) {
+	if msg.Counters == nil {
+		msg.Counters = map[string]uint64{}
+	}
+	msg.Counters["sessions.expired"]++
+	msg.Counters["client."+metric.StatsdName(d.clients.fold(c.client))+".sessions.expired"]++
+}
+
+func (d *ZooKeeperDecode) finish(s *tcpStream, c *streamConn, call *streamCall, msg *metric.ProtocolMessage, total int) {
+	msg.ReqTime = c.elapsed(call)
+	msg.ResponseLength = uint64(total)
+	s.store.Input(msg)
+}
+
+func (d *ZooKeeperDecode) unanswered(s *tcpStream, c *streamConn, call *streamCall, result string) {
+	msg := call.value.(*metric.ProtocolMessage)
+	msg.Result = result
+	s.store.Input(msg)
+}
+
+func (d *ZooKeeperDecode) message(c *streamConn, command, resource string, total int) *metric.ProtocolMessage {
+	return &metric.ProtocolMessage{Command: command, Resource: resource, RemoteAddr: c.client, RequestLength: uint64(total)}
+}
+
+//path 节点路径按http地址模版的规则归并，如顺序节点 /locks/lock-0000000012
+func (d *ZooKeeperDecode) path(path string) string {
+	if path == "" {
+		return ""
+	}
+	return d.paths.fold(d.normalizer.Normalize(path))
+}
+
+//zkMultiError multi响应中第一个失败操作的错误码
+func zkMultiError(r *zkReader) int32 {
+	for {
+		kind := r.int32()
+		done := r.take(1)
+		r.int32()
+		if r.err || done[0] != 0 || kind != -1 {
+			return 0
+		}
+		//ErrorResult，其余操作为RUNTIMEINCONSISTENCY或成功
+		if code := r.int32(); code != 0 && code != -2 {
+			return code
+		}
+	}
+}
+
+func zkError(code int32) string {
+	if name, ok := zkErrors[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+//zkReader 读取jute编码的数据，数据不足时err为true
+type zkReader struct {
+	p   []byte
+	err bool
+}
+
+func (z *zkReader) take(n int) []byte {
+	if z.err || n < 0 || n > len(z.p) {
+		z.err = true
+		return nil
+	}
+	b := z.p[:n]
+	z.p = z.p[n:]
+	return b
+}
+
+func (z *zkReader) int32() int32 {
+	if b := z.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (z *zkReader) int64() int64 {
+	if b := z.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (z *zkReader) string() string {
+	n := z.int32()
+	if n <= 0 {
+		return ""
+	}
+	return string(z.take(int(n)))
+}
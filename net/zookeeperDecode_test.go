@@ -0,0 +1,129 @@
+// RAINBOND, Application Management Platform
+// Copyright (C) 2014-2017 Goodrain Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Rainbond,
+// one or multiple Commercial Licenses authorized by Goodrain Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package net
+
+import (
+	"encoding/binary"
+	"tcm/metric"
+	"testing"
+)
+
+//zkPacket 生成带长度前缀的jute报文，string为int32长度前缀的字符串
+func zkPacket(args ...interface{}) []byte {
+	p := []byte{0, 0, 0, 0}
+	for _, a := range args {
+		switch v := a.(type) {
+		case int32:
+			p = append(p, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(p[len(p)-4:], uint32(v))
+		case int64:
+			p = append(p, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(p[len(p)-8:], uint64(v))
+		case string:
+			p = append(p, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(p[len(p)-4:], uint32(len(v)))
+			p = append(p, v...)
+		case bool:
+			if v {
+				p = append(p, 1)
+			} else {
+				p = append(p, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	return p
+}
+
+func TestZooKeeperDecode(t *testing.T) {
+	req := func(args ...interface{}) streamSegment { return streamSegment{true, zkPacket(args...)} }
+	res := func(args ...interface{}) streamSegment { return streamSegment{false, zkPacket(args...)} }
+	password := string(make([]byte, 16))
+	connect := func(session int64) streamSegment {
+		return req(int32(0), int64(0), int32(30000), session, password)
+	}
+	zxid := int64(0x100)
+	runStreamTests(t, func() streamParser {
+		return &ZooKeeperDecode{normalizer: NewPathNormalizer(nil), paths: newLabelFolder(maxZKPaths), clients: newLabelFolder(maxZKClients)}
+	}, []streamTest{
+		{
+			name: "new session",
+			segments: []streamSegment{
+				connect(0), res(int32(0), int32(30000), int64(0x1234), password),
+				req(int32(1), int32(4), "/config/app", true), res(int32(1), zxid, int32(0), "v=1"),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "connect", RequestLength: 48, ResponseLength: 40, Counters: map[string]uint64{"sessions.created": 1}},
+				{Command: "getData", Resource: "/config/app", RequestLength: 28, ResponseLength: 27},
+			},
+		},
+		{
+			name:     "session expired",
+			segments: []streamSegment{connect(0x1234), res(int32(0), int32(0), int64(0), password)},
+			want: []metric.ProtocolMessage{{Command: "connect", Code: "SESSIONEXPIRED", Counters: map[string]uint64{
+				"sessions.resumed": 1, "sessions.expired": 1, "client.10_0_0_2.sessions.expired": 1}}},
+		},
+		{
+			name: "errors",
+			segments: []streamSegment{
+				req(int32(1), int32(1), "/services/api", "", int32(0), int32(0)),
+				req(int32(2), int32(3), "/services/web", false),
+				req(int32(3), int32(2), "/services", int32(-1)),
+				res(int32(1), zxid, int32(-110)), res(int32(2), zxid, int32(-101)), res(int32(3), zxid, int32(-111)),
+			},
+			want: []metric.ProtocolMessage{
+				{Command: "create", Resource: "/services/api", Code: "NODEEXISTS"},
+				{Command: "exists", Resource: "/services/web"},
+				{Command: "delete", Resource: "/services", Code: "NOTEMPTY"},
+			},
+		},
+		{
+			name: "multi",
+			segments: []streamSegment{
+				req(int32(5), int32(14), int32(2), false, int32(-1), "/jobs/a", int32(-1),
+					int32(1), false, int32(-1), "/jobs/b", "", int32(0), int32(0), int32(-1), true, int32(-1)),
+				res(int32(5), zxid, int32(0), int32(-1), false, int32(-1), int32(-2),
+					int32(-1), false, int32(-1), int32(-110), int32(-1), true, int32(-1)),
+			},
+			want: []metric.ProtocolMessage{{Command: "multi", Resource: "/jobs/a", Code: "NODEEXISTS"}},
+		},
+		{
+			name: "watch events",
+			segments: []streamSegment{
+				res(int32(zkXidWatch), int64(-1), int32(0), int32(3), int32(3), "/config/app"),
+				res(int32(zkXidWatch), int64(-1), int32(0), int32(-1), int32(zkSessionExpired), ""),
+			},
+			want: []metric.ProtocolMessage{
+				{Counters: map[string]uint64{"watch.total": 1, "watch.nodeDataChanged": 1}},
+				{Counters: map[string]uint64{"sessions.expired": 1}},
+			},
+		},
+		{
+			name:     "ping",
+			segments: []streamSegment{req(int32(-2), int32(11)), res(int32(-2), zxid, int32(0))},
+			want:     []metric.ProtocolMessage{{Command: "ping"}},
+		},
+		{
+			name:     "timeout",
+			segments: []streamSegment{req(int32(7), int32(8), "/services", false)},
+			sweep:    true,
+			want:     []metric.ProtocolMessage{{Command: "getChildren", Resource: "/services", Result: metric.ResultTimeout}},
+		},
+	})
+}